@@ -1,12 +1,10 @@
 package main
 
 import (
-	"bufio"
 	"bytes"
 	"flag"
 	"github.com/bitly/nsq/nsq"
 	"log"
-	"net"
 	"runtime"
 	"sync"
 	"time"
@@ -50,30 +48,16 @@ func main() {
 }
 
 func pubWorker(n int, tcpAddr string, batchSize int, batch [][]byte, topic string) {
-	conn, err := net.DialTimeout("tcp", tcpAddr, time.Second)
-	if err != nil {
-		panic(err.Error())
-	}
-	conn.Write(nsq.MagicV2)
-	rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+	w := nsq.NewWriter(tcpAddr)
+	defer w.Stop()
 
 	num := n / runtime.GOMAXPROCS(0) / batchSize
 	for i := 0; i < num; i += 1 {
-		cmd, _ := nsq.MultiPublish(topic, batch)
-		err := cmd.Write(rw)
-		if err != nil {
-			panic(err.Error())
-		}
-		err = rw.Flush()
-		if err != nil {
-			panic(err.Error())
-		}
-		resp, err := nsq.ReadResponse(rw)
+		frameType, data, err := w.MultiPublish(topic, batch)
 		if err != nil {
 			panic(err.Error())
 		}
-		_, data, _ := nsq.UnpackResponse(resp)
-		if !bytes.Equal(data, []byte("OK")) {
+		if frameType == nsq.FrameTypeError || !bytes.Equal(data, []byte("OK")) {
 			panic("invalid response")
 		}
 	}
@@ -16,6 +16,7 @@ var (
 	topic            = flag.String("topic", "", "nsq topic")
 	channel          = flag.String("channel", "nsq_tail#ephemeral", "nsq channel")
 	maxInFlight      = flag.Int("max-in-flight", 200, "max number of messages to allow in flight")
+	sampleRate       = flag.Int("sample-rate", 0, "percentage of messages to receive (1-99, 0 receives every message)")
 	nsqdTCPAddrs     = util.StringArray{}
 	lookupdHTTPAddrs = util.StringArray{}
 )
@@ -55,6 +56,10 @@ func main() {
 		log.Fatalf("--max-in-flight must be > 0")
 	}
 
+	if *sampleRate < 0 || *sampleRate > 99 {
+		log.Fatalf("--sample-rate must be between 0 and 99")
+	}
+
 	if len(nsqdTCPAddrs) == 0 && len(lookupdHTTPAddrs) == 0 {
 		log.Fatalf("--nsqd-tcp-address or --lookupd-http-address required")
 	}
@@ -70,6 +75,7 @@ func main() {
 		log.Fatalf(err.Error())
 	}
 	r.SetMaxInFlight(*maxInFlight)
+	r.SampleRate = int32(*sampleRate)
 	r.AddHandler(&TailHandler{})
 
 	for _, addrString := range nsqdTCPAddrs {
@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"io"
 	"strconv"
+	"time"
 )
 
 var byteSpace = []byte(" ")
@@ -93,6 +94,12 @@ func Identify(js map[string]interface{}) (*Command, error) {
 	return &Command{[]byte("IDENTIFY"), nil, body}, nil
 }
 
+// Auth creates a new Command to authenticate (with an nsqd configured to
+// use an auth service) using the supplied secret
+func Auth(secret string) *Command {
+	return &Command{[]byte("AUTH"), nil, []byte(secret)}
+}
+
 // Register creates a new Command to add a topic/channel for the connected nsqd
 func Register(topic string, channel string) *Command {
 	params := [][]byte{[]byte(topic)}
@@ -123,6 +130,13 @@ func Publish(topic string, body []byte) *Command {
 	return &Command{[]byte("PUB"), params, body}
 }
 
+// DeferredPublish creates a new Command to write a message to a given topic
+// that will not be made available to consumers until the specified delay has elapsed
+func DeferredPublish(topic string, delay time.Duration, body []byte) *Command {
+	var params = [][]byte{[]byte(topic), []byte(strconv.Itoa(int(delay / time.Millisecond)))}
+	return &Command{[]byte("DPUB"), params, body}
+}
+
 // MultiPublish creates a new Command to write more than one message to a given topic.
 // This is useful for high-throughput situations to avoid roundtrips and saturate the pipe.
 func MultiPublish(topic string, bodies [][]byte) (*Command, error) {
@@ -189,6 +203,33 @@ func Touch(id MessageID) *Command {
 	return &Command{[]byte("TOUCH"), params, nil}
 }
 
+// MultiFinish creates a new Command to indicate that
+// the given messages (by id) have been processed successfully
+func MultiFinish(ids []MessageID) *Command {
+	return &Command{[]byte("FIN"), idParams(ids), nil}
+}
+
+// MultiRequeue creates a new Command to indicate that the given
+// messages (by id) should be requeued after the given timeout (in ms)
+func MultiRequeue(ids []MessageID, timeoutMs int) *Command {
+	params := append(idParams(ids), []byte(strconv.Itoa(timeoutMs)))
+	return &Command{[]byte("REQ"), params, nil}
+}
+
+// MultiTouch creates a new Command to reset the timeout for
+// the given messages (by id)
+func MultiTouch(ids []MessageID) *Command {
+	return &Command{[]byte("TOUCH"), idParams(ids), nil}
+}
+
+func idParams(ids []MessageID) [][]byte {
+	params := make([][]byte, 0, len(ids)+1)
+	for i := range ids {
+		params = append(params, ids[i][:])
+	}
+	return params
+}
+
 // StartClose creates a new Command to indicate that the
 // client would like to start a close cycle.  nsqd will no longer
 // send messages to a client in this state and the client is expected
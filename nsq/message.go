@@ -3,14 +3,40 @@ package nsq
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"sort"
 	"time"
 )
 
 // The number of bytes for a Message.Id
 const MsgIdLength = 16
 
+// The versions of the serialized message format
+const (
+	MessageVersion1 = 1 // timestamp, attempts, id, and body
+	MessageVersion2 = 2 // prefixed with a marker and version, adds headers
+)
+
+// the first byte of a serialized message (after version 1), it can't be confused
+// with the first byte of a version 1 timestamp
+const messageVersionMarker = 0xff
+
+// The maximum number of headers (and length of a header key or value)
+const MaxMessageHeaders = 1<<16 - 1
+
+// The header of a published message holding its (optional) dedup key, nsqd
+// drops a message whose key was published within its --dedup-window
+const DedupKeyHeader = "dedup_key"
+
+// The header of a published message holding its (optional) partition key,
+// nsqd delivers the messages of a channel with the same key to the same client
+const PartitionKeyHeader = "partition_key"
+
+var errHeadersTooLarge = errors.New("message headers too large")
+
 type MessageID [MsgIdLength]byte
 
 // Message is the fundamental data type containing
@@ -20,6 +46,15 @@ type Message struct {
 	Body      []byte
 	Timestamp int64
 	Attempts  uint16
+
+	// Headers are string key/value pairs serialized with the message
+	// (only delivered to clients that negotiate MessageVersion2)
+	Headers map[string]string
+
+	// Deferred is the delay requested via DPUB before nsqd makes the
+	// message available to consumers (nsqd persists the time it is due
+	// with a message written to disk, it is not sent to consumers)
+	Deferred time.Duration
 }
 
 // NewMessage creates a Message, initializes some metadata,
@@ -32,6 +67,19 @@ func NewMessage(id MessageID, body []byte) *Message {
 	}
 }
 
+// Header returns the value of the header key (or "" if it isn't set)
+func (m *Message) Header(key string) string {
+	return m.Headers[key]
+}
+
+// SetHeader sets the header key to value
+func (m *Message) SetHeader(key string, value string) {
+	if m.Headers == nil {
+		m.Headers = make(map[string]string)
+	}
+	m.Headers[key] = value
+}
+
 // EncodeBytes serializes the message into a new, returned, []byte
 func (m *Message) EncodeBytes() ([]byte, error) {
 	var buf bytes.Buffer
@@ -42,10 +90,31 @@ func (m *Message) EncodeBytes() ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
-// Write serializes the message into the supplied writer.
+// Write serializes the message into the supplied writer, as MessageVersion2 when
+// it has headers (otherwise MessageVersion1).
 //
 // It is suggested that the target Writer is buffered to avoid performing many system calls.
 func (m *Message) Write(w io.Writer) error {
+	if len(m.Headers) > 0 {
+		return m.WriteVersion(w, MessageVersion2)
+	}
+	return m.WriteVersion(w, MessageVersion1)
+}
+
+// WriteVersion serializes the message into the supplied writer in the specified
+// format version (headers are dropped for MessageVersion1)
+func (m *Message) WriteVersion(w io.Writer, version int) error {
+	switch version {
+	case MessageVersion1:
+	case MessageVersion2:
+		_, err := w.Write([]byte{messageVersionMarker, byte(version)})
+		if err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unsupported message version %d", version)
+	}
+
 	err := binary.Write(w, binary.BigEndian, &m.Timestamp)
 	if err != nil {
 		return err
@@ -61,6 +130,13 @@ func (m *Message) Write(w io.Writer) error {
 		return err
 	}
 
+	if version == MessageVersion2 {
+		err = writeHeaders(w, m.Headers)
+		if err != nil {
+			return err
+		}
+	}
+
 	_, err = w.Write(m.Body)
 	if err != nil {
 		return err
@@ -70,11 +146,24 @@ func (m *Message) Write(w io.Writer) error {
 }
 
 // DecodeMessage deseralizes data (as []byte) and creates a new Message
+// (of either version)
 func DecodeMessage(byteBuf []byte) (*Message, error) {
 	var timestamp int64
 	var attempts uint16
 	var msg Message
 
+	version := MessageVersion1
+	if len(byteBuf) > 0 && byteBuf[0] == messageVersionMarker {
+		if len(byteBuf) < 2 {
+			return nil, io.ErrUnexpectedEOF
+		}
+		version = int(byteBuf[1])
+		if version != MessageVersion2 {
+			return nil, fmt.Errorf("unsupported message version %d", version)
+		}
+		byteBuf = byteBuf[2:]
+	}
+
 	buf := bytes.NewBuffer(byteBuf)
 
 	err := binary.Read(buf, binary.BigEndian, &timestamp)
@@ -92,6 +181,13 @@ func DecodeMessage(byteBuf []byte) (*Message, error) {
 		return nil, err
 	}
 
+	if version == MessageVersion2 {
+		msg.Headers, err = readHeaders(buf)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	body, err := ioutil.ReadAll(buf)
 	if err != nil {
 		return nil, err
@@ -103,3 +199,129 @@ func DecodeMessage(byteBuf []byte) (*Message, error) {
 
 	return &msg, nil
 }
+
+// DecodeMessageBatch deserializes the data of a FrameTypeMessageBatch frame
+// (a 4-byte count followed by each message prefixed by its 4-byte size)
+func DecodeMessageBatch(data []byte) ([]*Message, error) {
+	if len(data) < 4 {
+		return nil, io.ErrUnexpectedEOF
+	}
+	count := binary.BigEndian.Uint32(data)
+	data = data[4:]
+
+	if uint64(count)*4 > uint64(len(data)) {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	msgs := make([]*Message, 0, count)
+	for i := uint32(0); i < count; i++ {
+		if len(data) < 4 {
+			return nil, io.ErrUnexpectedEOF
+		}
+		size := binary.BigEndian.Uint32(data)
+		data = data[4:]
+
+		if uint64(size) > uint64(len(data)) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		msg, err := DecodeMessage(data[:size])
+		if err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, msg)
+		data = data[size:]
+	}
+
+	return msgs, nil
+}
+
+// PackHeaders prefixes body with the serialized headers, the format of the
+// PUB/DPUB/MPUB bodies of a client that negotiated MessageVersion2 via IDENTIFY
+func PackHeaders(headers map[string]string, body []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	err := writeHeaders(&buf, headers)
+	if err != nil {
+		return nil, err
+	}
+	_, err = buf.Write(body)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// UnpackHeaders splits data (in the format of PackHeaders) into its headers and body
+func UnpackHeaders(data []byte) (map[string]string, []byte, error) {
+	buf := bytes.NewBuffer(data)
+	headers, err := readHeaders(buf)
+	if err != nil {
+		return nil, nil, err
+	}
+	return headers, buf.Bytes(), nil
+}
+
+// writeHeaders serializes headers as a 2-byte count followed by each
+// key and value prefixed by its 2-byte length (sorted by key)
+func writeHeaders(w io.Writer, headers map[string]string) error {
+	if len(headers) > MaxMessageHeaders {
+		return errHeadersTooLarge
+	}
+
+	keys := make([]string, 0, len(headers))
+	for k := range headers {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	err := binary.Write(w, binary.BigEndian, uint16(len(keys)))
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		for _, s := range []string{k, headers[k]} {
+			if len(s) > MaxMessageHeaders {
+				return errHeadersTooLarge
+			}
+			err = binary.Write(w, binary.BigEndian, uint16(len(s)))
+			if err != nil {
+				return err
+			}
+			_, err = io.WriteString(w, s)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func readHeaders(buf *bytes.Buffer) (map[string]string, error) {
+	var count uint16
+	err := binary.Read(buf, binary.BigEndian, &count)
+	if err != nil {
+		return nil, err
+	}
+	if count == 0 {
+		return nil, nil
+	}
+
+	headers := make(map[string]string, count)
+	for i := uint16(0); i < count; i++ {
+		var kv [2]string
+		for j := range kv {
+			var size uint16
+			err = binary.Read(buf, binary.BigEndian, &size)
+			if err != nil {
+				return nil, err
+			}
+			if int(size) > buf.Len() {
+				return nil, io.ErrUnexpectedEOF
+			}
+			kv[j] = string(buf.Next(int(size)))
+		}
+		headers[kv[0]] = kv[1]
+	}
+
+	return headers, nil
+}
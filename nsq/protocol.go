@@ -22,6 +22,8 @@ const (
 	FrameTypeError int32 = 1
 	// when it's a serialized message
 	FrameTypeMessage int32 = 2
+	// when it's a batch of serialized messages (negotiated via IDENTIFY)
+	FrameTypeMessageBatch int32 = 3
 )
 
 // The amount of time nsqd will allow a client to idle, can be overriden
@@ -29,6 +31,7 @@ const DefaultClientTimeout = 60 * time.Second
 
 var validTopicNameRegex = regexp.MustCompile(`^[\.a-zA-Z0-9_-]+$`)
 var validChannelNameRegex = regexp.MustCompile(`^[\.a-zA-Z0-9_-]+(#ephemeral)?$`)
+var validMessageIDRegex = regexp.MustCompile(`^[\.a-zA-Z0-9_-]+$`)
 
 // IsValidTopicName checks a topic name for correctness
 func IsValidTopicName(name string) bool {
@@ -46,6 +49,14 @@ func IsValidChannelName(name string) bool {
 	return validChannelNameRegex.MatchString(name)
 }
 
+// IsValidMessageID checks a producer supplied message ID for correctness
+func IsValidMessageID(id []byte) bool {
+	if len(id) != MsgIdLength {
+		return false
+	}
+	return validMessageIDRegex.Match(id)
+}
+
 // Protocol describes the basic behavior of any protocol in the system
 type Protocol interface {
 	IOLoop(conn net.Conn) error
@@ -3,8 +3,13 @@ package nsq
 import (
 	"bufio"
 	"bytes"
+	"compress/flate"
+	"crypto/tls"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"github.com/golang/snappy"
+	"io"
 	"log"
 	"math"
 	"math/rand"
@@ -68,7 +73,10 @@ type incomingMessage struct {
 
 type nsqConn struct {
 	net.Conn
-	r                *bufio.Reader
+	r                io.Reader
+	w                io.Writer
+	flusher          flusher
+	writeMtx         sync.Mutex
 	addr             string
 	stopFlag         int32
 	finishedMessages chan *FinishedMessage
@@ -77,6 +85,8 @@ type nsqConn struct {
 	messagesFinished uint64
 	messagesRequeued uint64
 	rdyCount         int64
+	maxRdyCount      int64
+	maxBatchSize     int64
 	readTimeout      time.Duration
 	writeTimeout     time.Duration
 	stopper          sync.Once
@@ -96,7 +106,9 @@ func newNSQConn(addr string, readTimeout time.Duration, writeTimeout time.Durati
 	nc := &nsqConn{
 		Conn:             conn,
 		r:                bufio.NewReader(conn),
+		w:                conn,
 		addr:             addr,
+		maxRdyCount:      MaxReadyCount,
 		finishedMessages: make(chan *FinishedMessage),
 		readTimeout:      readTimeout,
 		writeTimeout:     writeTimeout,
@@ -116,6 +128,74 @@ func newNSQConn(addr string, readTimeout time.Duration, writeTimeout time.Durati
 	return nc, nil
 }
 
+// upgradeTLS performs the client side of a TLS handshake (after nsqd agreed
+// to it in response to IDENTIFY) and reads the final response sent over TLS
+func (c *nsqConn) upgradeTLS(conf *tls.Config) error {
+	if conf == nil {
+		host, _, _ := net.SplitHostPort(c.addr)
+		conf = &tls.Config{ServerName: host}
+	}
+
+	tlsConn := tls.Client(c.Conn, conf)
+	tlsConn.SetDeadline(time.Now().Add(5 * time.Second))
+	err := tlsConn.Handshake()
+	if err != nil {
+		return err
+	}
+	tlsConn.SetDeadline(time.Time{})
+
+	c.Conn = tlsConn
+	c.r = bufio.NewReader(tlsConn)
+	c.w = tlsConn
+
+	return c.readUpgradeOK()
+}
+
+// upgradeDeflate wraps the connection to (de)compress using deflate (after nsqd
+// agreed to it in response to IDENTIFY) and reads the final response sent compressed
+func (c *nsqConn) upgradeDeflate(level int) error {
+	fw, err := flate.NewWriter(c.w, level)
+	if err != nil {
+		return err
+	}
+
+	// the existing reader may have already buffered compressed data
+	c.r = bufio.NewReader(flate.NewReader(c.r))
+	c.w = fw
+	c.flusher = fw
+
+	return c.readUpgradeOK()
+}
+
+// upgradeSnappy wraps the connection to (de)compress using snappy (after nsqd
+// agreed to it in response to IDENTIFY) and reads the final response sent compressed
+func (c *nsqConn) upgradeSnappy() error {
+	sw := snappy.NewBufferedWriter(c.w)
+
+	// the existing reader may have already buffered compressed data
+	c.r = bufio.NewReader(snappy.NewReader(c.r))
+	c.w = sw
+	c.flusher = sw
+
+	return c.readUpgradeOK()
+}
+
+func (c *nsqConn) readUpgradeOK() error {
+	resp, err := ReadResponse(c)
+	if err != nil {
+		return err
+	}
+	frameType, data, err := UnpackResponse(resp)
+	if err != nil {
+		return err
+	}
+	if frameType != FrameTypeResponse || !bytes.Equal(data, []byte("OK")) {
+		return fmt.Errorf("unexpected response %d %s", frameType, data)
+	}
+
+	return nil
+}
+
 func (c *nsqConn) String() string {
 	return c.addr
 }
@@ -126,8 +206,25 @@ func (c *nsqConn) Read(p []byte) (int, error) {
 }
 
 func (c *nsqConn) Write(p []byte) (int, error) {
+	c.writeMtx.Lock()
+	defer c.writeMtx.Unlock()
+
 	c.SetWriteDeadline(time.Now().Add(c.writeTimeout))
-	return c.Conn.Write(p)
+	n, err := c.w.Write(p)
+	if err != nil {
+		return n, err
+	}
+
+	// compressed data is buffered by the compressor until flushed
+	if c.flusher != nil {
+		err = c.flusher.Flush()
+	}
+
+	return n, err
+}
+
+type flusher interface {
+	Flush() error
 }
 
 func (c *nsqConn) sendCommand(buf *bytes.Buffer, cmd *Command) error {
@@ -159,6 +256,19 @@ type Reader struct {
 	VerboseLogging      bool          // enable verbose logging
 	ShortIdentifier     string        // an identifier to send to nsqd when connecting (defaults: short hostname)
 	LongIdentifier      string        // an identifier to send to nsqd when connecting (defaults: long hostname)
+	TLSv1               bool          // negotiate TLS with nsqd (connecting fails if nsqd does not agree)
+	TLSConfig           *tls.Config   // client TLS configuration (defaults: verify nsqd's certificate against the system roots)
+	Deflate             bool          // negotiate deflate compression with nsqd (uncompressed if nsqd does not agree)
+	DeflateLevel        int           // the deflate compression level to request (1-9, defaults: 6)
+	Snappy              bool          // negotiate snappy compression with nsqd (uncompressed if nsqd does not agree)
+	AuthSecret          string        // secret sent via AUTH to nsqd configured with an auth service
+	OutputBufferSize    int64         // size of the buffer (in bytes) nsqd uses for this connection (defaults: nsqd's default, -1 disables)
+	OutputBufferTimeout time.Duration // duration after which nsqd flushes buffered data (defaults: nsqd's default, -1 disables)
+	MsgTimeout          time.Duration // duration after which nsqd requeues in-flight messages (defaults: nsqd's --msg-timeout)
+	SampleRate          int32         // percentage (1-99) of messages nsqd delivers to this connection (defaults: 0, every message)
+	FinishBatchTimeout  time.Duration // duration a finished message may be held to be sent in a batched FIN (defaults: 5ms, 0 disables)
+	MessageBatchSize    int32         // maximum number of messages nsqd sends in a single frame (defaults: 100, 0 disables)
+	MessageVersion      int           // the message format requested from nsqd (defaults: MessageVersion2, with headers)
 	ReadTimeout         time.Duration // the deadline set for network reads
 	WriteTimeout        time.Duration // the deadline set for network writes
 	MessagesReceived    uint64        // an atomic counter - # of messages received
@@ -212,6 +322,10 @@ func NewReader(topic string, channel string) (*Reader, error) {
 		MaxRequeueDelay:     15 * time.Minute,
 		ShortIdentifier:     strings.Split(hostname, ".")[0],
 		LongIdentifier:      hostname,
+		DeflateLevel:        6,
+		FinishBatchTimeout:  5 * time.Millisecond,
+		MessageBatchSize:    100,
+		MessageVersion:      MessageVersion2,
 		ReadTimeout:         DefaultClientTimeout,
 		WriteTimeout:        time.Second,
 		maxInFlight:         1,
@@ -246,17 +360,15 @@ func (q *Reader) IsStarved() bool {
 // SetMaxInFlight sets the maximum number of messages this reader instance
 // will allow in-flight.
 //
+// The RDY count sent to each nsqd is capped at the max it reported via feature
+// negotiation (MaxReadyCount for those that don't support it).
+//
 // If already connected, it updates the reader RDY state for each connection.
 func (q *Reader) SetMaxInFlight(maxInFlight int) {
 	if atomic.LoadInt32(&q.stopFlag) == 1 {
 		return
 	}
 
-	if maxInFlight > MaxReadyCount {
-		log.Printf("WARNING: tried to SetMaxInFlight() > %d, truncating...", MaxReadyCount)
-		maxInFlight = MaxReadyCount
-	}
-
 	if q.maxInFlight == maxInFlight {
 		return
 	}
@@ -390,6 +502,37 @@ func (q *Reader) ConnectToNSQ(addr string) error {
 	ci := make(map[string]interface{})
 	ci["short_id"] = q.ShortIdentifier
 	ci["long_id"] = q.LongIdentifier
+	ci["feature_negotiation"] = true
+	if q.OutputBufferSize != 0 {
+		ci["output_buffer_size"] = q.OutputBufferSize
+	}
+	if q.OutputBufferTimeout < 0 {
+		ci["output_buffer_timeout"] = -1
+	} else if q.OutputBufferTimeout > 0 {
+		ci["output_buffer_timeout"] = int64(q.OutputBufferTimeout / time.Millisecond)
+	}
+	if q.MsgTimeout > 0 {
+		ci["msg_timeout"] = int64(q.MsgTimeout / time.Millisecond)
+	}
+	if q.SampleRate > 0 {
+		ci["sample_rate"] = q.SampleRate
+	}
+	if q.MessageBatchSize > 0 {
+		ci["message_batch_size"] = q.MessageBatchSize
+	}
+	if q.MessageVersion > 0 {
+		ci["message_version"] = q.MessageVersion
+	}
+	if q.TLSv1 {
+		ci["tls_v1"] = true
+	}
+	if q.Deflate {
+		ci["deflate"] = true
+		ci["deflate_level"] = q.DeflateLevel
+	}
+	if q.Snappy {
+		ci["snappy"] = true
+	}
 	cmd, err := Identify(ci)
 	if err != nil {
 		connection.Close()
@@ -402,6 +545,20 @@ func (q *Reader) ConnectToNSQ(addr string) error {
 		return fmt.Errorf("[%s] failed to identify - %s", connection, err.Error())
 	}
 
+	err = q.negotiate(connection)
+	if err != nil {
+		connection.Close()
+		return fmt.Errorf("[%s] failed to negotiate features - %s", connection, err.Error())
+	}
+
+	if q.AuthSecret != "" {
+		err = q.auth(&buf, connection)
+		if err != nil {
+			connection.Close()
+			return fmt.Errorf("[%s] failed to AUTH - %s", connection, err.Error())
+		}
+	}
+
 	cmd = Subscribe(q.TopicName, q.ChannelName)
 	err = connection.sendCommand(&buf, cmd)
 	if err != nil {
@@ -418,6 +575,105 @@ func (q *Reader) ConnectToNSQ(addr string) error {
 	return nil
 }
 
+// negotiate synchronously reads the response to IDENTIFY (nsqd's limits and the features it
+// agreed to) and upgrades the connection (to TLS and/or compression) accordingly
+func (q *Reader) negotiate(c *nsqConn) error {
+	resp, err := ReadResponse(c)
+	if err != nil {
+		return err
+	}
+
+	frameType, data, err := UnpackResponse(resp)
+	if err != nil {
+		return err
+	}
+
+	if frameType == FrameTypeError {
+		return fmt.Errorf("IDENTIFY error %s", data)
+	}
+
+	// nsqd that don't support feature negotiation respond with OK
+	identifyResp := struct {
+		MaxRdyCount  int64 `json:"max_rdy_count"`
+		MaxBatchSize int64 `json:"max_batch_size"`
+		TLSv1        bool  `json:"tls_v1"`
+		Deflate      bool  `json:"deflate"`
+		DeflateLevel int   `json:"deflate_level"`
+		Snappy       bool  `json:"snappy"`
+	}{}
+	err = json.Unmarshal(data, &identifyResp)
+	if err != nil && !bytes.Equal(data, []byte("OK")) {
+		return fmt.Errorf("invalid IDENTIFY response %s", data)
+	}
+
+	if identifyResp.MaxRdyCount > 0 {
+		atomic.StoreInt64(&c.maxRdyCount, identifyResp.MaxRdyCount)
+	}
+
+	// nsqd that don't support batched FIN respond without max_batch_size
+	atomic.StoreInt64(&c.maxBatchSize, identifyResp.MaxBatchSize)
+
+	if q.TLSv1 && !identifyResp.TLSv1 {
+		return errors.New("nsqd does not support TLS")
+	}
+
+	if identifyResp.TLSv1 {
+		log.Printf("[%s] upgrading to TLS", c)
+		err = c.upgradeTLS(q.TLSConfig)
+		if err != nil {
+			return err
+		}
+	}
+
+	if identifyResp.Snappy {
+		log.Printf("[%s] upgrading to snappy", c)
+		err = c.upgradeSnappy()
+		if err != nil {
+			return err
+		}
+	} else if q.Snappy {
+		log.Printf("[%s] nsqd did not agree to snappy, continuing uncompressed", c)
+	}
+
+	if identifyResp.Deflate {
+		log.Printf("[%s] upgrading to deflate (level %d)", c, identifyResp.DeflateLevel)
+		err = c.upgradeDeflate(identifyResp.DeflateLevel)
+		if err != nil {
+			return err
+		}
+	} else if q.Deflate {
+		log.Printf("[%s] nsqd did not agree to deflate, continuing uncompressed", c)
+	}
+
+	return nil
+}
+
+// auth synchronously sends AUTH and reads the response
+func (q *Reader) auth(buf *bytes.Buffer, c *nsqConn) error {
+	err := c.sendCommand(buf, Auth(q.AuthSecret))
+	if err != nil {
+		return err
+	}
+
+	resp, err := ReadResponse(c)
+	if err != nil {
+		return err
+	}
+
+	frameType, data, err := UnpackResponse(resp)
+	if err != nil {
+		return err
+	}
+
+	if frameType == FrameTypeError {
+		return fmt.Errorf("AUTH error %s", data)
+	}
+
+	log.Printf("[%s] AUTH succeeded %s", c, data)
+
+	return nil
+}
+
 func handleError(q *Reader, c *nsqConn, errMsg string) {
 	log.Printf(errMsg)
 	atomic.StoreInt32(&c.stopFlag, 1)
@@ -467,18 +723,16 @@ func (q *Reader) readLoop(c *nsqConn) {
 				handleError(q, c, fmt.Sprintf("[%s] error (%s) decoding message %s", c, err.Error(), data))
 				continue
 			}
-
-			remain := atomic.AddInt64(&c.rdyCount, -1)
-			atomic.AddUint64(&c.messagesReceived, 1)
-			atomic.AddUint64(&q.MessagesReceived, 1)
-			atomic.AddInt64(&c.messagesInFlight, 1)
-			atomic.AddInt64(&q.messagesInFlight, 1)
-
-			if q.VerboseLogging {
-				log.Printf("[%s] (remain %d) FrameTypeMessage: %s - %s", c, remain, msg.Id, msg.Body)
+			q.receiveMessage(c, msg)
+		case FrameTypeMessageBatch:
+			msgs, err := DecodeMessageBatch(data)
+			if err != nil {
+				handleError(q, c, fmt.Sprintf("[%s] error (%s) decoding message batch", c, err.Error()))
+				continue
+			}
+			for _, msg := range msgs {
+				q.receiveMessage(c, msg)
 			}
-
-			q.incomingMessages <- &incomingMessage{msg, c.finishedMessages}
 		case FrameTypeResponse:
 			switch {
 			case bytes.Equal(data, []byte("CLOSE_WAIT")):
@@ -512,11 +766,29 @@ exit:
 	log.Printf("[%s] readLoop exiting", c)
 }
 
+// receiveMessage accounts for a message received over the connection and
+// passes it to the handlers
+func (q *Reader) receiveMessage(c *nsqConn, msg *Message) {
+	remain := atomic.AddInt64(&c.rdyCount, -1)
+	atomic.AddUint64(&c.messagesReceived, 1)
+	atomic.AddUint64(&q.MessagesReceived, 1)
+	atomic.AddInt64(&c.messagesInFlight, 1)
+	atomic.AddInt64(&q.messagesInFlight, 1)
+
+	if q.VerboseLogging {
+		log.Printf("[%s] (remain %d) FrameTypeMessage: %s - %s", c, remain, msg.Id, msg.Body)
+	}
+
+	q.incomingMessages <- &incomingMessage{msg, c.finishedMessages}
+}
+
 func (q *Reader) finishLoop(c *nsqConn) {
 	var buf bytes.Buffer
 	var backoffCounter int32
 	var backoffUpdated bool
 	var backoffDeadline time.Time
+	var finishBatch []MessageID
+	var finishBatchChan <-chan time.Time
 
 	for {
 		select {
@@ -525,6 +797,14 @@ func (q *Reader) finishLoop(c *nsqConn) {
 			// Indicate drainReady because we will not pull any more off finishedMessages
 			c.drainReady <- 1
 			goto exit
+		case <-finishBatchChan:
+			finishBatchChan = nil
+			err := q.sendFinishBatch(c, &buf, finishBatch)
+			finishBatch = finishBatch[:0]
+			if err != nil {
+				q.stopFinishLoop(c)
+				continue
+			}
 		case msg := <-c.finishedMessages:
 			// Decrement this here so it is correct even if we can't respond to nsqd
 			atomic.AddInt64(&q.messagesInFlight, -1)
@@ -536,11 +816,22 @@ func (q *Reader) finishLoop(c *nsqConn) {
 					log.Printf("[%s] finishing %s", c, msg.Id)
 				}
 
-				err := c.sendCommand(&buf, Finish(msg.Id))
-				if err != nil {
-					log.Printf("[%s] error finishing %s - %s", c, msg.Id, err.Error())
-					q.stopFinishLoop(c)
-					continue
+				// FINs are coalesced (when nsqd supports batches) unless the batch is
+				// full or nothing else is in-flight (there'd be nothing to coalesce with)
+				finishBatch = append(finishBatch, msg.Id)
+				maxBatchSize := atomic.LoadInt64(&c.maxBatchSize)
+				if q.FinishBatchTimeout <= 0 || maxBatchSize <= 0 ||
+					int64(len(finishBatch)) >= maxBatchSize ||
+					atomic.LoadInt64(&c.messagesInFlight) == 0 {
+					finishBatchChan = nil
+					err := q.sendFinishBatch(c, &buf, finishBatch)
+					finishBatch = finishBatch[:0]
+					if err != nil {
+						q.stopFinishLoop(c)
+						continue
+					}
+				} else if finishBatchChan == nil {
+					finishBatchChan = time.After(q.FinishBatchTimeout)
 				}
 
 				atomic.AddUint64(&c.messagesFinished, 1)
@@ -555,6 +846,18 @@ func (q *Reader) finishLoop(c *nsqConn) {
 					log.Printf("[%s] requeuing %s", c, msg.Id)
 				}
 
+				// send any pending FINs first (so that none are pending when
+				// nothing is in-flight)
+				if len(finishBatch) > 0 {
+					finishBatchChan = nil
+					err := q.sendFinishBatch(c, &buf, finishBatch)
+					finishBatch = finishBatch[:0]
+					if err != nil {
+						q.stopFinishLoop(c)
+						continue
+					}
+				}
+
 				err := c.sendCommand(&buf, Requeue(msg.Id, msg.RequeueDelayMs))
 				if err != nil {
 					log.Printf("[%s] error requeueing %s - %s", c, msg.Id, err.Error())
@@ -592,6 +895,15 @@ exit:
 	log.Printf("[%s] finishLoop exiting", c)
 }
 
+// sendFinishBatch sends a single FIN for the finished messages
+func (q *Reader) sendFinishBatch(c *nsqConn, buf *bytes.Buffer, ids []MessageID) error {
+	err := c.sendCommand(buf, MultiFinish(ids))
+	if err != nil {
+		log.Printf("[%s] error finishing %d message(s) - %s", c, len(ids), err.Error())
+	}
+	return err
+}
+
 func (q *Reader) stopFinishLoop(c *nsqConn) {
 	c.stopper.Do(func() {
 		log.Printf("[%s] beginning stopFinishLoop logic", c)
@@ -688,6 +1000,10 @@ func (q *Reader) updateRDY(c *nsqConn) error {
 
 	remain := atomic.LoadInt64(&c.rdyCount)
 	mif := q.ConnectionMaxInFlight()
+	maxRdyCount := int(atomic.LoadInt64(&c.maxRdyCount))
+	if mif > maxRdyCount {
+		mif = maxRdyCount
+	}
 	// refill when at 1, or at 25% whichever comes first
 	if remain <= 1 || remain < (int64(mif)/int64(4)) {
 		if q.VerboseLogging {
@@ -2,6 +2,7 @@ package nsq
 
 import (
 	"bytes"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"github.com/bitly/go-simplejson"
@@ -10,6 +11,7 @@ import (
 	"net/http"
 	"os"
 	"strconv"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -59,13 +61,40 @@ func SendMessage(t *testing.T, port int, topic string, method string, body []byt
 }
 
 func TestQueuereader(t *testing.T) {
+	readerTest(t, "reader_test", false, false, false)
+}
+
+func TestQueuereaderTLSv1(t *testing.T) {
+	readerTest(t, "reader_tls_test", true, false, false)
+}
+
+func TestQueuereaderDeflate(t *testing.T) {
+	readerTest(t, "reader_deflate_test", false, true, false)
+}
+
+func TestQueuereaderSnappy(t *testing.T) {
+	readerTest(t, "reader_snappy_test", false, false, true)
+}
+
+func TestQueuereaderTLSv1Snappy(t *testing.T) {
+	readerTest(t, "reader_tls_snappy_test", true, false, true)
+}
+
+func readerTest(t *testing.T, topicPrefix string, tlsv1 bool, deflate bool, snappy bool) {
 	log.SetOutput(ioutil.Discard)
 	defer log.SetOutput(os.Stdout)
 
 	addr := "127.0.0.1:4150"
-	topicName := "reader_test" + strconv.Itoa(int(time.Now().Unix()))
+	topicName := topicPrefix + strconv.Itoa(int(time.Now().Unix()))
 	q, _ := NewReader(topicName, "ch")
 	q.VerboseLogging = true
+	if tlsv1 {
+		// nsqd is started with a self-signed certificate
+		q.TLSv1 = true
+		q.TLSConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	q.Deflate = deflate
+	q.Snappy = snappy
 	// so that the test can simulate reaching max requeues and a call to LogFailedMessage
 	q.DefaultRequeueDelay = 0
 	// so that the test wont timeout from backing off
@@ -87,6 +116,11 @@ func TestQueuereader(t *testing.T) {
 		t.Fatalf(err.Error())
 	}
 
+	// nsqd reports its max RDY count via feature negotiation
+	if atomic.LoadInt64(&q.nsqConnections[addr].maxRdyCount) != MaxReadyCount {
+		t.Fatalf("max RDY count was not negotiated")
+	}
+
 	err = q.ConnectToNSQ(addr)
 	if err == nil {
 		t.Fatalf("should not be able to connect to the same NSQ twice")
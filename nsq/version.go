@@ -3,7 +3,8 @@
 // It provides the building blocks for developing applications on the NSQ platform in Go.
 //
 // Low-level functions and types are provided to communicate over the NSQ protocol as well
-// as a high-level Reader library to implement robust consumers.
+// as a high-level Reader library to implement robust consumers and Writer library to
+// implement producers.
 package nsq
 
 const VERSION = "0.3.1"
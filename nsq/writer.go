@@ -0,0 +1,439 @@
+package nsq
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// returned from Publish/MultiPublish (and their async variants) when
+// the Writer has been stopped
+var ErrStopped = errors.New("stopped")
+
+// returned from Publish/MultiPublish (and their async variants) when
+// the connection to nsqd was lost before a response was received
+var ErrNotConnected = errors.New("not connected")
+
+// Writer is a high-level type to publish to NSQ.
+//
+// A Writer instance is 1:1 with a destination nsqd and will lazily connect to that
+// instance (and re-connect) when Publish commands are executed.
+//
+// Commands are pipelined over the connection and their responses are matched up,
+// in order, with the transactions that produced them.
+type Writer struct {
+	net.Conn
+
+	Addr              string        // the nsqd TCP address to publish to
+	WriteTimeout      time.Duration // the deadline set for network writes
+	HeartbeatInterval time.Duration // duration between heartbeats requested via IDENTIFY
+	ShortIdentifier   string        // an identifier to send to nsqd when connecting (defaults: short hostname)
+	LongIdentifier    string        // an identifier to send to nsqd when connecting (defaults: long hostname)
+
+	// internal variables
+	sync.Mutex
+	concurrentWriters int32
+	transactionChan   chan *WriterTransaction
+	dataChan          chan []byte
+	transactions      []*WriterTransaction
+	state             int32
+	stopFlag          int32
+	exitChan          chan int
+	closeChan         chan int
+	wg                sync.WaitGroup
+}
+
+// WriterTransaction is returned by the async publish methods
+// to retrieve metadata about the command after the
+// response is received.
+type WriterTransaction struct {
+	cmd       *Command
+	doneChan  chan *WriterTransaction
+	FrameType int32         // the frame type received in response to the publish command
+	Data      []byte        // the response data of the publish command
+	Error     error         // the error (or nil) of the publish command
+	Args      []interface{} // the slice of variadic arguments passed to PublishAsync or MultiPublishAsync
+}
+
+func (t *WriterTransaction) finish() {
+	if t.doneChan != nil {
+		t.doneChan <- t
+	}
+}
+
+// NewWriter returns an instance of Writer for the specified address
+//
+// The returned Writer instance is setup with sane default values.  To modify
+// configuration, update the values on the returned instance before publishing.
+func NewWriter(addr string) *Writer {
+	hostname, err := os.Hostname()
+	if err != nil {
+		log.Fatalf("ERROR: unable to get hostname %s", err.Error())
+	}
+	return &Writer{
+		Addr:              addr,
+		WriteTimeout:      time.Second,
+		HeartbeatInterval: DefaultClientTimeout / 2,
+		ShortIdentifier:   strings.Split(hostname, ".")[0],
+		LongIdentifier:    hostname,
+
+		transactionChan: make(chan *WriterTransaction),
+		exitChan:        make(chan int),
+		dataChan:        make(chan []byte),
+	}
+}
+
+// String returns the address of the Writer
+func (w *Writer) String() string {
+	return w.Addr
+}
+
+// Stop disconnects and permanently stops the Writer
+func (w *Writer) Stop() {
+	if !atomic.CompareAndSwapInt32(&w.stopFlag, 0, 1) {
+		return
+	}
+	close(w.exitChan)
+	w.close()
+	w.wg.Wait()
+}
+
+// PublishAsync publishes a message body to the specified topic
+// but does not wait for the response from nsqd.
+//
+// When the Writer eventually receives the response from nsqd,
+// the supplied doneChan (if specified)
+// will receive a WriterTransaction instance with the supplied variadic arguments
+// (and the response FrameType, Data, and Error)
+func (w *Writer) PublishAsync(topic string, body []byte, doneChan chan *WriterTransaction, args ...interface{}) error {
+	return w.sendCommandAsync(Publish(topic, body), doneChan, args)
+}
+
+// DeferredPublishAsync publishes a message body to the specified topic
+// (to be made available to consumers after the specified delay)
+// but does not wait for the response from nsqd.
+//
+// When the Writer eventually receives the response from nsqd,
+// the supplied doneChan (if specified)
+// will receive a WriterTransaction instance with the supplied variadic arguments
+// (and the response FrameType, Data, and Error)
+func (w *Writer) DeferredPublishAsync(topic string, delay time.Duration, body []byte, doneChan chan *WriterTransaction, args ...interface{}) error {
+	return w.sendCommandAsync(DeferredPublish(topic, delay, body), doneChan, args)
+}
+
+// MultiPublishAsync publishes a slice of message bodies to the specified topic
+// but does not wait for the response from nsqd.
+//
+// When the Writer eventually receives the response from nsqd,
+// the supplied doneChan (if specified)
+// will receive a WriterTransaction instance with the supplied variadic arguments
+// (and the response FrameType, Data, and Error)
+func (w *Writer) MultiPublishAsync(topic string, body [][]byte, doneChan chan *WriterTransaction, args ...interface{}) error {
+	cmd, err := MultiPublish(topic, body)
+	if err != nil {
+		return err
+	}
+	return w.sendCommandAsync(cmd, doneChan, args)
+}
+
+// Publish synchronously publishes a message body to the specified topic, returning
+// the response frameType, data, and error
+func (w *Writer) Publish(topic string, body []byte) (int32, []byte, error) {
+	return w.sendCommand(Publish(topic, body))
+}
+
+// DeferredPublish synchronously publishes a message body to the specified topic
+// (to be made available to consumers after the specified delay), returning
+// the response frameType, data, and error
+func (w *Writer) DeferredPublish(topic string, delay time.Duration, body []byte) (int32, []byte, error) {
+	return w.sendCommand(DeferredPublish(topic, delay, body))
+}
+
+// MultiPublish synchronously publishes a slice of message bodies to the specified topic, returning
+// the response frameType, data, and error
+func (w *Writer) MultiPublish(topic string, body [][]byte) (int32, []byte, error) {
+	cmd, err := MultiPublish(topic, body)
+	if err != nil {
+		return -1, nil, err
+	}
+	return w.sendCommand(cmd)
+}
+
+func (w *Writer) sendCommand(cmd *Command) (int32, []byte, error) {
+	doneChan := make(chan *WriterTransaction)
+	err := w.sendCommandAsync(cmd, doneChan, nil)
+	if err != nil {
+		return -1, nil, err
+	}
+	t := <-doneChan
+	return t.FrameType, t.Data, t.Error
+}
+
+func (w *Writer) sendCommandAsync(cmd *Command, doneChan chan *WriterTransaction, args []interface{}) error {
+	// keep track of how many outstanding writers we're dealing with
+	// in order to later ensure that we clean them all up...
+	atomic.AddInt32(&w.concurrentWriters, 1)
+	defer atomic.AddInt32(&w.concurrentWriters, -1)
+
+	if atomic.LoadInt32(&w.state) != StateConnected {
+		err := w.connect()
+		if err != nil {
+			return err
+		}
+	}
+
+	t := &WriterTransaction{
+		cmd:       cmd,
+		doneChan:  doneChan,
+		FrameType: -1,
+		Args:      args,
+	}
+
+	select {
+	case w.transactionChan <- t:
+	case <-w.exitChan:
+		return ErrStopped
+	}
+
+	return nil
+}
+
+func (w *Writer) connect() error {
+	w.Lock()
+	defer w.Unlock()
+
+	if atomic.LoadInt32(&w.stopFlag) == 1 {
+		return ErrStopped
+	}
+
+	switch atomic.LoadInt32(&w.state) {
+	case StateConnected:
+		// another goroutine won the race to connect
+		return nil
+	case StateDisconnected:
+		// the previous connection is still being cleaned up
+		return ErrNotConnected
+	}
+
+	log.Printf("[%s] connecting to nsqd", w)
+
+	conn, err := net.DialTimeout("tcp", w.Addr, time.Second)
+	if err != nil {
+		log.Printf("ERROR: [%s] failed to dial %s - %s", w, w.Addr, err.Error())
+		return err
+	}
+	w.Conn = conn
+
+	err = w.identify()
+	if err != nil {
+		w.Conn.Close()
+		return err
+	}
+
+	w.closeChan = make(chan int)
+	atomic.StoreInt32(&w.state, StateConnected)
+
+	w.wg.Add(2)
+	go w.readLoop()
+	go w.messageRouter()
+
+	return nil
+}
+
+// identify writes the protocol magic and IDENTIFY command and synchronously
+// waits for the response (before any of the loops are started)
+func (w *Writer) identify() error {
+	var buf bytes.Buffer
+
+	w.SetWriteDeadline(time.Now().Add(w.WriteTimeout))
+	_, err := w.Write(MagicV2)
+	if err != nil {
+		return fmt.Errorf("[%s] failed to write magic - %s", w, err.Error())
+	}
+
+	ci := make(map[string]interface{})
+	ci["short_id"] = w.ShortIdentifier
+	ci["long_id"] = w.LongIdentifier
+	if w.HeartbeatInterval > 0 {
+		ci["heartbeat_interval"] = int64(w.HeartbeatInterval / time.Millisecond)
+	} else {
+		ci["heartbeat_interval"] = -1
+	}
+	cmd, err := Identify(ci)
+	if err != nil {
+		return fmt.Errorf("[%s] failed to create identify command - %s", w, err.Error())
+	}
+
+	err = cmd.Write(&buf)
+	if err != nil {
+		return err
+	}
+	_, err = buf.WriteTo(w)
+	if err != nil {
+		return fmt.Errorf("[%s] failed to identify - %s", w, err.Error())
+	}
+
+	w.SetReadDeadline(time.Now().Add(w.WriteTimeout))
+	resp, err := ReadResponse(w)
+	if err != nil {
+		return fmt.Errorf("[%s] failed to read identify response - %s", w, err.Error())
+	}
+
+	frameType, data, err := UnpackResponse(resp)
+	if err != nil {
+		return fmt.Errorf("[%s] failed to unpack identify response - %s", w, err.Error())
+	}
+
+	if frameType == FrameTypeError {
+		return fmt.Errorf("[%s] identify returned error - %s", w, data)
+	}
+
+	return nil
+}
+
+func (w *Writer) close() {
+	if !atomic.CompareAndSwapInt32(&w.state, StateConnected, StateDisconnected) {
+		return
+	}
+	close(w.closeChan)
+	w.Conn.Close()
+	go func() {
+		// we need to handle this in a goroutine so we don't
+		// block the caller from making progress
+		w.wg.Wait()
+		atomic.StoreInt32(&w.state, StateInit)
+	}()
+}
+
+func (w *Writer) messageRouter() {
+	var buf bytes.Buffer
+
+	for {
+		select {
+		case t := <-w.transactionChan:
+			w.transactions = append(w.transactions, t)
+			err := w.writeCommand(&buf, t.cmd)
+			if err != nil {
+				log.Printf("ERROR: [%s] sending command - %s", w, err.Error())
+				w.close()
+			}
+		case resp := <-w.dataChan:
+			frameType, data, err := UnpackResponse(resp)
+			if err != nil {
+				log.Printf("ERROR: [%s] unpacking response - %s", w, err.Error())
+				w.close()
+				continue
+			}
+
+			if frameType == FrameTypeResponse && bytes.Equal(data, []byte("_heartbeat_")) {
+				log.Printf("[%s] received heartbeat from nsqd", w)
+				err := w.writeCommand(&buf, Nop())
+				if err != nil {
+					log.Printf("ERROR: [%s] sending NOP - %s", w, err.Error())
+					w.close()
+				}
+				continue
+			}
+
+			if len(w.transactions) == 0 {
+				log.Printf("ERROR: [%s] received unexpected response %d %s", w, frameType, data)
+				w.close()
+				continue
+			}
+
+			t := w.transactions[0]
+			w.transactions = w.transactions[1:]
+			t.FrameType = frameType
+			t.Data = data
+			t.Error = nil
+			t.finish()
+		case <-w.closeChan:
+			goto exit
+		}
+	}
+
+exit:
+	w.transactionCleanup()
+	w.wg.Done()
+	log.Printf("[%s] exiting messageRouter", w)
+}
+
+func (w *Writer) writeCommand(buf *bytes.Buffer, cmd *Command) error {
+	buf.Reset()
+	err := cmd.Write(buf)
+	if err != nil {
+		return err
+	}
+	w.SetWriteDeadline(time.Now().Add(w.WriteTimeout))
+	_, err = buf.WriteTo(w)
+	return err
+}
+
+func (w *Writer) transactionCleanup() {
+	// clean up transactions we can easily account for
+	for _, t := range w.transactions {
+		t.Error = ErrNotConnected
+		t.finish()
+	}
+	w.transactions = w.transactions[:0]
+
+	// spin and free up any writes that might have raced
+	// with the cleanup process (blocked on writing
+	// to transactionChan)
+	for {
+		select {
+		case t := <-w.transactionChan:
+			t.Error = ErrNotConnected
+			t.finish()
+		default:
+			// keep spinning until there are 0 concurrent writers
+			if atomic.LoadInt32(&w.concurrentWriters) == 0 {
+				return
+			}
+			// give the runtime a chance to schedule other racing goroutines
+			time.Sleep(5 * time.Millisecond)
+			continue
+		}
+	}
+}
+
+func (w *Writer) readLoop() {
+	var zeroTime time.Time
+
+	rbuf := bufio.NewReader(w.Conn)
+	for {
+		if w.HeartbeatInterval > 0 {
+			w.SetReadDeadline(time.Now().Add(w.HeartbeatInterval * 2))
+		} else {
+			w.SetReadDeadline(zeroTime)
+		}
+
+		resp, err := ReadResponse(rbuf)
+		if err != nil {
+			// theres no direct way to detect this error because it is not exposed
+			if !strings.Contains(err.Error(), "use of closed network connection") {
+				log.Printf("ERROR: [%s] reading response - %s", w, err.Error())
+			}
+			w.close()
+			goto exit
+		}
+
+		select {
+		case w.dataChan <- resp:
+		case <-w.closeChan:
+			goto exit
+		}
+	}
+
+exit:
+	w.wg.Done()
+	log.Printf("[%s] exiting readLoop", w)
+}
@@ -0,0 +1,411 @@
+package nsq
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// returned from WriterPool.Publish/MultiPublish when there are no
+// nsqd available to publish to
+var ErrNoWriters = errors.New("no writers available")
+
+const (
+	StrategyRoundRobin   = 0 // select nsqd in turn
+	StrategyLeastLatency = 1 // select the nsqd with the lowest observed publish latency
+)
+
+// WriterPool is a high-level type to publish to a cluster of nsqd.
+//
+// A WriterPool instance maintains a Writer for each nsqd it knows about, either
+// added directly via ConnectToNSQ or discovered by polling the /nodes endpoint
+// of nsqlookupd instances added via ConnectToLookupd (these are removed once
+// nsqlookupd no longer lists them).
+//
+// Each publish is sent to a single nsqd selected according to Strategy.  If it fails
+// (ie. the nsqd is unreachable) the nsqd is marked unhealthy for UnhealthyTimeout and
+// the publish is retried on another nsqd, up to MaxAttempts times.
+type WriterPool struct {
+	Strategy            int           // StrategyRoundRobin or StrategyLeastLatency
+	MaxAttempts         int           // maximum number of nsqd a single publish is attempted on
+	UnhealthyTimeout    time.Duration // duration an nsqd is excluded from selection after a failed publish
+	LookupdPollInterval time.Duration // duration between polling lookupd's (+/- random 1/10th this value for jitter)
+	WriteTimeout        time.Duration // the deadline set for network writes (applied to new Writers)
+	HeartbeatInterval   time.Duration // duration between heartbeats requested via IDENTIFY (applied to new Writers)
+	ShortIdentifier     string        // an identifier to send to nsqd when connecting (defaults: short hostname)
+	LongIdentifier      string        // an identifier to send to nsqd when connecting (defaults: long hostname)
+
+	// internal variables
+	sync.RWMutex
+	writers            map[string]*poolWriter
+	addrs              []string
+	counter            uint64
+	stopFlag           int32
+	lookupdHTTPAddrs   []string
+	lookupdExitChan    chan int
+	lookupdRecheckChan chan int
+}
+
+type poolWriter struct {
+	*Writer
+	latency        int64 // moving average of publish latency in nanoseconds
+	unhealthyUntil int64 // unix nanoseconds until which this nsqd should not be selected
+	discovered     bool  // discovered via lookupd (rather than added via ConnectToNSQ)
+}
+
+func (pw *poolWriter) isHealthy(now int64) bool {
+	return atomic.LoadInt64(&pw.unhealthyUntil) <= now
+}
+
+func (pw *poolWriter) markUnhealthy(d time.Duration) {
+	atomic.StoreInt64(&pw.unhealthyUntil, time.Now().Add(d).UnixNano())
+}
+
+func (pw *poolWriter) updateLatency(d time.Duration) {
+	old := atomic.LoadInt64(&pw.latency)
+	if old == 0 {
+		atomic.StoreInt64(&pw.latency, int64(d))
+		return
+	}
+	// exponentially weighted so that a single slow publish doesn't dominate
+	atomic.StoreInt64(&pw.latency, (old*7+int64(d))/8)
+}
+
+// NewWriterPool returns an instance of WriterPool
+//
+// The returned WriterPool instance is setup with sane default values.  To modify
+// configuration, update the values on the returned instance before connecting.
+func NewWriterPool() *WriterPool {
+	hostname, err := os.Hostname()
+	if err != nil {
+		log.Fatalf("ERROR: unable to get hostname %s", err.Error())
+	}
+	return &WriterPool{
+		Strategy:            StrategyRoundRobin,
+		MaxAttempts:         3,
+		UnhealthyTimeout:    10 * time.Second,
+		LookupdPollInterval: 120 * time.Second,
+		WriteTimeout:        time.Second,
+		HeartbeatInterval:   DefaultClientTimeout / 2,
+		ShortIdentifier:     strings.Split(hostname, ".")[0],
+		LongIdentifier:      hostname,
+
+		writers:            make(map[string]*poolWriter),
+		lookupdExitChan:    make(chan int),
+		lookupdRecheckChan: make(chan int, 1),
+	}
+}
+
+// ConnectToNSQ adds a nsqd address to the pool.
+//
+// The underlying Writer lazily connects when it is first selected for a publish.
+func (p *WriterPool) ConnectToNSQ(addr string) error {
+	return p.connectToNSQ(addr, false)
+}
+
+func (p *WriterPool) connectToNSQ(addr string, discovered bool) error {
+	if atomic.LoadInt32(&p.stopFlag) == 1 {
+		return ErrStopped
+	}
+
+	p.Lock()
+	defer p.Unlock()
+
+	pw, ok := p.writers[addr]
+	if ok {
+		if !discovered {
+			// added directly, it stays even if lookupd stops listing it
+			pw.discovered = false
+		}
+		return ErrAlreadyConnected
+	}
+
+	log.Printf("[%s] adding nsqd to writer pool", addr)
+
+	w := NewWriter(addr)
+	w.WriteTimeout = p.WriteTimeout
+	w.HeartbeatInterval = p.HeartbeatInterval
+	w.ShortIdentifier = p.ShortIdentifier
+	w.LongIdentifier = p.LongIdentifier
+
+	p.writers[addr] = &poolWriter{Writer: w, discovered: discovered}
+	p.addrs = append(p.addrs, addr)
+	sort.Strings(p.addrs)
+
+	return nil
+}
+
+// ConnectToLookupd adds a nsqlookupd address to the list for this WriterPool instance.
+//
+// If it is the first to be added, it initiates an HTTP request to discover all nsqd
+// registered with nsqlookupd (via /nodes).
+//
+// A goroutine is spawned to handle continual polling.
+func (p *WriterPool) ConnectToLookupd(addr string) error {
+	p.Lock()
+	for _, x := range p.lookupdHTTPAddrs {
+		if x == addr {
+			p.Unlock()
+			return errors.New("lookupd address already exists")
+		}
+	}
+	p.lookupdHTTPAddrs = append(p.lookupdHTTPAddrs, addr)
+	first := len(p.lookupdHTTPAddrs) == 1
+	p.Unlock()
+
+	// if this is the first one, kick off the go loop
+	if first {
+		p.queryLookupd()
+		go p.lookupdLoop()
+	}
+
+	return nil
+}
+
+// poll all known lookup servers every LookupdPollInterval
+func (p *WriterPool) lookupdLoop() {
+	rand.Seed(time.Now().UnixNano())
+	select {
+	case <-time.After(time.Duration(rand.Int63n(int64(p.LookupdPollInterval / 10)))):
+	case <-p.lookupdExitChan:
+		return
+	}
+	ticker := time.NewTicker(p.LookupdPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			p.queryLookupd()
+		case <-p.lookupdRecheckChan:
+			p.queryLookupd()
+		case <-p.lookupdExitChan:
+			return
+		}
+	}
+}
+
+// make a HTTP req to the /nodes endpoint on each lookup server,
+// add any nsqd we don't already know about, and remove those
+// discovered previously that are no longer listed
+func (p *WriterPool) queryLookupd() {
+	p.RLock()
+	lookupdHTTPAddrs := make([]string, len(p.lookupdHTTPAddrs))
+	copy(lookupdHTTPAddrs, p.lookupdHTTPAddrs)
+	p.RUnlock()
+
+	queried := false
+	listed := make(map[string]bool)
+	for _, addr := range lookupdHTTPAddrs {
+		endpoint := fmt.Sprintf("http://%s/nodes", addr)
+
+		log.Printf("LOOKUPD: querying %s", endpoint)
+
+		data, err := ApiRequest(endpoint)
+		if err != nil {
+			log.Printf("ERROR: lookupd %s - %s", addr, err.Error())
+			continue
+		}
+		queried = true
+
+		// {"data":{"producers":[{"address":"jehiah-air.local", "broadcast_address":"jehiah-air.local", "tcp_port":4150, "http_port":4151, ...}]},"status_code":200,"status_txt":"OK"}
+		producers, _ := data.Get("producers").Array()
+		for _, producer := range producers {
+			producerData, _ := producer.(map[string]interface{})
+			address, _ := producerData["broadcast_address"].(string)
+			if address == "" {
+				address, _ = producerData["address"].(string)
+			}
+			port, _ := producerData["tcp_port"].(float64)
+
+			joined := net.JoinHostPort(address, strconv.Itoa(int(port)))
+			listed[joined] = true
+			err = p.connectToNSQ(joined, true)
+			if err != nil && err != ErrAlreadyConnected {
+				log.Printf("ERROR: failed to add nsqd (%s) - %s", joined, err.Error())
+				continue
+			}
+		}
+	}
+
+	// don't remove anything when none of the lookupd could be queried
+	if !queried {
+		return
+	}
+
+	var removed []*poolWriter
+	p.Lock()
+	addrs := make([]string, 0, len(p.addrs))
+	for _, addr := range p.addrs {
+		pw := p.writers[addr]
+		if pw.discovered && !listed[addr] {
+			log.Printf("[%s] removing nsqd from writer pool", addr)
+			delete(p.writers, addr)
+			removed = append(removed, pw)
+			continue
+		}
+		addrs = append(addrs, addr)
+	}
+	p.addrs = addrs
+	p.Unlock()
+
+	for _, pw := range removed {
+		pw.Stop()
+	}
+}
+
+// Publish synchronously publishes a message body to the specified topic on
+// one of the nsqd in the pool, returning the response frameType, data, and error
+func (p *WriterPool) Publish(topic string, body []byte) (int32, []byte, error) {
+	return p.publish(func(w *Writer) (int32, []byte, error) {
+		return w.Publish(topic, body)
+	})
+}
+
+// DeferredPublish synchronously publishes a message body to the specified topic on
+// one of the nsqd in the pool (to be made available to consumers after the specified delay),
+// returning the response frameType, data, and error
+func (p *WriterPool) DeferredPublish(topic string, delay time.Duration, body []byte) (int32, []byte, error) {
+	return p.publish(func(w *Writer) (int32, []byte, error) {
+		return w.DeferredPublish(topic, delay, body)
+	})
+}
+
+// MultiPublish synchronously publishes a slice of message bodies to the specified topic on
+// one of the nsqd in the pool, returning the response frameType, data, and error
+func (p *WriterPool) MultiPublish(topic string, body [][]byte) (int32, []byte, error) {
+	return p.publish(func(w *Writer) (int32, []byte, error) {
+		return w.MultiPublish(topic, body)
+	})
+}
+
+func (p *WriterPool) publish(f func(*Writer) (int32, []byte, error)) (int32, []byte, error) {
+	var lastErr error
+
+	if atomic.LoadInt32(&p.stopFlag) == 1 {
+		return -1, nil, ErrStopped
+	}
+
+	tried := make(map[string]bool)
+	for i := 0; i < p.MaxAttempts; i++ {
+		pw := p.selectWriter(tried)
+		if pw == nil {
+			break
+		}
+		tried[pw.Addr] = true
+
+		start := time.Now()
+		frameType, data, err := f(pw.Writer)
+		if err != nil {
+			// a Writer is also stopped when its nsqd is removed from the pool
+			if err == ErrStopped && atomic.LoadInt32(&p.stopFlag) == 1 {
+				return frameType, data, err
+			}
+			log.Printf("ERROR: [%s] failed to publish - %s", pw, err.Error())
+			pw.markUnhealthy(p.UnhealthyTimeout)
+			lastErr = err
+			p.recheckLookupd()
+			continue
+		}
+		pw.updateLatency(time.Now().Sub(start))
+
+		// a protocol error (ie. E_BAD_TOPIC) would fail the same way elsewhere
+		return frameType, data, nil
+	}
+
+	if lastErr == nil {
+		lastErr = ErrNoWriters
+	}
+	return -1, nil, lastErr
+}
+
+// selectWriter returns the next writer according to Strategy, excluding those
+// already tried.  Unhealthy writers are only selected when no healthy one remains.
+func (p *WriterPool) selectWriter(tried map[string]bool) *poolWriter {
+	var healthy []*poolWriter
+	var unhealthy []*poolWriter
+
+	now := time.Now().UnixNano()
+
+	p.RLock()
+	for _, addr := range p.addrs {
+		if tried[addr] {
+			continue
+		}
+		pw := p.writers[addr]
+		if pw.isHealthy(now) {
+			healthy = append(healthy, pw)
+		} else {
+			unhealthy = append(unhealthy, pw)
+		}
+	}
+	p.RUnlock()
+
+	candidates := healthy
+	if len(candidates) == 0 {
+		candidates = unhealthy
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	if p.Strategy == StrategyLeastLatency {
+		best := candidates[0]
+		for _, pw := range candidates[1:] {
+			if atomic.LoadInt64(&pw.latency) < atomic.LoadInt64(&best.latency) {
+				best = pw
+			}
+		}
+		return best
+	}
+
+	idx := atomic.AddUint64(&p.counter, 1) - 1
+	return candidates[idx%uint64(len(candidates))]
+}
+
+// trigger a poll of the lookupd (if any) so that a replacement can be discovered
+func (p *WriterPool) recheckLookupd() {
+	p.RLock()
+	numLookupd := len(p.lookupdHTTPAddrs)
+	p.RUnlock()
+
+	if numLookupd == 0 || atomic.LoadInt32(&p.stopFlag) == 1 {
+		return
+	}
+
+	select {
+	case p.lookupdRecheckChan <- 1:
+	default:
+	}
+}
+
+// Stop permanently stops the WriterPool and all of its Writers
+func (p *WriterPool) Stop() {
+	if !atomic.CompareAndSwapInt32(&p.stopFlag, 0, 1) {
+		return
+	}
+
+	log.Printf("Stopping writer pool")
+
+	p.RLock()
+	writers := make([]*poolWriter, 0, len(p.writers))
+	for _, pw := range p.writers {
+		writers = append(writers, pw)
+	}
+	p.RUnlock()
+
+	// lookupdLoop (if running) may be waiting out its initial jitter
+	close(p.lookupdExitChan)
+
+	for _, pw := range writers {
+		pw.Stop()
+	}
+}
@@ -0,0 +1,191 @@
+package nsq
+
+import (
+	"encoding/json"
+	"github.com/bmizerany/assert"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWriterPoolFailover(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	topicName := "pool_failover" + strconv.Itoa(int(time.Now().Unix()))
+	msgCount := 10
+
+	p := NewWriterPool()
+	defer p.Stop()
+
+	// an unreachable nsqd should be skipped and marked unhealthy
+	err := p.ConnectToNSQ("127.0.0.1:0")
+	assert.Equal(t, err, nil)
+	err = p.ConnectToNSQ("127.0.0.1:4150")
+	assert.Equal(t, err, nil)
+	err = p.ConnectToNSQ("127.0.0.1:4150")
+	assert.Equal(t, err, ErrAlreadyConnected)
+
+	for i := 0; i < msgCount; i++ {
+		frameType, data, err := p.Publish(topicName, []byte("publish_test_case"))
+		assert.Equal(t, err, nil)
+		assert.Equal(t, frameType, FrameTypeResponse)
+		assert.Equal(t, data, []byte("OK"))
+	}
+
+	assert.Equal(t, p.writers["127.0.0.1:0"].isHealthy(time.Now().UnixNano()), false)
+	assert.Equal(t, p.writers["127.0.0.1:4150"].isHealthy(time.Now().UnixNano()), true)
+
+	frameType, data, err := p.Publish(topicName, []byte("stop_test_case"))
+	assert.Equal(t, err, nil)
+	assert.Equal(t, frameType, FrameTypeResponse)
+	assert.Equal(t, data, []byte("OK"))
+
+	readMessages(topicName, t, msgCount)
+}
+
+func TestWriterPoolLeastLatency(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	p := NewWriterPool()
+	p.Strategy = StrategyLeastLatency
+	defer p.Stop()
+
+	p.ConnectToNSQ("127.0.0.1:4150")
+	p.ConnectToNSQ("127.0.0.2:4150")
+	p.writers["127.0.0.1:4150"].latency = int64(5 * time.Millisecond)
+	p.writers["127.0.0.2:4150"].latency = int64(time.Millisecond)
+
+	pw := p.selectWriter(make(map[string]bool))
+	assert.Equal(t, pw.Addr, "127.0.0.2:4150")
+
+	// unhealthy nsqd are only selected as a last resort
+	p.writers["127.0.0.2:4150"].markUnhealthy(time.Minute)
+	pw = p.selectWriter(make(map[string]bool))
+	assert.Equal(t, pw.Addr, "127.0.0.1:4150")
+	pw = p.selectWriter(map[string]bool{"127.0.0.1:4150": true})
+	assert.Equal(t, pw.Addr, "127.0.0.2:4150")
+	pw = p.selectWriter(map[string]bool{"127.0.0.1:4150": true, "127.0.0.2:4150": true})
+	assert.Equal(t, pw, (*poolWriter)(nil))
+}
+
+func TestWriterPoolLookupd(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	topicName := "pool_lookupd" + strconv.Itoa(int(time.Now().Unix()))
+	msgCount := 10
+
+	p := NewWriterPool()
+	defer p.Stop()
+
+	err := p.ConnectToLookupd("127.0.0.1:4161")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(p.writers), 1)
+
+	var testData [][]byte
+	for i := 0; i < msgCount; i++ {
+		testData = append(testData, []byte("multipublish_test_case"))
+	}
+
+	frameType, data, err := p.MultiPublish(topicName, testData)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, frameType, FrameTypeResponse)
+	assert.Equal(t, data, []byte("OK"))
+
+	frameType, data, err = p.Publish(topicName, []byte("stop_test_case"))
+	assert.Equal(t, err, nil)
+	assert.Equal(t, frameType, FrameTypeResponse)
+	assert.Equal(t, data, []byte("OK"))
+
+	readMessages(topicName, t, msgCount)
+}
+
+func TestWriterPoolLookupdRemoved(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	// a stand-in lookupd listing (the first) numProducers nsqd, or failing when 0
+	var numProducers int32 = 2
+	lookupd := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		n := int(atomic.LoadInt32(&numProducers))
+		if n == 0 {
+			w.WriteHeader(500)
+			return
+		}
+		producers := []map[string]interface{}{
+			{"broadcast_address": "127.0.0.1", "tcp_port": 4150},
+			{"broadcast_address": "127.0.0.2", "tcp_port": 4150},
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status_code": 200,
+			"status_txt":  "OK",
+			"data":        map[string]interface{}{"producers": producers[:n]},
+		})
+	}))
+	defer lookupd.Close()
+
+	p := NewWriterPool()
+	defer p.Stop()
+
+	err := p.ConnectToNSQ("127.0.0.3:4150")
+	assert.Equal(t, err, nil)
+	err = p.ConnectToLookupd(lookupd.Listener.Addr().String())
+	assert.Equal(t, err, nil)
+	assert.Equal(t, p.addrs, []string{"127.0.0.1:4150", "127.0.0.2:4150", "127.0.0.3:4150"})
+
+	// nsqd added via ConnectToNSQ stay
+	atomic.StoreInt32(&numProducers, 1)
+	p.queryLookupd()
+	assert.Equal(t, p.addrs, []string{"127.0.0.1:4150", "127.0.0.3:4150"})
+	assert.Equal(t, len(p.writers), 2)
+
+	// an unreachable lookupd doesn't remove anything
+	atomic.StoreInt32(&numProducers, 0)
+	p.queryLookupd()
+	assert.Equal(t, p.addrs, []string{"127.0.0.1:4150", "127.0.0.3:4150"})
+}
+
+func TestWriterPoolStopLookupd(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	p := NewWriterPool()
+	p.LookupdPollInterval = time.Hour
+	err := p.ConnectToLookupd("127.0.0.1:4161")
+	assert.Equal(t, err, nil)
+
+	// lookupdLoop is (almost certainly) waiting out its initial jitter
+	stopped := make(chan int)
+	go func() {
+		p.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatalf("Stop() blocked")
+	}
+}
+
+func TestWriterPoolNoWriters(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	p := NewWriterPool()
+
+	_, _, err := p.Publish("pool_empty", []byte("publish_test_case"))
+	assert.Equal(t, err, ErrNoWriters)
+
+	p.Stop()
+
+	_, _, err = p.Publish("pool_empty", []byte("publish_test_case"))
+	assert.Equal(t, err, ErrStopped)
+}
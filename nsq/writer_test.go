@@ -0,0 +1,178 @@
+package nsq
+
+import (
+	"github.com/bmizerany/assert"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+type ConsumerHandler struct {
+	t              *testing.T
+	q              *Reader
+	messagesGood   int
+	messagesFailed int
+}
+
+func (h *ConsumerHandler) LogFailedMessage(message *Message) {
+	h.messagesFailed++
+	h.q.Stop()
+}
+
+func (h *ConsumerHandler) HandleMessage(message *Message) error {
+	msg := string(message.Body)
+	if msg == "stop_test_case" {
+		// the sentinel is always published last
+		h.q.Stop()
+		return nil
+	}
+	if msg != "multipublish_test_case" && msg != "publish_test_case" {
+		h.t.Error("message 'action' was not correct:", msg)
+	}
+	h.messagesGood++
+	return nil
+}
+
+func TestWriterPublish(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	topicName := "publish" + strconv.Itoa(int(time.Now().Unix()))
+	msgCount := 10
+
+	w := NewWriter("127.0.0.1:4150")
+	defer w.Stop()
+
+	for i := 0; i < msgCount; i++ {
+		frameType, data, err := w.Publish(topicName, []byte("publish_test_case"))
+		assert.Equal(t, err, nil)
+		assert.Equal(t, frameType, FrameTypeResponse)
+		assert.Equal(t, data, []byte("OK"))
+	}
+
+	frameType, data, err := w.Publish(topicName, []byte("stop_test_case"))
+	assert.Equal(t, err, nil)
+	assert.Equal(t, frameType, FrameTypeResponse)
+	assert.Equal(t, data, []byte("OK"))
+
+	readMessages(topicName, t, msgCount)
+}
+
+func TestWriterMultiPublish(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	topicName := "multi_publish" + strconv.Itoa(int(time.Now().Unix()))
+	msgCount := 10
+
+	w := NewWriter("127.0.0.1:4150")
+	defer w.Stop()
+
+	var testData [][]byte
+	for i := 0; i < msgCount; i++ {
+		testData = append(testData, []byte("multipublish_test_case"))
+	}
+
+	frameType, data, err := w.MultiPublish(topicName, testData)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, frameType, FrameTypeResponse)
+	assert.Equal(t, data, []byte("OK"))
+
+	frameType, data, err = w.Publish(topicName, []byte("stop_test_case"))
+	assert.Equal(t, err, nil)
+	assert.Equal(t, frameType, FrameTypeResponse)
+	assert.Equal(t, data, []byte("OK"))
+
+	readMessages(topicName, t, msgCount)
+}
+
+func TestWriterPublishAsync(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	topicName := "async_publish" + strconv.Itoa(int(time.Now().Unix()))
+	msgCount := 10
+
+	w := NewWriter("127.0.0.1:4150")
+	defer w.Stop()
+
+	responseChan := make(chan *WriterTransaction, msgCount)
+	for i := 0; i < msgCount; i++ {
+		err := w.PublishAsync(topicName, []byte("publish_test_case"), responseChan, i)
+		assert.Equal(t, err, nil)
+	}
+
+	for i := 0; i < msgCount; i++ {
+		trans := <-responseChan
+		assert.Equal(t, trans.Error, nil)
+		assert.Equal(t, trans.FrameType, FrameTypeResponse)
+		assert.Equal(t, trans.Data, []byte("OK"))
+		assert.Equal(t, trans.Args[0].(int), i)
+	}
+
+	frameType, data, err := w.Publish(topicName, []byte("stop_test_case"))
+	assert.Equal(t, err, nil)
+	assert.Equal(t, frameType, FrameTypeResponse)
+	assert.Equal(t, data, []byte("OK"))
+
+	readMessages(topicName, t, msgCount)
+}
+
+func TestWriterConnectionFailure(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	topicName := "publish_failure" + strconv.Itoa(int(time.Now().Unix()))
+
+	w := NewWriter("127.0.0.1:0")
+	defer w.Stop()
+
+	frameType, _, err := w.Publish(topicName, []byte("publish_test_case"))
+	assert.NotEqual(t, err, nil)
+	assert.Equal(t, frameType, int32(-1))
+}
+
+func TestWriterStop(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	topicName := "publish_stop" + strconv.Itoa(int(time.Now().Unix()))
+
+	w := NewWriter("127.0.0.1:4150")
+
+	frameType, data, err := w.Publish(topicName, []byte("publish_test_case"))
+	assert.Equal(t, err, nil)
+	assert.Equal(t, frameType, FrameTypeResponse)
+	assert.Equal(t, data, []byte("OK"))
+
+	w.Stop()
+
+	_, _, err = w.Publish(topicName, []byte("publish_test_case"))
+	assert.Equal(t, err, ErrStopped)
+}
+
+func readMessages(topicName string, t *testing.T, msgCount int) {
+	q, _ := NewReader(topicName, "ch")
+	q.VerboseLogging = true
+	q.DefaultRequeueDelay = 0
+	q.SetMaxBackoffDuration(time.Millisecond * 50)
+
+	h := &ConsumerHandler{
+		t: t,
+		q: q,
+	}
+	q.AddHandler(h)
+
+	err := q.ConnectToNSQ("127.0.0.1:4150")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	<-q.ExitChan
+
+	if h.messagesGood != msgCount {
+		t.Fatalf("end of test. should have handled a diff number of messages %d != %d", h.messagesGood, msgCount)
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/bitly/nsq/nsq"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sync"
+	"time"
+)
+
+const (
+	permissionPublish   = "publish"
+	permissionSubscribe = "subscribe"
+	permissionAdmin     = "admin"
+)
+
+// Authorization is a single entry of the permissions an auth service returns
+// for a secret, the topic and channels are regular expressions
+type Authorization struct {
+	Topic       string   `json:"topic"`
+	Channels    []string `json:"channels"`
+	Permissions []string `json:"permissions"`
+
+	topicRegexp    *regexp.Regexp
+	channelRegexps []*regexp.Regexp
+}
+
+func (a *Authorization) compile() error {
+	var err error
+
+	a.topicRegexp, err = regexp.Compile("^" + a.Topic + "$")
+	if err != nil {
+		return fmt.Errorf("invalid topic regex %s - %s", a.Topic, err.Error())
+	}
+
+	a.channelRegexps = make([]*regexp.Regexp, 0, len(a.Channels))
+	for _, c := range a.Channels {
+		r, err := regexp.Compile("^" + c + "$")
+		if err != nil {
+			return fmt.Errorf("invalid channel regex %s - %s", c, err.Error())
+		}
+		a.channelRegexps = append(a.channelRegexps, r)
+	}
+
+	return nil
+}
+
+func (a *Authorization) HasPermission(permission string) bool {
+	for _, p := range a.Permissions {
+		if p == permission {
+			return true
+		}
+	}
+	return false
+}
+
+// IsAllowed returns whether the permission is granted for the topic/channel
+// (channel is ignored when empty, ie. for publish, and both are ignored when
+// topic is empty, ie. for the profiling endpoints)
+func (a *Authorization) IsAllowed(permission string, topic string, channel string) bool {
+	if !a.HasPermission(permission) {
+		return false
+	}
+
+	if topic == "" {
+		return true
+	}
+
+	if !a.topicRegexp.MatchString(topic) {
+		return false
+	}
+
+	if channel == "" {
+		return true
+	}
+
+	for _, r := range a.channelRegexps {
+		if r.MatchString(channel) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// AuthState is the response of an auth service for a secret
+type AuthState struct {
+	TTL            int             `json:"ttl"`
+	Identity       string          `json:"identity"`
+	IdentityURL    string          `json:"identity_url"`
+	Authorizations []Authorization `json:"authorizations"`
+	Expires        time.Time       `json:"-"`
+}
+
+func (a *AuthState) IsExpired() bool {
+	return time.Now().After(a.Expires)
+}
+
+func (a *AuthState) IsAllowed(permission string, topic string, channel string) bool {
+	for i := range a.Authorizations {
+		if a.Authorizations[i].IsAllowed(permission, topic, channel) {
+			return true
+		}
+	}
+	return false
+}
+
+// queryAuthd asks each of the auth services (in turn) for the permissions of
+// the secret, returning the first successful response
+func queryAuthd(authHTTPAddrs []string, secret string, remoteIP string, tls bool) (*AuthState, error) {
+	var lastErr error
+
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("remote_ip", remoteIP)
+	if tls {
+		v.Set("tls", "true")
+	} else {
+		v.Set("tls", "false")
+	}
+
+	for _, addr := range authHTTPAddrs {
+		endpoint := fmt.Sprintf("http://%s/auth?%s", addr, v.Encode())
+		authState, err := queryAuthdEndpoint(endpoint)
+		if err != nil {
+			log.Printf("ERROR: auth %s - %s", addr, err.Error())
+			lastErr = err
+			continue
+		}
+		return authState, nil
+	}
+
+	if lastErr == nil {
+		lastErr = errors.New("no auth services")
+	}
+	return nil, lastErr
+}
+
+func queryAuthdEndpoint(endpoint string) (*AuthState, error) {
+	httpclient := &http.Client{Transport: nsq.NewDeadlineTransport(2 * time.Second)}
+	resp, err := httpclient.Get(endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("got response %s %q", resp.Status, body)
+	}
+
+	var authState AuthState
+	err = json.Unmarshal(body, &authState)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range authState.Authorizations {
+		err = authState.Authorizations[i].compile()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	authState.Expires = time.Now().Add(time.Duration(authState.TTL) * time.Second)
+
+	return &authState, nil
+}
+
+// authCache holds the responses of the auth services (until their TTL expires)
+// keyed by secret and remote address, so that they're shared between clients
+// and HTTP requests
+type authCache struct {
+	sync.Mutex
+	authHTTPAddrs []string
+	states        map[string]*AuthState
+}
+
+func newAuthCache(authHTTPAddrs []string) *authCache {
+	return &authCache{
+		authHTTPAddrs: authHTTPAddrs,
+		states:        make(map[string]*AuthState),
+	}
+}
+
+// Get returns the (cached) AuthState for the secret, querying the auth
+// services when there is none or it has expired
+func (c *authCache) Get(secret string, remoteIP string, tls bool) (*AuthState, error) {
+	key := fmt.Sprintf("%s:%s:%t", secret, remoteIP, tls)
+
+	c.Lock()
+	authState, ok := c.states[key]
+	c.Unlock()
+	if ok && !authState.IsExpired() {
+		return authState, nil
+	}
+
+	authState, err := queryAuthd(c.authHTTPAddrs, secret, remoteIP, tls)
+	if err != nil {
+		return nil, err
+	}
+
+	c.Lock()
+	for k, s := range c.states {
+		if s.IsExpired() {
+			delete(c.states, k)
+		}
+	}
+	c.states[key] = authState
+	c.Unlock()
+
+	return authState, nil
+}
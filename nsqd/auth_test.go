@@ -0,0 +1,246 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/bitly/nsq/nsq"
+	"github.com/bmizerany/assert"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// mustStartAuthd starts a stand-in auth service that grants "testsecret" publish
+// on topics prefixed "auth_pub" and subscribe on channel "ch" of those topics,
+// and "adminsecret" admin on all topics
+func mustStartAuthd(queryCount *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(queryCount, 1)
+		authorization := map[string]interface{}{}
+		switch {
+		case req.URL.Path != "/auth":
+			w.WriteHeader(403)
+			return
+		case req.FormValue("secret") == "testsecret":
+			authorization = map[string]interface{}{
+				"topic":       "auth_pub.*",
+				"channels":    []string{"ch"},
+				"permissions": []string{"publish", "subscribe"},
+			}
+		case req.FormValue("secret") == "adminsecret":
+			authorization = map[string]interface{}{
+				"topic":       ".*",
+				"channels":    []string{".*"},
+				"permissions": []string{"admin"},
+			}
+		default:
+			w.WriteHeader(403)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"ttl":            3600,
+			"identity":       "test",
+			"identity_url":   "http://127.0.0.1/test",
+			"authorizations": []map[string]interface{}{authorization},
+		})
+	}))
+}
+
+func authCmd(t *testing.T, conn net.Conn, secret string) (int32, []byte) {
+	err := nsq.Auth(secret).Write(conn)
+	assert.Equal(t, err, nil)
+	resp, err := nsq.ReadResponse(conn)
+	assert.Equal(t, err, nil)
+	frameType, data, err := nsq.UnpackResponse(resp)
+	assert.Equal(t, err, nil)
+	return frameType, data
+}
+
+func pubCmd(t *testing.T, conn net.Conn, topicName string) (int32, []byte) {
+	err := nsq.Publish(topicName, []byte("test body")).Write(conn)
+	assert.Equal(t, err, nil)
+	resp, err := nsq.ReadResponse(conn)
+	assert.Equal(t, err, nil)
+	frameType, data, err := nsq.UnpackResponse(resp)
+	assert.Equal(t, err, nil)
+	return frameType, data
+}
+
+func TestAuthorization(t *testing.T) {
+	a := Authorization{
+		Topic:       "test.*",
+		Channels:    []string{"ch", "ch2.*"},
+		Permissions: []string{"subscribe"},
+	}
+	err := a.compile()
+	assert.Equal(t, err, nil)
+
+	assert.Equal(t, a.IsAllowed(permissionSubscribe, "test_topic", "ch"), true)
+	assert.Equal(t, a.IsAllowed(permissionSubscribe, "test_topic", "ch2_x"), true)
+	assert.Equal(t, a.IsAllowed(permissionSubscribe, "test_topic", "other_ch"), false)
+	assert.Equal(t, a.IsAllowed(permissionSubscribe, "a_test_topic", "ch"), false)
+	assert.Equal(t, a.IsAllowed(permissionPublish, "test_topic", ""), false)
+	assert.Equal(t, a.IsAllowed(permissionSubscribe, "", ""), true)
+	assert.Equal(t, a.IsAllowed(permissionAdmin, "", ""), false)
+
+	a.Topic = "("
+	assert.NotEqual(t, a.compile(), nil)
+}
+
+func TestAuth(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	var queryCount int32
+	authd := mustStartAuthd(&queryCount)
+	defer authd.Close()
+
+	options := testNsqdOptions()
+	options.authHTTPAddresses = []string{authd.Listener.Addr().String()}
+	tcpAddr, _ := mustStartNSQd(options)
+	defer nsqd.Exit()
+
+	topicName := "auth_pub" + strconv.Itoa(int(time.Now().Unix()))
+
+	// clients must AUTH first
+	conn, err := mustConnectNSQd(tcpAddr)
+	assert.Equal(t, err, nil)
+	frameType, data := pubCmd(t, conn, topicName)
+	assert.Equal(t, frameType, nsq.FrameTypeError)
+	assert.Equal(t, string(data), "E_UNAUTHORIZED PUB AUTH required")
+	// the error is fatal so nsqd closes the connection rather than treating
+	// the unread body as the next command
+	_, err = nsq.ReadResponse(conn)
+	assert.Equal(t, err, io.EOF)
+	conn.Close()
+
+	conn, err = mustConnectNSQd(tcpAddr)
+	assert.Equal(t, err, nil)
+	frameType, data = authCmd(t, conn, "badsecret")
+	assert.Equal(t, frameType, nsq.FrameTypeError)
+	assert.Equal(t, string(data), "E_AUTH_FAILED AUTH failed")
+	conn.Close()
+
+	conn, err = mustConnectNSQd(tcpAddr)
+	assert.Equal(t, err, nil)
+	frameType, data = authCmd(t, conn, "testsecret")
+	assert.Equal(t, frameType, nsq.FrameTypeResponse)
+	assert.Equal(t, data, []byte(`{"identity":"test","identity_url":"http://127.0.0.1/test","permission_count":1}`))
+	frameType, data = pubCmd(t, conn, topicName)
+	assert.Equal(t, frameType, nsq.FrameTypeResponse)
+	assert.Equal(t, data, []byte("OK"))
+	frameType, data = pubCmd(t, conn, "test_auth_other")
+	assert.Equal(t, frameType, nsq.FrameTypeError)
+	assert.Equal(t, string(data), "E_UNAUTHORIZED PUB unauthorized for test_auth_other")
+	_, err = nsq.ReadResponse(conn)
+	assert.Equal(t, err, io.EOF)
+	conn.Close()
+
+	conn, err = mustConnectNSQd(tcpAddr)
+	assert.Equal(t, err, nil)
+	frameType, _ = authCmd(t, conn, "testsecret")
+	assert.Equal(t, frameType, nsq.FrameTypeResponse)
+	sub(t, conn, topicName, "ch")
+	conn.Close()
+
+	conn, err = mustConnectNSQd(tcpAddr)
+	assert.Equal(t, err, nil)
+	frameType, _ = authCmd(t, conn, "testsecret")
+	assert.Equal(t, frameType, nsq.FrameTypeResponse)
+	subFail(t, conn, topicName, "other_ch")
+	conn.Close()
+
+	// the response for a secret is cached (until its TTL expires)
+	assert.Equal(t, atomic.LoadInt32(&queryCount), int32(2))
+}
+
+func TestAuthDisabled(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	options := testNsqdOptions()
+	tcpAddr, _ := mustStartNSQd(options)
+	defer nsqd.Exit()
+
+	conn, err := mustConnectNSQd(tcpAddr)
+	assert.Equal(t, err, nil)
+
+	frameType, data := authCmd(t, conn, "testsecret")
+	assert.Equal(t, frameType, nsq.FrameTypeError)
+	assert.Equal(t, string(data), "E_AUTH_DISABLED AUTH disabled")
+}
+
+func TestHTTPAuth(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	var queryCount int32
+	authd := mustStartAuthd(&queryCount)
+	defer authd.Close()
+
+	options := testNsqdOptions()
+	options.authHTTPAddresses = []string{authd.Listener.Addr().String()}
+	_, httpAddr := mustStartNSQd(options)
+	defer nsqd.Exit()
+
+	topicName := "auth_pub_http" + strconv.Itoa(int(time.Now().Unix()))
+
+	httpPut := func(topicName string, secret string) int {
+		endpoint := fmt.Sprintf("http://%s/put?topic=%s", httpAddr, topicName)
+		req, _ := http.NewRequest("POST", endpoint, nil)
+		if secret != "" {
+			req.Header.Set("X-NSQ-Auth-Secret", secret)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		assert.Equal(t, err, nil)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	assert.Equal(t, httpPut(topicName, ""), 403)
+	assert.Equal(t, httpPut(topicName, "badsecret"), 500)
+	assert.Equal(t, httpPut(topicName, "testsecret"), 200)
+	assert.Equal(t, httpPut("test_auth_http_other", "testsecret"), 403)
+
+	httpGet := func(path string, secret string) int {
+		req, _ := http.NewRequest("GET", fmt.Sprintf("http://%s%s", httpAddr, path), nil)
+		if secret != "" {
+			req.Header.Set("X-NSQ-Auth-Secret", secret)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		assert.Equal(t, err, nil)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// destructive endpoints require admin, publish/subscribe aren't enough
+	topic := nsqd.GetTopic(topicName)
+	topic.GetChannel("ch")
+	channelArgs := fmt.Sprintf("?topic=%s&channel=ch", topicName)
+	assert.Equal(t, httpGet("/empty_channel"+channelArgs, "testsecret"), 403)
+	assert.Equal(t, httpGet("/delete_channel"+channelArgs, "testsecret"), 403)
+	assert.Equal(t, httpGet("/purge_dead_letters"+channelArgs, "testsecret"), 403)
+	assert.Equal(t, httpGet("/delete_topic?topic="+topicName, "testsecret"), 403)
+	assert.Equal(t, httpGet("/mem_profile", ""), 403)
+	assert.Equal(t, httpGet("/mem_profile", "testsecret"), 403)
+	assert.Equal(t, httpGet("/cpu_profile", "testsecret"), 403)
+
+	_, err := topic.GetExistingChannel("ch")
+	assert.Equal(t, err, nil)
+
+	assert.Equal(t, httpGet("/delete_channel"+channelArgs, "adminsecret"), 200)
+	_, err = topic.GetExistingChannel("ch")
+	assert.NotEqual(t, err, nil)
+
+	assert.Equal(t, httpGet("/delete_topic?topic="+topicName, "adminsecret"), 200)
+	_, err = nsqd.GetExistingTopic(topicName)
+	assert.NotEqual(t, err, nil)
+}
@@ -1,14 +1,20 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"container/heap"
+	"encoding/binary"
 	"errors"
+	"fmt"
 	"github.com/bitly/nsq/nsq"
 	"github.com/bitly/nsq/util"
 	"github.com/bitly/nsq/util/pqueue"
+	"io/ioutil"
 	"log"
 	"math"
+	"os"
+	"path"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -18,13 +24,19 @@ import (
 // the amount of time a worker will wait when idle
 const defaultWorkerWait = 100 * time.Millisecond
 
+// errDeadLetterNotFound is returned by RequeueDeadLetters and PurgeDeadLetters
+// when one of the specified messages isn't in the dead letter queue
+var errDeadLetterNotFound = errors.New("ID not in dead letter queue")
+
 type Consumer interface {
 	UnPause()
 	Pause()
 	Close() error
 	TimedOutMessage()
+	MessageTimeout() time.Duration
 	Stats() ClientStats
 	Empty()
+	Drain()
 }
 
 // Channel represents the concrete type for a NSQ channel (and also
@@ -46,6 +58,32 @@ type Channel struct {
 
 	backend BackendQueue
 
+	// messages that have exceeded maxAttempts are written to the dead letter
+	// queue (deadLetterBackend, ephemeral channels discard them), which only
+	// popDeadLetters reads from (under deadLetterMutex)
+	maxAttempts       int32
+	deadLetterMutex   sync.Mutex
+	deadLetterBackend BackendQueue
+
+	// ordered channels have a single message outstanding at a time and hold
+	// a requeued message (in requeuedMsgs) to redeliver it before any newer one
+	ordered        int32
+	orderedPending bool
+	orderedId      nsq.MessageID
+	requeuedMsgs   []*nsq.Message
+	orderedMutex   sync.Mutex
+	orderedChan    chan int
+
+	// the number of deferred messages that were already delivered (ie. they
+	// were requeued with a timeout), only these hold up an ordered channel
+	redeliveryCount int
+
+	// messages with a partition key (see nsq.PartitionKeyHeader) are queued
+	// for the client that owns the key on the hash ring
+	keyedMutex  sync.Mutex
+	ring        hashRing
+	keyedQueues map[Consumer]*keyedQueue
+
 	incomingMsgChan chan *nsq.Message
 	memoryMsgChan   chan *nsq.Message
 	clientMsgChan   chan *nsq.Message
@@ -69,10 +107,11 @@ type Channel struct {
 	inFlightMutex    sync.Mutex
 
 	// stat counters
-	requeueCount  uint64
-	messageCount  uint64
-	timeoutCount  uint64
-	bufferedCount int32
+	requeueCount           uint64
+	messageCount           uint64
+	timeoutCount           uint64
+	disconnectRequeueCount uint64
+	bufferedCount          int32
 }
 
 type inFlightMessage struct {
@@ -92,11 +131,14 @@ func NewChannel(topicName string, channelName string, options *nsqdOptions,
 		incomingMsgChan: make(chan *nsq.Message, 1),
 		memoryMsgChan:   make(chan *nsq.Message, options.memQueueSize),
 		clientMsgChan:   make(chan *nsq.Message),
+		orderedChan:     make(chan int, 1),
+		keyedQueues:     make(map[Consumer]*keyedQueue),
 		exitChan:        make(chan int),
 		clients:         make([]Consumer, 0, 5),
 		deleteCallback:  deleteCallback,
 		notifier:        notifier,
 		options:         options,
+		maxAttempts:     int32(options.maxAttempts),
 	}
 
 	c.initPQ()
@@ -104,8 +146,16 @@ func NewChannel(topicName string, channelName string, options *nsqdOptions,
 	if strings.HasSuffix(channelName, "#ephemeral") {
 		c.ephemeralChannel = true
 		c.backend = NewDummyBackendQueue()
+		c.deadLetterBackend = NewDummyBackendQueue()
 	} else {
-		c.backend = NewDiskQueue(backendName, options.dataPath, options.maxBytesPerFile, options.syncEvery)
+		c.backend = NewDiskQueue(backendName, options.dataPath, options.maxBytesPerFile,
+			options.maxMessageSize+messageOverhead, options.syncEvery, options.syncTimeout)
+		c.deadLetterBackend = NewDiskQueue(backendName+":dead_letter", options.dataPath, options.maxBytesPerFile,
+			options.maxMessageSize+messageOverhead, options.syncEvery, options.syncTimeout)
+		err := c.loadDeferred()
+		if err != nil {
+			log.Printf("ERROR: channel(%s) failed to load deferred messages - %s", c.name, err.Error())
+		}
 	}
 
 	go c.messagePump()
@@ -124,6 +174,7 @@ func (c *Channel) initPQ() {
 
 	c.inFlightMessages = make(map[nsq.MessageID]*pqueue.Item)
 	c.deferredMessages = make(map[nsq.MessageID]*pqueue.Item)
+	c.redeliveryCount = 0
 
 	c.inFlightMutex.Lock()
 	c.inFlightPQ = pqueue.New(pqSize)
@@ -183,6 +234,8 @@ func (c *Channel) exit(deleted bool) error {
 	if deleted {
 		// empty the queue (deletes the backend files, too)
 		c.Empty()
+		c.deadLetterBackend.Empty()
+		os.Remove(c.deferredFileName())
 	} else {
 		// messagePump is responsible for closing the channel it writes to
 		// this will read until its closed (exited)
@@ -191,10 +244,23 @@ func (c *Channel) exit(deleted bool) error {
 			WriteMessageToBackend(&msgBuf, msg, c.backend)
 		}
 
+		c.Lock()
+		c.keyedMutex.Lock()
+		for client, q := range c.keyedQueues {
+			for _, msg := range q.Close() {
+				log.Printf("CHANNEL(%s): recovered buffered message from keyedQueue", c.name)
+				WriteMessageToBackend(&msgBuf, msg, c.backend)
+			}
+			delete(c.keyedQueues, client)
+		}
+		c.keyedMutex.Unlock()
+		c.Unlock()
+
 		// write anything leftover to disk
 		c.flush()
 	}
 
+	c.deadLetterBackend.Close()
 	return c.backend.Close()
 }
 
@@ -207,6 +273,17 @@ func (c *Channel) Empty() error {
 		client.Empty()
 	}
 
+	c.orderedMutex.Lock()
+	c.orderedPending = false
+	c.requeuedMsgs = nil
+	c.orderedMutex.Unlock()
+
+	c.keyedMutex.Lock()
+	for _, q := range c.keyedQueues {
+		q.Empty()
+	}
+	c.keyedMutex.Unlock()
+
 	for {
 		select {
 		case <-c.memoryMsgChan:
@@ -229,6 +306,14 @@ func (c *Channel) flush() error {
 			c.name, len(c.memoryMsgChan), len(c.inFlightMessages), len(c.deferredMessages))
 	}
 
+	for _, msg := range c.requeuedMsgs {
+		err := WriteMessageToBackend(&msgBuf, msg, c.backend)
+		if err != nil {
+			log.Printf("ERROR: failed to write message to backend - %s", err.Error())
+		}
+	}
+	c.requeuedMsgs = nil
+
 	for {
 		select {
 		case msg := <-c.memoryMsgChan:
@@ -250,19 +335,161 @@ finish:
 		}
 	}
 
-	for _, item := range c.deferredMessages {
-		msg := item.Value.(*nsq.Message)
-		err := WriteMessageToBackend(&msgBuf, msg, c.backend)
+	// deferred messages are persisted separately (with their due time)
+	// falling back to the backend if that isn't possible
+	if len(c.deferredMessages) > 0 {
+		err := c.persistDeferred()
 		if err != nil {
-			log.Printf("ERROR: failed to write message to backend - %s", err.Error())
+			log.Printf("ERROR: channel(%s) failed to persist deferred messages - %s", c.name, err.Error())
+			now := time.Now().UnixNano()
+			for _, item := range c.deferredMessages {
+				msg := item.Value.(*nsq.Message)
+				msg.Deferred = time.Duration(item.Priority - now)
+				err := WriteMessageToBackend(&msgBuf, msg, c.backend)
+				if err != nil {
+					log.Printf("ERROR: failed to write message to backend - %s", err.Error())
+				}
+			}
 		}
 	}
 
 	return nil
 }
 
+func (c *Channel) deferredFileName() string {
+	return fmt.Sprintf(path.Join(c.options.dataPath, "%s:%s.diskqueue.deferred.dat"), c.topicName, c.name)
+}
+
+// persistDeferred atomically writes all deferred messages, along with the
+// absolute time they are due, to the filesystem
+//
+// each record is of the form:
+//
+//     [ 8-byte due time (unix ns) ][ 4-byte size ][ N-byte message ]
+//
+func (c *Channel) persistDeferred() error {
+	var msgBuf bytes.Buffer
+
+	fileName := c.deferredFileName()
+	tmpFileName := fileName + ".tmp"
+
+	f, err := os.OpenFile(tmpFileName, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+	for _, item := range c.deferredMessages {
+		msgBuf.Reset()
+		err = item.Value.(*nsq.Message).Write(&msgBuf)
+		if err != nil {
+			break
+		}
+
+		err = binary.Write(w, binary.BigEndian, item.Priority)
+		if err != nil {
+			break
+		}
+
+		err = binary.Write(w, binary.BigEndian, int32(msgBuf.Len()))
+		if err != nil {
+			break
+		}
+
+		_, err = w.Write(msgBuf.Bytes())
+		if err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		f.Close()
+		return err
+	}
+	f.Sync()
+	f.Close()
+
+	// atomically rename
+	return os.Rename(tmpFileName, fileName)
+}
+
+// loadDeferred restores deferred messages persisted by persistDeferred
+// (with their original due time), it is only called in NewChannel()
+func (c *Channel) loadDeferred() error {
+	var dueTs int64
+	var size int32
+
+	fileName := c.deferredFileName()
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	count := 0
+	buf := bytes.NewBuffer(data)
+	for buf.Len() > 0 {
+		err = binary.Read(buf, binary.BigEndian, &dueTs)
+		if err != nil {
+			break
+		}
+
+		err = binary.Read(buf, binary.BigEndian, &size)
+		if err != nil {
+			break
+		}
+
+		if size < 0 || int(size) > buf.Len() {
+			err = fmt.Errorf("invalid message size %d", size)
+			break
+		}
+
+		var msg *nsq.Message
+		msg, err = nsq.DecodeMessage(buf.Next(int(size)))
+		if err != nil {
+			break
+		}
+
+		item := &pqueue.Item{Value: msg, Priority: dueTs}
+		if c.pushDeferredMessage(item) == nil {
+			c.addToDeferredPQ(item)
+			count++
+		}
+	}
+
+	log.Printf("CHANNEL(%s): loaded %d deferred messages", c.name, count)
+
+	if err != nil {
+		// move the file aside so that we don't load it again on the next restart
+		badFileName := fileName + ".bad"
+		log.Printf("ERROR: channel(%s) corrupt deferred messages file, renaming %s to %s",
+			c.name, fileName, badFileName)
+		os.Rename(fileName, badFileName)
+		return err
+	}
+
+	// these messages are now owned by this channel's deferred queue
+	return os.Remove(fileName)
+}
+
 func (c *Channel) Depth() int64 {
-	return int64(len(c.memoryMsgChan)) + c.backend.Depth() + int64(atomic.LoadInt32(&c.bufferedCount))
+	c.orderedMutex.Lock()
+	requeued := len(c.requeuedMsgs)
+	c.orderedMutex.Unlock()
+
+	keyed := 0
+	c.keyedMutex.Lock()
+	for _, q := range c.keyedQueues {
+		keyed += q.Len()
+	}
+	c.keyedMutex.Unlock()
+
+	return int64(len(c.memoryMsgChan)) + int64(requeued) + int64(keyed) + c.backend.Depth() +
+		int64(atomic.LoadInt32(&c.bufferedCount))
 }
 
 func (c *Channel) Pause() {
@@ -300,6 +527,77 @@ func (c *Channel) PutMessage(msg *nsq.Message) error {
 	return nil
 }
 
+// SetMaxAttempts sets the number of delivery attempts after which a message
+// is moved to the dead letter queue (0 means unlimited)
+func (c *Channel) SetMaxAttempts(maxAttempts uint16) {
+	atomic.StoreInt32(&c.maxAttempts, int32(maxAttempts))
+}
+
+func (c *Channel) MaxAttempts() uint16 {
+	return uint16(atomic.LoadInt32(&c.maxAttempts))
+}
+
+// SetOrdered sets whether the channel delivers a single message at a time,
+// redelivering a requeued message before any newer message
+//
+// messages already in-flight when it is set are delivered before the next one
+func (c *Channel) SetOrdered(ordered bool) {
+	if ordered {
+		atomic.StoreInt32(&c.ordered, 1)
+	} else {
+		atomic.StoreInt32(&c.ordered, 0)
+	}
+	c.notifyOrdered()
+}
+
+func (c *Channel) IsOrdered() bool {
+	return atomic.LoadInt32(&c.ordered) == 1
+}
+
+// DeadLetters returns up to limit (or, if limit is 0, all) of the messages in
+// the dead letter queue, without removing them
+func (c *Channel) DeadLetters(limit int) ([]*nsq.Message, error) {
+	msgs, _, err := c.peekDeadLetters(limit)
+	return msgs, err
+}
+
+func (c *Channel) DeadLetterDepth() int64 {
+	return c.deadLetterBackend.Depth()
+}
+
+// RequeueDeadLetters moves the specified messages (or all, if none are specified)
+// from the dead letter queue back to the channel with their attempts reset
+func (c *Channel) RequeueDeadLetters(ids ...nsq.MessageID) (int, error) {
+	if atomic.LoadInt32(&c.exitFlag) == 1 {
+		return 0, errors.New("exiting")
+	}
+
+	msgs, err := c.popDeadLetters(ids)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, msg := range msgs {
+		msg.Attempts = 0
+		err := c.doRequeue(msg)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return len(msgs), nil
+}
+
+// PurgeDeadLetters discards the specified messages (or all, if none are specified)
+// from the dead letter queue
+func (c *Channel) PurgeDeadLetters(ids ...nsq.MessageID) (int, error) {
+	msgs, err := c.popDeadLetters(ids)
+	if err != nil {
+		return 0, err
+	}
+	return len(msgs), nil
+}
+
 // TouchMessage resets the timeout for an in-flight message
 func (c *Channel) TouchMessage(client Consumer, id nsq.MessageID) error {
 	item, err := c.popInFlightMessage(client, id)
@@ -311,8 +609,9 @@ func (c *Channel) TouchMessage(client Consumer, id nsq.MessageID) error {
 
 	ifMsg := item.Value.(*inFlightMessage)
 	currentTimeout := time.Unix(0, item.Priority)
-	newTimeout := currentTimeout.Add(c.options.msgTimeout)
-	if newTimeout.Add(c.options.msgTimeout).Sub(ifMsg.ts) >= c.options.maxMsgTimeout {
+	msgTimeout := client.MessageTimeout()
+	newTimeout := currentTimeout.Add(msgTimeout)
+	if newTimeout.Add(msgTimeout).Sub(ifMsg.ts) >= c.options.maxMsgTimeout {
 		// we would have gone over, set to the max
 		newTimeout = ifMsg.ts.Add(c.options.maxMsgTimeout)
 	}
@@ -334,6 +633,7 @@ func (c *Channel) FinishMessage(client Consumer, id nsq.MessageID) error {
 		return err
 	}
 	c.removeFromInFlightPQ(item)
+	c.orderedDone(id)
 	return nil
 }
 
@@ -341,8 +641,8 @@ func (c *Channel) FinishMessage(client Consumer, id nsq.MessageID) error {
 //
 // `timeoutMs` == 0 - requeue a message immediately
 // `timeoutMs`  > 0 - asynchronously wait for the specified timeout
-//     and requeue a message (aka "deferred requeue")
 //
+//	and requeue a message (aka "deferred requeue")
 func (c *Channel) RequeueMessage(client Consumer, id nsq.MessageID, timeout time.Duration) error {
 	// remove from inflight first
 	item, err := c.popInFlightMessage(client, id)
@@ -377,14 +677,52 @@ func (c *Channel) AddClient(client Consumer) {
 
 	if !found {
 		c.clients = append(c.clients, client)
+		c.keyedMutex.Lock()
+		c.keyedQueues[client] = newKeyedQueue()
+		c.ring = newHashRing(c.clients)
+		c.keyedMutex.Unlock()
+	}
+}
+
+// KeyedMsgChan returns the go channel the client receives the messages whose
+// partition key it owns on
+func (c *Channel) KeyedMsgChan(client Consumer) chan *nsq.Message {
+	c.keyedMutex.Lock()
+	defer c.keyedMutex.Unlock()
+
+	q, ok := c.keyedQueues[client]
+	if !ok {
+		return nil
+	}
+	return q.msgChan
+}
+
+// Drain asks each of the Channel's clients to close (ie. when nsqd is exiting)
+func (c *Channel) Drain() {
+	c.RLock()
+	defer c.RUnlock()
+
+	for _, client := range c.clients {
+		client.Drain()
 	}
 }
 
+// InFlightCount returns the number of messages in-flight to the Channel's clients
+func (c *Channel) InFlightCount() int {
+	c.RLock()
+	defer c.RUnlock()
+
+	return len(c.inFlightMessages)
+}
+
 // RemoveClient removes a client from the Channel's client list
+// and immediately requeues any messages it had in-flight
 func (c *Channel) RemoveClient(client Consumer) {
 	c.Lock()
 	defer c.Unlock()
 
+	c.requeueClientMessages(client)
+
 	if len(c.clients) != 0 {
 		finalClients := make([]Consumer, 0, len(c.clients)-1)
 		for _, cli := range c.clients {
@@ -395,15 +733,62 @@ func (c *Channel) RemoveClient(client Consumer) {
 		c.clients = finalClients
 	}
 
+	// messages waiting for the client are sent to their new owners (when
+	// exiting, exit() writes them to the backend instead)
+	var msgs []*nsq.Message
+	c.keyedMutex.Lock()
+	c.ring = newHashRing(c.clients)
+	q, ok := c.keyedQueues[client]
+	if ok && atomic.LoadInt32(&c.exitFlag) == 0 {
+		delete(c.keyedQueues, client)
+		msgs = q.Close()
+	}
+	c.keyedMutex.Unlock()
+
+	for _, msg := range msgs {
+		// it was never delivered
+		msg.Attempts--
+		c.requeue(msg)
+	}
+
 	if len(c.clients) == 0 && c.ephemeralChannel == true {
 		go c.deleter.Do(func() { c.deleteCallback(c) })
 	}
 }
 
+// requeueClientMessages requeues all messages in-flight to the specified
+// client rather than waiting for them to time out
+//
+// this expects the caller to handle locking
+func (c *Channel) requeueClientMessages(client Consumer) {
+	// when exiting, in-flight messages are flushed to the backend instead
+	if atomic.LoadInt32(&c.exitFlag) == 1 {
+		return
+	}
+
+	count := uint64(0)
+	for id, item := range c.inFlightMessages {
+		ifMsg := item.Value.(*inFlightMessage)
+		if ifMsg.client != client {
+			continue
+		}
+		delete(c.inFlightMessages, id)
+		c.removeFromInFlightPQ(item)
+		c.requeue(ifMsg.msg)
+		count++
+	}
+
+	if count > 0 {
+		log.Printf("CHANNEL(%s): requeued %d in-flight messages from removed client", c.name, count)
+		atomic.AddUint64(&c.requeueCount, count)
+		atomic.AddUint64(&c.disconnectRequeueCount, count)
+	}
+}
+
 func (c *Channel) StartInFlightTimeout(msg *nsq.Message, client Consumer) error {
 	now := time.Now()
 	value := &inFlightMessage{msg, client, now}
-	absTs := now.Add(c.options.msgTimeout).UnixNano()
+	absTs := now.Add(client.MessageTimeout()).UnixNano()
 	item := &pqueue.Item{Value: value, Priority: absTs}
 	err := c.pushInFlightMessage(item)
 	if err != nil {
@@ -429,11 +814,75 @@ func (c *Channel) doRequeue(msg *nsq.Message) error {
 	if atomic.LoadInt32(&c.exitFlag) == 1 {
 		return errors.New("exiting")
 	}
-	c.incomingMsgChan <- msg
+	c.requeue(msg)
 	atomic.AddUint64(&c.requeueCount, 1)
 	return nil
 }
 
+// requeue routes a requeued message, ordered channels hold it to be
+// redelivered before any newer message
+func (c *Channel) requeue(msg *nsq.Message) {
+	if atomic.LoadInt32(&c.ordered) == 1 {
+		c.orderedMutex.Lock()
+		c.requeuedMsgs = append(c.requeuedMsgs, msg)
+		c.orderedMutex.Unlock()
+	} else {
+		c.incomingMsgChan <- msg
+	}
+	c.orderedDone(msg.Id)
+}
+
+// orderedDone marks the message handed to a client by an ordered channel as
+// no longer outstanding (ie. it was finished, requeued, or discarded)
+func (c *Channel) orderedDone(id nsq.MessageID) {
+	c.orderedMutex.Lock()
+	if c.orderedPending && c.orderedId == id {
+		c.orderedPending = false
+	}
+	c.orderedMutex.Unlock()
+
+	if atomic.LoadInt32(&c.ordered) == 1 {
+		c.notifyOrdered()
+	}
+}
+
+// notifyOrdered wakes messagePump to re-check whether it can deliver the
+// next message of an ordered channel
+func (c *Channel) notifyOrdered() {
+	select {
+	case c.orderedChan <- 1:
+	default:
+	}
+}
+
+// orderedReady returns whether an ordered channel can deliver its next
+// message, ie. none are outstanding, in-flight, or deferred for redelivery
+// (messages deferred by the producer were never delivered, so don't count)
+func (c *Channel) orderedReady() bool {
+	c.RLock()
+	count := len(c.inFlightMessages) + c.redeliveryCount
+	c.RUnlock()
+
+	c.orderedMutex.Lock()
+	defer c.orderedMutex.Unlock()
+
+	return !c.orderedPending && count == 0
+}
+
+// popRequeued returns the oldest message held by requeue (if any)
+func (c *Channel) popRequeued() *nsq.Message {
+	c.orderedMutex.Lock()
+	defer c.orderedMutex.Unlock()
+
+	if len(c.requeuedMsgs) == 0 {
+		return nil
+	}
+	msg := c.requeuedMsgs[0]
+	c.requeuedMsgs[0] = nil
+	c.requeuedMsgs = c.requeuedMsgs[1:]
+	return msg
+}
+
 // pushInFlightMessage atomically adds a message to the in-flight dictionary
 func (c *Channel) pushInFlightMessage(item *pqueue.Item) error {
 	c.Lock()
@@ -492,12 +941,15 @@ func (c *Channel) pushDeferredMessage(item *pqueue.Item) error {
 	defer c.Unlock()
 
 	// TODO: these map lookups are costly
-	id := item.Value.(*nsq.Message).Id
-	_, ok := c.deferredMessages[id]
+	msg := item.Value.(*nsq.Message)
+	_, ok := c.deferredMessages[msg.Id]
 	if ok {
 		return errors.New("ID already deferred")
 	}
-	c.deferredMessages[id] = item
+	c.deferredMessages[msg.Id] = item
+	if msg.Attempts > 0 {
+		c.redeliveryCount++
+	}
 
 	return nil
 }
@@ -512,10 +964,99 @@ func (c *Channel) popDeferredMessage(id nsq.MessageID) (*pqueue.Item, error) {
 		return nil, errors.New("ID not deferred")
 	}
 	delete(c.deferredMessages, id)
+	if item.Value.(*nsq.Message).Attempts > 0 {
+		c.redeliveryCount--
+	}
 
 	return item, nil
 }
 
+func (c *Channel) pushDeadLetter(msg *nsq.Message) {
+	var msgBuf bytes.Buffer
+
+	err := WriteMessageToBackend(&msgBuf, msg, c.deadLetterBackend)
+	if err != nil {
+		log.Printf("CHANNEL(%s) ERROR: failed to write dead letter to backend - %s", c.name, err.Error())
+	}
+}
+
+// popDeadLetters removes the messages with the specified ids (or all messages
+// if no ids are specified) from the dead letter queue
+//
+// the messages that are kept are written back (to the end of the queue) before
+// it is advanced past the ones that were read, so that they are duplicated
+// rather than lost when that fails
+func (c *Channel) popDeadLetters(ids []nsq.MessageID) ([]*nsq.Message, error) {
+	var msgBuf bytes.Buffer
+
+	c.deadLetterMutex.Lock()
+	defer c.deadLetterMutex.Unlock()
+
+	deadLetters, count, err := c.peekDeadLetters(0)
+	if err != nil {
+		return nil, err
+	}
+
+	msgs := deadLetters
+	if len(ids) > 0 {
+		remove := make(map[nsq.MessageID]bool)
+		for _, id := range ids {
+			remove[id] = true
+		}
+
+		msgs = make([]*nsq.Message, 0, len(ids))
+		remaining := make([]*nsq.Message, 0, len(deadLetters))
+		for _, msg := range deadLetters {
+			if remove[msg.Id] {
+				msgs = append(msgs, msg)
+			} else {
+				remaining = append(remaining, msg)
+			}
+		}
+
+		if len(msgs) != len(remove) {
+			return nil, errDeadLetterNotFound
+		}
+
+		if len(remaining) > 0 {
+			err = WriteMessagesToBackend(&msgBuf, remaining, c.deadLetterBackend)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	for i := 0; i < count; i++ {
+		select {
+		case <-c.deadLetterBackend.ReadChan():
+		case <-c.deadLetterBackend.IdleChan():
+			return nil, errors.New("dead letter queue changed while being read")
+		}
+	}
+
+	return msgs, nil
+}
+
+// peekDeadLetters returns up to limit (or, if limit is 0, all) of the messages
+// in the dead letter backend, along with the number of records read
+func (c *Channel) peekDeadLetters(limit int) ([]*nsq.Message, int, error) {
+	data, err := c.deadLetterBackend.Peek(limit)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	msgs := make([]*nsq.Message, 0, len(data))
+	for _, buf := range data {
+		msg, err := nsq.DecodeMessage(buf)
+		if err != nil {
+			log.Printf("CHANNEL(%s) ERROR: failed to decode dead letter - %s", c.name, err.Error())
+			continue
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs, len(data), nil
+}
+
 func (c *Channel) addToDeferredPQ(item *pqueue.Item) {
 	c.deferredMutex.Lock()
 	defer c.deferredMutex.Unlock()
@@ -561,22 +1102,69 @@ func (c *Channel) messagePump() {
 			goto exit
 		}
 
-		select {
-		case msg = <-c.memoryMsgChan:
-		case buf = <-c.backend.ReadChan():
-			msg, err = nsq.DecodeMessage(buf)
-			if err != nil {
-				log.Printf("ERROR: failed to decode message - %s", err.Error())
+		// ordered channels wait for the outstanding message to be finished
+		// (or requeued) before delivering the next one
+		ordered := atomic.LoadInt32(&c.ordered) == 1
+		if ordered && !c.orderedReady() {
+			select {
+			case <-c.orderedChan:
+			case <-c.exitChan:
+				goto exit
+			}
+			continue
+		}
+
+		msg = c.popRequeued()
+		if msg == nil {
+			select {
+			case msg = <-c.memoryMsgChan:
+			case buf = <-c.backend.ReadChan():
+				msg, err = decodeBackendMessage(buf)
+				if err != nil {
+					log.Printf("ERROR: failed to decode message - %s", err.Error())
+					continue
+				}
+				if msg.Deferred > 0 {
+					// a deferred message written to the backend (see flush)
+					timeout := msg.Deferred
+					msg.Deferred = 0
+					err = c.StartDeferredTimeout(msg, timeout)
+					if err != nil {
+						log.Printf("CHANNEL(%s) ERROR: failed to defer msg(%s) - %s", c.name, msg.Id, err.Error())
+					}
+					continue
+				}
+			case <-c.orderedChan:
 				continue
+			case <-c.exitChan:
+				goto exit
 			}
-		case <-c.exitChan:
-			goto exit
 		}
 
 		msg.Attempts++
 
+		maxAttempts := atomic.LoadInt32(&c.maxAttempts)
+		if maxAttempts > 0 && int32(msg.Attempts) > maxAttempts {
+			log.Printf("CHANNEL(%s): msg(%s) exceeded max attempts (%d), moving to dead letter queue",
+				c.name, msg.Id, maxAttempts)
+			c.pushDeadLetter(msg)
+			continue
+		}
+
+		if ordered {
+			c.orderedMutex.Lock()
+			c.orderedPending = true
+			c.orderedId = msg.Id
+			c.orderedMutex.Unlock()
+		}
+
 		atomic.StoreInt32(&c.bufferedCount, 1)
-		c.clientMsgChan <- msg
+		key := msg.Header(nsq.PartitionKeyHeader)
+		if key != "" {
+			c.sendKeyed(msg, key)
+		} else {
+			c.clientMsgChan <- msg
+		}
 		atomic.StoreInt32(&c.bufferedCount, 0)
 		// the client will call back to mark as in-flight w/ it's info
 	}
@@ -586,6 +1174,21 @@ exit:
 	close(c.clientMsgChan)
 }
 
+// sendKeyed queues a message for the client that owns its partition key
+// (or, when there are no clients, sends it to clientMsgChan)
+func (c *Channel) sendKeyed(msg *nsq.Message, key string) {
+	c.keyedMutex.Lock()
+	q := c.keyedQueues[c.ring.Get(key)]
+	if q != nil {
+		q.Put(msg)
+	}
+	c.keyedMutex.Unlock()
+
+	if q == nil {
+		c.clientMsgChan <- msg
+	}
+}
+
 func (c *Channel) deferredWorker() {
 	c.pqWorker(&c.deferredPQ, &c.deferredMutex, func(item *pqueue.Item) {
 		msg := item.Value.(*nsq.Message)
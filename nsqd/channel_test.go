@@ -16,7 +16,7 @@ func TestPutMessage(t *testing.T) {
 	log.SetOutput(ioutil.Discard)
 	defer log.SetOutput(os.Stdout)
 
-	nsqd = NewNSQd(1, NewNsqdOptions())
+	nsqd = NewNSQd(1, testNsqdOptions())
 	defer nsqd.Exit()
 
 	topicName := "test_put_message" + strconv.Itoa(int(time.Now().Unix()))
@@ -37,7 +37,7 @@ func TestPutMessage2Chan(t *testing.T) {
 	log.SetOutput(ioutil.Discard)
 	defer log.SetOutput(os.Stdout)
 
-	nsqd = NewNSQd(1, NewNsqdOptions())
+	nsqd = NewNSQd(1, testNsqdOptions())
 	defer nsqd.Exit()
 
 	topicName := "test_put_message_2chan" + strconv.Itoa(int(time.Now().Unix()))
@@ -62,7 +62,7 @@ func TestInFlightWorker(t *testing.T) {
 	log.SetOutput(ioutil.Discard)
 	defer log.SetOutput(os.Stdout)
 
-	options := NewNsqdOptions()
+	options := testNsqdOptions()
 	options.msgTimeout = 300 * time.Millisecond
 	nsqd = NewNSQd(1, options)
 	defer nsqd.Exit()
@@ -89,7 +89,7 @@ func TestChannelEmpty(t *testing.T) {
 	log.SetOutput(ioutil.Discard)
 	defer log.SetOutput(os.Stdout)
 
-	nsqd = NewNSQd(1, NewNsqdOptions())
+	nsqd = NewNSQd(1, testNsqdOptions())
 	defer nsqd.Exit()
 
 	topicName := "test_channel_empty" + strconv.Itoa(int(time.Now().Unix()))
@@ -123,7 +123,7 @@ func TestChannelEmptyConsumer(t *testing.T) {
 	log.SetOutput(ioutil.Discard)
 	defer log.SetOutput(os.Stdout)
 
-	tcpAddr, _ := mustStartNSQd(NewNsqdOptions())
+	tcpAddr, _ := mustStartNSQd(testNsqdOptions())
 	defer nsqd.Exit()
 	conn, _ := mustConnectNSQd(tcpAddr)
 
@@ -153,3 +153,408 @@ func TestChannelEmptyConsumer(t *testing.T) {
 	}
 
 }
+
+func TestChannelDeadLetter(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	options := testNsqdOptions()
+	options.maxAttempts = 2
+	nsqd = NewNSQd(1, options)
+	defer nsqd.Exit()
+
+	topicName := "test_channel_dead_letter" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("channel")
+	client := NewClientV2(nil)
+
+	// the backend's depth is updated just after a message is read from it
+	assertDeadLetterDepth := func(depth int64) {
+		for i := 0; i < 100 && channel.DeadLetterDepth() != depth; i++ {
+			time.Sleep(time.Millisecond)
+		}
+		assert.Equal(t, channel.DeadLetterDepth(), depth)
+	}
+
+	msg := nsq.NewMessage(<-nsqd.idChan, []byte("test"))
+	channel.PutMessage(msg)
+
+	for i := 1; i <= 2; i++ {
+		outputMsg := <-channel.clientMsgChan
+		assert.Equal(t, outputMsg.Attempts, uint16(i))
+		channel.StartInFlightTimeout(outputMsg, client)
+		channel.RequeueMessage(client, outputMsg.Id, 0)
+	}
+
+	// the third attempt exceeds max attempts
+	for channel.DeadLetterDepth() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	deadLetters, err := channel.DeadLetters(0)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(deadLetters), 1)
+	assert.Equal(t, deadLetters[0].Id, msg.Id)
+
+	_, err = channel.RequeueDeadLetters(<-nsqd.idChan)
+	assert.NotEqual(t, err, nil)
+
+	count, err := channel.RequeueDeadLetters(msg.Id)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, count, 1)
+	assertDeadLetterDepth(0)
+
+	outputMsg := <-channel.clientMsgChan
+	assert.Equal(t, outputMsg.Id, msg.Id)
+	assert.Equal(t, outputMsg.Attempts, uint16(1))
+
+	// dead letters are written to the backend as they arrive and listing
+	// them leaves them in place
+	msg2 := nsq.NewMessage(<-nsqd.idChan, []byte("test"))
+	channel.pushDeadLetter(outputMsg)
+	channel.pushDeadLetter(msg2)
+	assert.Equal(t, channel.DeadLetterDepth(), int64(2))
+	deadLetters, err = channel.DeadLetters(1)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(deadLetters), 1)
+	assert.Equal(t, deadLetters[0].Id, outputMsg.Id)
+	deadLetters, _ = channel.DeadLetters(0)
+	assert.Equal(t, len(deadLetters), 2)
+	assert.Equal(t, channel.DeadLetterDepth(), int64(2))
+
+	// removing some of them keeps the rest
+	count, err = channel.PurgeDeadLetters(outputMsg.Id)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, count, 1)
+	assertDeadLetterDepth(1)
+	deadLetters, _ = channel.DeadLetters(0)
+	assert.Equal(t, len(deadLetters), 1)
+	assert.Equal(t, deadLetters[0].Id, msg2.Id)
+
+	count, err = channel.PurgeDeadLetters()
+	assert.Equal(t, err, nil)
+	assert.Equal(t, count, 1)
+	assertDeadLetterDepth(0)
+}
+
+func TestChannelRemoveClientRequeue(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	nsqd = NewNSQd(1, testNsqdOptions())
+	defer nsqd.Exit()
+
+	topicName := "test_channel_remove_client" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("channel")
+	client1 := NewClientV2(nil)
+	client2 := NewClientV2(nil)
+	channel.AddClient(client1)
+	channel.AddClient(client2)
+
+	for i := 0; i < 10; i++ {
+		msg := nsq.NewMessage(<-nsqd.idChan, []byte("test"))
+		if i%2 == 0 {
+			channel.StartInFlightTimeout(msg, client1)
+		} else {
+			channel.StartInFlightTimeout(msg, client2)
+		}
+	}
+
+	channel.RemoveClient(client1)
+
+	assert.Equal(t, len(channel.inFlightMessages), 5)
+	assert.Equal(t, len(channel.inFlightPQ), 5)
+	assert.Equal(t, channel.disconnectRequeueCount, uint64(5))
+	assert.Equal(t, channel.timeoutCount, uint64(0))
+
+	for i := 0; i < 5; i++ {
+		msg := <-channel.clientMsgChan
+		assert.Equal(t, msg.Attempts, uint16(1))
+	}
+
+	channel.RemoveClient(client2)
+	assert.Equal(t, len(channel.inFlightMessages), 0)
+	assert.Equal(t, channel.disconnectRequeueCount, uint64(10))
+}
+
+func TestChannelOrdered(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	nsqd = NewNSQd(1, testNsqdOptions())
+	defer nsqd.Exit()
+
+	topicName := "test_channel_ordered" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("channel")
+	channel.SetOrdered(true)
+	client := NewClientV2(nil)
+
+	msgs := make([]*nsq.Message, 3)
+	for i := range msgs {
+		msgs[i] = nsq.NewMessage(<-nsqd.idChan, []byte("test"))
+		channel.PutMessage(msgs[i])
+	}
+
+	// nothing else is delivered while a message is outstanding
+	assertNoMessage := func() {
+		select {
+		case msg := <-channel.clientMsgChan:
+			t.Fatalf("unexpected msg(%s) while another was outstanding", msg.Id)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+
+	outputMsg := <-channel.clientMsgChan
+	assert.Equal(t, outputMsg.Id, msgs[0].Id)
+	assertNoMessage()
+	channel.StartInFlightTimeout(outputMsg, client)
+	assertNoMessage()
+
+	// a requeued message is redelivered before any newer message
+	channel.RequeueMessage(client, outputMsg.Id, 0)
+	outputMsg = <-channel.clientMsgChan
+	assert.Equal(t, outputMsg.Id, msgs[0].Id)
+	assert.Equal(t, outputMsg.Attempts, uint16(2))
+	channel.StartInFlightTimeout(outputMsg, client)
+	channel.FinishMessage(client, outputMsg.Id)
+
+	outputMsg = <-channel.clientMsgChan
+	assert.Equal(t, outputMsg.Id, msgs[1].Id)
+	channel.StartInFlightTimeout(outputMsg, client)
+	channel.RequeueMessage(client, outputMsg.Id, 10*time.Millisecond)
+	outputMsg = <-channel.clientMsgChan
+	assert.Equal(t, outputMsg.Id, msgs[1].Id)
+	assert.Equal(t, outputMsg.Attempts, uint16(2))
+	channel.StartInFlightTimeout(outputMsg, client)
+	channel.FinishMessage(client, outputMsg.Id)
+
+	outputMsg = <-channel.clientMsgChan
+	assert.Equal(t, outputMsg.Id, msgs[2].Id)
+	channel.StartInFlightTimeout(outputMsg, client)
+
+	// unordered again, the message in-flight no longer holds up delivery
+	channel.SetOrdered(false)
+	msg := nsq.NewMessage(<-nsqd.idChan, []byte("test"))
+	channel.PutMessage(msg)
+	outputMsg = <-channel.clientMsgChan
+	assert.Equal(t, outputMsg.Id, msg.Id)
+}
+
+func TestChannelOrderedDeferred(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	nsqd = NewNSQd(1, testNsqdOptions())
+	defer nsqd.Exit()
+
+	topicName := "test_channel_ordered_deferred" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("channel")
+	channel.SetOrdered(true)
+
+	// a message deferred by its producer was never delivered, so it doesn't
+	// hold up the messages published after it
+	deferredMsg := nsq.NewMessage(<-nsqd.idChan, []byte("test"))
+	deferredMsg.Deferred = time.Hour
+	topic.PutMessage(deferredMsg)
+	msg := nsq.NewMessage(<-nsqd.idChan, []byte("test"))
+	topic.PutMessage(msg)
+
+	select {
+	case outputMsg := <-channel.clientMsgChan:
+		assert.Equal(t, outputMsg.Id, msg.Id)
+	case <-time.After(time.Second):
+		t.Fatalf("deferred msg(%s) held up delivery", deferredMsg.Id)
+	}
+}
+
+func TestHashRing(t *testing.T) {
+	clients := make([]Consumer, 0)
+	for i := 0; i < 4; i++ {
+		clients = append(clients, NewClientV2(nil))
+	}
+	ring := newHashRing(clients)
+
+	owners := make(map[string]Consumer)
+	counts := make(map[Consumer]int)
+	for i := 0; i < 1000; i++ {
+		key := strconv.Itoa(i)
+		owners[key] = ring.Get(key)
+		counts[owners[key]]++
+	}
+	assert.Equal(t, len(counts), 4)
+
+	// only keys of the added client move
+	added := NewClientV2(nil)
+	ring = newHashRing(append(clients, added))
+	for key, owner := range owners {
+		newOwner := ring.Get(key)
+		if newOwner != owner && newOwner != added {
+			t.Fatalf("key %s moved between existing clients", key)
+		}
+	}
+
+	// only keys of the removed client move
+	removed := clients[0]
+	ring = newHashRing(clients[1:])
+	for key, owner := range owners {
+		newOwner := ring.Get(key)
+		assert.NotEqual(t, newOwner, removed)
+		if owner != removed && newOwner != owner {
+			t.Fatalf("key %s moved from a remaining client", key)
+		}
+	}
+
+	assert.Equal(t, newHashRing(nil).Get("key"), nil)
+}
+
+func TestChannelPartitionKey(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	nsqd = NewNSQd(1, testNsqdOptions())
+	defer nsqd.Exit()
+
+	topicName := "test_channel_partition_key" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("channel")
+	client1 := NewClientV2(nil)
+	client2 := NewClientV2(nil)
+	channel.AddClient(client1)
+	channel.AddClient(client2)
+
+	keyedMsgChans := map[Consumer]chan *nsq.Message{
+		client1: channel.KeyedMsgChan(client1),
+		client2: channel.KeyedMsgChan(client2),
+	}
+
+	// find a key owned by each client
+	keys := make(map[Consumer]string)
+	for i := 0; len(keys) < 2; i++ {
+		key := strconv.Itoa(i)
+		keys[channel.ring.Get(key)] = key
+	}
+
+	for _, client := range []Consumer{client1, client2, client1} {
+		msg := nsq.NewMessage(<-nsqd.idChan, []byte("test"))
+		msg.SetHeader(nsq.PartitionKeyHeader, keys[client])
+		channel.PutMessage(msg)
+
+		outputMsg := <-keyedMsgChans[client]
+		assert.Equal(t, outputMsg.Id, msg.Id)
+	}
+
+	// messages without a key are shared
+	msg := nsq.NewMessage(<-nsqd.idChan, []byte("test"))
+	channel.PutMessage(msg)
+	outputMsg := <-channel.clientMsgChan
+	assert.Equal(t, outputMsg.Id, msg.Id)
+
+	// a message waiting for a client that is removed moves to its new owner
+	msg = nsq.NewMessage(<-nsqd.idChan, []byte("test"))
+	msg.SetHeader(nsq.PartitionKeyHeader, keys[client1])
+	channel.PutMessage(msg)
+	time.Sleep(10 * time.Millisecond)
+	channel.RemoveClient(client1)
+	assert.Equal(t, channel.KeyedMsgChan(client1), (chan *nsq.Message)(nil))
+	outputMsg = <-keyedMsgChans[client2]
+	assert.Equal(t, outputMsg.Id, msg.Id)
+
+	channel.RemoveClient(client2)
+}
+
+func TestChannelPartitionKeySlowClient(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	nsqd = NewNSQd(1, testNsqdOptions())
+	defer nsqd.Exit()
+
+	topicName := "test_channel_partition_key_slow" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("channel")
+	client1 := NewClientV2(nil)
+	client2 := NewClientV2(nil)
+	channel.AddClient(client1)
+	channel.AddClient(client2)
+
+	keys := make(map[Consumer]string)
+	for i := 0; len(keys) < 2; i++ {
+		key := strconv.Itoa(i)
+		keys[channel.ring.Get(key)] = key
+	}
+
+	// client1 doesn't read its messages, once its keyedMsgChan is full the rest
+	// wait (in order) rather than holding up client2's
+	msgs := make([]*nsq.Message, keyedMsgChanSize*2)
+	for i := range msgs {
+		msgs[i] = nsq.NewMessage(<-nsqd.idChan, []byte("test"))
+		msgs[i].SetHeader(nsq.PartitionKeyHeader, keys[client1])
+		channel.PutMessage(msgs[i])
+	}
+	msg := nsq.NewMessage(<-nsqd.idChan, []byte("test"))
+	msg.SetHeader(nsq.PartitionKeyHeader, keys[client2])
+	channel.PutMessage(msg)
+
+	keyedMsgChan1 := channel.KeyedMsgChan(client1)
+	keyedMsgChan2 := channel.KeyedMsgChan(client2)
+	select {
+	case outputMsg := <-keyedMsgChan2:
+		assert.Equal(t, outputMsg.Id, msg.Id)
+	case <-time.After(time.Second):
+		t.Fatalf("client2 blocked by client1")
+	}
+
+	// the messages waiting for client1 count towards the channel's depth
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(t, channel.Depth(), int64(len(msgs)))
+
+	for i := range msgs {
+		outputMsg := <-keyedMsgChan1
+		assert.Equal(t, outputMsg.Id, msgs[i].Id)
+		assert.Equal(t, outputMsg.Attempts, uint16(1))
+	}
+
+	channel.RemoveClient(client1)
+	channel.RemoveClient(client2)
+}
+
+func TestChannelDeferredPersistence(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	options := testNsqdOptions()
+	nsqd = NewNSQd(1, options)
+
+	topicName := "test_channel_deferred_persistence" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("channel")
+
+	msg := nsq.NewMessage(<-nsqd.idChan, []byte("test"))
+	channel.StartDeferredTimeout(msg, time.Hour)
+	dueTs := channel.deferredMessages[msg.Id].Priority
+
+	nsqd.Exit()
+
+	// start up a new nsqd w/ the same folder
+	nsqd = NewNSQd(1, options)
+	defer nsqd.Exit()
+
+	topic = nsqd.GetTopic(topicName)
+	channel = topic.GetChannel("channel")
+
+	assert.Equal(t, channel.Depth(), int64(0))
+	assert.Equal(t, len(channel.deferredMessages), 1)
+	assert.Equal(t, len(channel.deferredPQ), 1)
+	item, ok := channel.deferredMessages[msg.Id]
+	assert.Equal(t, ok, true)
+	assert.Equal(t, item.Priority, dueTs)
+	assert.Equal(t, item.Value.(*nsq.Message).Body, msg.Body)
+
+	// the file is consumed once loaded
+	_, err := os.Stat(channel.deferredFileName())
+	assert.Equal(t, os.IsNotExist(err), true)
+
+	topic.DeleteExistingChannel("channel")
+}
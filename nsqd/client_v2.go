@@ -2,7 +2,11 @@ package main
 
 import (
 	"bufio"
+	"compress/flate"
+	"crypto/tls"
 	"github.com/bitly/nsq/nsq"
+	"github.com/golang/snappy"
+	"io"
 	"log"
 	"net"
 	"sync"
@@ -10,6 +14,8 @@ import (
 	"time"
 )
 
+const defaultBufferSize = 16 * 1024
+
 type ClientV2 struct {
 	net.Conn
 	sync.Mutex
@@ -29,10 +35,58 @@ type ClientV2 struct {
 	ShortIdentifier string
 	LongIdentifier  string
 	SubEventChan    chan *Channel
+	DrainChan       chan int
+	TLS             int32
+	Deflate         int32
+	Snappy          int32
+
+	// set once IDENTIFY has run (it may only run once per connection)
+	Identified int32
+
+	// bytes on the wire and (when compression is negotiated) before compression
+	BytesReceived             uint64
+	BytesSent                 uint64
+	UncompressedBytesReceived uint64
+	UncompressedBytesSent     uint64
+
+	tlsConn    *tls.Conn
+	compressor *compressWriter
+
+	// the secret sent via AUTH and the permissions it was last granted
+	authLock   sync.RWMutex
+	AuthSecret string
+	AuthState  *AuthState
 
 	// heartbeats are client configurable via IDENTIFY
 	HeartbeatInterval   time.Duration
 	HeartbeatUpdateChan chan time.Duration
+
+	// output buffering is client configurable via IDENTIFY
+	// (a timeout of 0 means data is only flushed when the buffer is full,
+	// or when there are no messages to send)
+	OutputBufferSize              int
+	OutputBufferTimeout           time.Duration
+	OutputBufferTimeoutUpdateChan chan time.Duration
+
+	// the duration after which in-flight messages are requeued is client
+	// configurable via IDENTIFY
+	MsgTimeout time.Duration
+
+	// the percentage of messages delivered (the rest are discarded),
+	// client configurable via IDENTIFY (0 delivers every message)
+	SampleRate int32
+
+	// the maximum number of messages sent in a single frame, client
+	// configurable via IDENTIFY (0 sends one message per frame)
+	MessageBatchSize int32
+
+	// the format of the messages sent to (and the bodies published by) this
+	// client, nsq.MessageVersion2 (with headers) is negotiated via IDENTIFY
+	MessageVersion int
+
+	// whether the response to PUB/DPUB/MPUB is the IDs of the published
+	// messages (rather than OK), client configurable via IDENTIFY
+	ReturnMessageIDs bool
 }
 
 func NewClientV2(conn net.Conn) *ClientV2 {
@@ -41,7 +95,7 @@ func NewClientV2(conn net.Conn) *ClientV2 {
 		identifier, _, _ = net.SplitHostPort(conn.RemoteAddr().String())
 	}
 
-	return &ClientV2{
+	c := &ClientV2{
 		Conn: conn,
 		// ReadyStateChan has a buffer of 1 to guarantee that in the event
 		// there is a race the state update is not lost
@@ -50,15 +104,25 @@ func NewClientV2(conn net.Conn) *ClientV2 {
 		ConnectTime:     time.Now(),
 		ShortIdentifier: identifier,
 		LongIdentifier:  identifier,
-		Reader:          bufio.NewReaderSize(conn, 16*1024),
-		Writer:          bufio.NewWriterSize(conn, 16*1024),
 		State:           nsq.StateInit,
 		SubEventChan:    make(chan *Channel, 1),
+		DrainChan:       make(chan int, 1),
 
 		// heartbeats are client configurable but default to 30s
 		HeartbeatInterval:   nsqd.options.clientTimeout / 2,
 		HeartbeatUpdateChan: make(chan time.Duration, 1),
+
+		OutputBufferSize:              defaultBufferSize,
+		OutputBufferTimeout:           5 * time.Millisecond,
+		OutputBufferTimeoutUpdateChan: make(chan time.Duration, 1),
+
+		MsgTimeout:     nsqd.options.msgTimeout,
+		MessageVersion: nsq.MessageVersion1,
 	}
+	c.Reader = bufio.NewReaderSize(&countingReader{conn, &c.BytesReceived}, defaultBufferSize)
+	c.Writer = bufio.NewWriterSize(&countingWriter{conn, &c.BytesSent}, c.OutputBufferSize)
+
+	return c
 }
 
 func (c *ClientV2) String() string {
@@ -66,6 +130,24 @@ func (c *ClientV2) String() string {
 }
 
 func (c *ClientV2) Stats() ClientStats {
+	var identity, identityURL string
+	c.authLock.RLock()
+	authed := c.AuthState != nil
+	if authed {
+		identity = c.AuthState.Identity
+		identityURL = c.AuthState.IdentityURL
+	}
+	c.authLock.RUnlock()
+
+	bytesReceived := atomic.LoadUint64(&c.BytesReceived)
+	bytesSent := atomic.LoadUint64(&c.BytesSent)
+	uncompressedBytesReceived := bytesReceived
+	uncompressedBytesSent := bytesSent
+	if atomic.LoadInt32(&c.Deflate) == 1 || atomic.LoadInt32(&c.Snappy) == 1 {
+		uncompressedBytesReceived = atomic.LoadUint64(&c.UncompressedBytesReceived)
+		uncompressedBytesSent = atomic.LoadUint64(&c.UncompressedBytesSent)
+	}
+
 	return ClientStats{
 		Version:       "V2",
 		RemoteAddress: c.RemoteAddr().String(),
@@ -77,9 +159,203 @@ func (c *ClientV2) Stats() ClientStats {
 		FinishCount:   atomic.LoadUint64(&c.FinishCount),
 		RequeueCount:  atomic.LoadUint64(&c.RequeueCount),
 		ConnectTime:   c.ConnectTime.Unix(),
+		TLS:           atomic.LoadInt32(&c.TLS) == 1,
+		Deflate:       atomic.LoadInt32(&c.Deflate) == 1,
+		Snappy:        atomic.LoadInt32(&c.Snappy) == 1,
+		SampleRate:    atomic.LoadInt32(&c.SampleRate),
+
+		Authed:          authed,
+		AuthIdentity:    identity,
+		AuthIdentityURL: identityURL,
+
+		CompressedBytesReceived:   bytesReceived,
+		UncompressedBytesReceived: uncompressedBytesReceived,
+		CompressedBytesSent:       bytesSent,
+		UncompressedBytesSent:     uncompressedBytesSent,
 	}
 }
 
+// UpgradeTLS performs the server side of a TLS handshake and replaces the
+// client's Reader/Writer, it expects the caller to hold the client's lock
+//
+// NOTE: net.Conn remains the underlying connection (which deadlines apply to)
+func (c *ClientV2) UpgradeTLS() error {
+	tlsConn := tls.Server(c.Conn, nsqd.tlsConfig)
+	tlsConn.SetDeadline(time.Now().Add(5 * time.Second))
+	err := tlsConn.Handshake()
+	if err != nil {
+		return err
+	}
+	tlsConn.SetDeadline(time.Time{})
+
+	c.tlsConn = tlsConn
+	c.Reader = bufio.NewReaderSize(&countingReader{tlsConn, &c.BytesReceived}, defaultBufferSize)
+	c.Writer = bufio.NewWriterSize(&countingWriter{tlsConn, &c.BytesSent}, c.OutputBufferSize)
+	atomic.StoreInt32(&c.TLS, 1)
+
+	return nil
+}
+
+// UpgradeDeflate replaces the client's Reader/Writer with ones that
+// (de)compress using deflate at the specified level, it expects the
+// caller to hold the client's lock
+func (c *ClientV2) UpgradeDeflate(level int) error {
+	conn := c.transport()
+
+	fw, err := flate.NewWriter(&countingWriter{conn, &c.BytesSent}, level)
+	if err != nil {
+		return err
+	}
+
+	c.upgradeCompression(flate.NewReader(&countingReader{conn, &c.BytesReceived}), fw)
+	atomic.StoreInt32(&c.Deflate, 1)
+
+	return nil
+}
+
+// UpgradeSnappy replaces the client's Reader/Writer with ones that
+// (de)compress using the snappy framing format, it expects the caller
+// to hold the client's lock
+func (c *ClientV2) UpgradeSnappy() {
+	conn := c.transport()
+
+	c.upgradeCompression(snappy.NewReader(&countingReader{conn, &c.BytesReceived}),
+		snappy.NewBufferedWriter(&countingWriter{conn, &c.BytesSent}))
+	atomic.StoreInt32(&c.Snappy, 1)
+}
+
+func (c *ClientV2) upgradeCompression(r io.Reader, w flushWriter) {
+	// uncompressed counts start from what was exchanged before the upgrade
+	atomic.StoreUint64(&c.UncompressedBytesReceived, atomic.LoadUint64(&c.BytesReceived))
+	atomic.StoreUint64(&c.UncompressedBytesSent, atomic.LoadUint64(&c.BytesSent))
+
+	c.compressor = &compressWriter{w: w, count: &c.UncompressedBytesSent}
+	c.Reader = bufio.NewReaderSize(&countingReader{r, &c.UncompressedBytesReceived}, defaultBufferSize)
+	c.Writer = bufio.NewWriterSize(c.compressor, c.OutputBufferSize)
+}
+
+// SetOutputBufferSize flushes and replaces the client's Writer with one
+// buffering size bytes
+func (c *ClientV2) SetOutputBufferSize(size int) error {
+	c.Lock()
+	defer c.Unlock()
+
+	err := c.Writer.Flush()
+	if err != nil {
+		return err
+	}
+
+	var w io.Writer = &countingWriter{c.transport(), &c.BytesSent}
+	if c.compressor != nil {
+		w = c.compressor
+	}
+
+	c.OutputBufferSize = size
+	c.Writer = bufio.NewWriterSize(w, size)
+
+	return nil
+}
+
+// SetOutputBufferTimeout updates the duration after which buffered data is flushed
+func (c *ClientV2) SetOutputBufferTimeout(timeout time.Duration) {
+	c.Lock()
+	c.OutputBufferTimeout = timeout
+	c.Unlock()
+
+	select {
+	case c.OutputBufferTimeoutUpdateChan <- timeout:
+	default:
+	}
+}
+
+// transport returns the connection that (possibly compressed) data is
+// written to and read from
+func (c *ClientV2) transport() net.Conn {
+	if c.tlsConn != nil {
+		return c.tlsConn
+	}
+	return c.Conn
+}
+
+// Flush writes any buffered data (including data held by a compressor)
+// to the connection, it expects the caller to hold the client's lock
+func (c *ClientV2) Flush() error {
+	err := c.Writer.Flush()
+	if err != nil {
+		return err
+	}
+
+	if c.compressor != nil {
+		return c.compressor.Flush()
+	}
+
+	return nil
+}
+
+// NeedsFlush returns whether there is buffered data that has not been
+// written to the connection, it expects the caller to hold the client's lock
+func (c *ClientV2) NeedsFlush() bool {
+	if c.Writer.Buffered() > 0 {
+		return true
+	}
+	return c.compressor != nil && c.compressor.pending
+}
+
+// Auth queries the auth services for the permissions granted to secret
+func (c *ClientV2) Auth(secret string) error {
+	authState, err := c.queryAuth(secret)
+	if err != nil {
+		return err
+	}
+
+	c.authLock.Lock()
+	c.AuthSecret = secret
+	c.AuthState = authState
+	c.authLock.Unlock()
+
+	return nil
+}
+
+// IsAuthorized returns whether the client's AUTH secret grants the permission
+// for the topic/channel, refreshing the permissions if they've expired
+func (c *ClientV2) IsAuthorized(permission string, topic string, channel string) (bool, error) {
+	c.authLock.RLock()
+	secret := c.AuthSecret
+	authState := c.AuthState
+	c.authLock.RUnlock()
+
+	if authState == nil {
+		return false, nil
+	}
+
+	if authState.IsExpired() {
+		var err error
+		authState, err = c.queryAuth(secret)
+		if err != nil {
+			return false, err
+		}
+		c.authLock.Lock()
+		c.AuthState = authState
+		c.authLock.Unlock()
+	}
+
+	return authState.IsAllowed(permission, topic, channel), nil
+}
+
+func (c *ClientV2) HasAuthed() bool {
+	c.authLock.RLock()
+	defer c.authLock.RUnlock()
+	return c.AuthState != nil
+}
+
+func (c *ClientV2) queryAuth(secret string) (*AuthState, error) {
+	remoteIP, _, err := net.SplitHostPort(c.RemoteAddr().String())
+	if err != nil {
+		return nil, err
+	}
+	return nsqd.authCache.Get(secret, remoteIP, atomic.LoadInt32(&c.TLS) == 1)
+}
+
 func (c *ClientV2) IsReadyForMessages() bool {
 	if c.Channel.IsPaused() {
 		return false
@@ -139,18 +415,44 @@ func (c *ClientV2) TimedOutMessage() {
 	c.tryUpdateReadyState()
 }
 
+// MessageTimeout returns the duration after which messages in-flight to this
+// client are requeued
+func (c *ClientV2) MessageTimeout() time.Duration {
+	return c.MsgTimeout
+}
+
 func (c *ClientV2) RequeuedMessage() {
 	atomic.AddUint64(&c.RequeueCount, 1)
 	atomic.AddInt64(&c.InFlightCount, -1)
 	c.tryUpdateReadyState()
 }
 
-func (c *ClientV2) StartClose() {
+// StartClose stops sending messages to the client (which should close the
+// connection once it has responded to those in-flight), the connection is
+// closed after the timeout in case the client doesn't do it first
+func (c *ClientV2) StartClose(timeout time.Duration) {
 	// Force the client into ready 0
 	c.SetReadyCount(0)
 	// mark this client as closing
 	atomic.StoreInt32(&c.State, nsq.StateClosing)
-	// TODO: start a timer to actually close the channel (in case the client doesn't do it first)
+	time.AfterFunc(timeout, func() {
+		select {
+		case <-c.ExitChan:
+			// the client already closed the connection
+			return
+		default:
+		}
+		log.Printf("PROTOCOL(V2): [%s] closing after CLS timeout %s", c, timeout)
+		c.Close()
+	})
+}
+
+// Drain asks the client to close (ie. when nsqd is exiting)
+func (c *ClientV2) Drain() {
+	select {
+	case c.DrainChan <- 1:
+	default:
+	}
 }
 
 func (c *ClientV2) Pause() {
@@ -160,3 +462,55 @@ func (c *ClientV2) Pause() {
 func (c *ClientV2) UnPause() {
 	c.tryUpdateReadyState()
 }
+
+type countingReader struct {
+	r     io.Reader
+	count *uint64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	atomic.AddUint64(cr.count, uint64(n))
+	return n, err
+}
+
+type countingWriter struct {
+	w     io.Writer
+	count *uint64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	atomic.AddUint64(cw.count, uint64(n))
+	return n, err
+}
+
+type flushWriter interface {
+	io.Writer
+	Flush() error
+}
+
+// compressWriter counts the (uncompressed) bytes written to a compressor
+// and tracks whether the compressor is holding data that needs flushing
+type compressWriter struct {
+	w       flushWriter
+	count   *uint64
+	pending bool
+}
+
+func (cw *compressWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	atomic.AddUint64(cw.count, uint64(n))
+	if n > 0 {
+		cw.pending = true
+	}
+	return n, err
+}
+
+func (cw *compressWriter) Flush() error {
+	if !cw.pending {
+		return nil
+	}
+	cw.pending = false
+	return cw.w.Flush()
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/bitly/nsq/nsq"
+	"io/ioutil"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type dedupEntry struct {
+	key     string
+	id      nsq.MessageID
+	expires int64 // unix ns
+}
+
+// dedupIndex holds the producer supplied dedup keys (see nsq.DedupKeyHeader)
+// of a topic's messages published within the last window (up to maxKeys)
+type dedupIndex struct {
+	sync.Mutex
+	window  time.Duration
+	maxKeys int
+	keys    map[string]*dedupEntry
+	entries []*dedupEntry // in the order they expire
+	dirty   bool          // whether keys changed since they were persisted
+
+	hitCount  uint64
+	missCount uint64
+}
+
+func newDedupIndex(window time.Duration, maxKeys int) *dedupIndex {
+	return &dedupIndex{
+		window:  window,
+		maxKeys: maxKeys,
+		keys:    make(map[string]*dedupEntry),
+	}
+}
+
+func (d *dedupIndex) Enabled() bool {
+	return d.window > 0 && d.maxKeys > 0
+}
+
+// Filter returns the messages whose dedup key (if any) isn't in the index,
+// adding their keys.  The ID of a duplicate is set to that of the message
+// originally published with its key.
+func (d *dedupIndex) Filter(msgs []*nsq.Message) []*nsq.Message {
+	if !d.Enabled() || !hasDedupKeys(msgs) {
+		return msgs
+	}
+
+	now := time.Now().UnixNano()
+
+	d.Lock()
+	defer d.Unlock()
+
+	d.expire(now)
+
+	filtered := make([]*nsq.Message, 0, len(msgs))
+	for _, msg := range msgs {
+		key := msg.Header(nsq.DedupKeyHeader)
+		if key != "" {
+			entry, ok := d.keys[key]
+			if ok {
+				atomic.AddUint64(&d.hitCount, 1)
+				msg.Id = entry.id
+				continue
+			}
+			atomic.AddUint64(&d.missCount, 1)
+			d.add(&dedupEntry{key, msg.Id, now + int64(d.window)})
+		}
+		filtered = append(filtered, msg)
+	}
+
+	return filtered
+}
+
+func hasDedupKeys(msgs []*nsq.Message) bool {
+	for _, msg := range msgs {
+		if msg.Header(nsq.DedupKeyHeader) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// Remove removes the dedup keys of messages that failed to be published
+func (d *dedupIndex) Remove(msgs []*nsq.Message) {
+	if !d.Enabled() {
+		return
+	}
+
+	d.Lock()
+	defer d.Unlock()
+
+	for _, msg := range msgs {
+		key := msg.Header(nsq.DedupKeyHeader)
+		entry, ok := d.keys[key]
+		if ok && entry.id == msg.Id {
+			delete(d.keys, key)
+			d.dirty = true
+		}
+	}
+}
+
+// this expects the caller to handle locking
+func (d *dedupIndex) add(entry *dedupEntry) {
+	d.keys[entry.key] = entry
+	d.dirty = true
+	d.entries = append(d.entries, entry)
+	for len(d.keys) > d.maxKeys {
+		d.pop()
+	}
+}
+
+// this expects the caller to handle locking
+func (d *dedupIndex) expire(now int64) {
+	for len(d.entries) > 0 && d.entries[0].expires <= now {
+		d.pop()
+	}
+}
+
+// this expects the caller to handle locking
+func (d *dedupIndex) pop() {
+	entry := d.entries[0]
+	d.entries[0] = nil
+	d.entries = d.entries[1:]
+	// the key may have been removed (and added again)
+	if d.keys[entry.key] == entry {
+		delete(d.keys, entry.key)
+	}
+}
+
+// persist atomically writes the (unexpired) dedup keys to fileName, unless
+// they haven't changed since they were last persisted (or loaded)
+//
+// each record is of the form:
+//
+//	[ 8-byte expiry (unix ns) ][ 16-byte message ID ][ 2-byte size ][ N-byte key ]
+func (d *dedupIndex) persist(fileName string) error {
+	d.Lock()
+	defer d.Unlock()
+
+	if !d.dirty {
+		return nil
+	}
+
+	d.expire(time.Now().UnixNano())
+	if len(d.keys) == 0 {
+		err := os.Remove(fileName)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		d.dirty = false
+		return nil
+	}
+
+	tmpFileName := fileName + ".tmp"
+	f, err := os.OpenFile(tmpFileName, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+	for _, entry := range d.entries {
+		if d.keys[entry.key] != entry {
+			continue
+		}
+
+		err = binary.Write(w, binary.BigEndian, entry.expires)
+		if err != nil {
+			break
+		}
+
+		_, err = w.Write(entry.id[:])
+		if err != nil {
+			break
+		}
+
+		err = binary.Write(w, binary.BigEndian, uint16(len(entry.key)))
+		if err != nil {
+			break
+		}
+
+		_, err = w.WriteString(entry.key)
+		if err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		f.Close()
+		return err
+	}
+	f.Sync()
+	f.Close()
+
+	// atomically rename
+	err = os.Rename(tmpFileName, fileName)
+	if err != nil {
+		return err
+	}
+	d.dirty = false
+	return nil
+}
+
+// load restores the (unexpired) dedup keys written by persist, returning how
+// many were loaded
+func (d *dedupIndex) load(fileName string) (int, error) {
+	var expires int64
+	var size uint16
+
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+
+	d.Lock()
+	defer d.Unlock()
+
+	now := time.Now().UnixNano()
+	buf := bytes.NewBuffer(data)
+	for buf.Len() > 0 {
+		err = binary.Read(buf, binary.BigEndian, &expires)
+		if err != nil {
+			return len(d.keys), err
+		}
+
+		var entry dedupEntry
+		if buf.Len() < len(entry.id) {
+			return len(d.keys), fmt.Errorf("invalid dedup record")
+		}
+		copy(entry.id[:], buf.Next(len(entry.id)))
+
+		err = binary.Read(buf, binary.BigEndian, &size)
+		if err != nil {
+			return len(d.keys), err
+		}
+
+		if int(size) > buf.Len() {
+			return len(d.keys), fmt.Errorf("invalid dedup key size %d", size)
+		}
+		entry.key = string(buf.Next(int(size)))
+		entry.expires = expires
+
+		if expires > now {
+			d.add(&entry)
+		}
+	}
+	d.dirty = false
+
+	return len(d.keys), nil
+}
@@ -6,14 +6,43 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
+	"io/ioutil"
 	"log"
 	"os"
 	"path"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
+// the high bit of a record's 4-byte size indicates that it is followed by a
+// 4-byte CRC32 (IEEE) of the data (records written by older versions do not set it)
+const crcFlag = uint32(1 << 31)
+
+// each data file begins with a 16-byte header (4-byte magic, 4-byte version, 8-byte
+// maxBytesPerFile) recording the maxBytesPerFile it was created with, so that the
+// latter can change across restarts
+//
+// files written by older versions have no header, they're identified by not beginning
+// with the magic (which, read as a record size, would exceed any sane maxMsgSize)
+const (
+	segmentMagic      = "NSQD"
+	segmentVersion    = uint32(1)
+	segmentHeaderSize = 16
+)
+
+// corruptRecordError is returned by readOne when the record at the current
+// read position is invalid (as opposed to the file being unreadable)
+type corruptRecordError struct {
+	reason string
+}
+
+func (e *corruptRecordError) Error() string {
+	return "corrupt record - " + e.reason
+}
+
 // DiskQueue implements the BackendQueue interface
 // providing a filesystem backed FIFO queue
 type DiskQueue struct {
@@ -22,10 +51,21 @@ type DiskQueue struct {
 	// instatiation time metadata
 	name            string
 	dataPath        string
-	maxBytesPerFile int64 // currently this cannot change once created
-	syncEvery       int64 // number of writes per sync
+	maxBytesPerFile int64         // applies to files created from now on
+	maxMsgSize      int64         // writes larger than this are rejected
+	syncEvery       int64         // number of writes per sync
+	syncTimeout     time.Duration // duration of time per sync (if there were writes)
 	exitFlag        int32
 
+	// 1 if every write should be synced before returning
+	syncEveryWrite int32
+
+	// unix nanoseconds of the last successful sync
+	lastSync int64
+
+	// number of times a corrupt record was skipped
+	corruptCount int64
+
 	// run-time state (also persisted to disk)
 	readPos      int64
 	writePos     int64
@@ -43,33 +83,58 @@ type DiskQueue struct {
 	reader    *bufio.Reader
 	writeBuf  bytes.Buffer
 
-	// exposed via ReadChan()
+	// the maxBytesPerFile of the files currently being read and written
+	readFileMaxBytes  int64
+	writeFileMaxBytes int64
+
+	// the size of the current read file, once it is no longer being written
+	// (-1 until then, see readFileEnd)
+	readFileSize int64
+
+	// exposed via ReadChan() and IdleChan()
 	readChan chan []byte
+	idleChan chan int
 
 	// internal channels
 	writeChan         chan []byte
+	writeBatchChan    chan [][]byte
 	writeResponseChan chan error
 	emptyChan         chan int
 	emptyResponseChan chan error
+	peekChan          chan int
+	peekResponseChan  chan peekResponse
 	exitChan          chan int
 	exitSyncChan      chan int
 }
 
+type peekResponse struct {
+	data [][]byte
+	err  error
+}
+
 // NewDiskQueue instantiates a new instance of DiskQueue, retrieving metadata
 // from the filesystem and starting the read ahead goroutine
-func NewDiskQueue(name string, dataPath string, maxBytesPerFile int64, syncEvery int64) BackendQueue {
+func NewDiskQueue(name string, dataPath string, maxBytesPerFile int64, maxMsgSize int64,
+	syncEvery int64, syncTimeout time.Duration) BackendQueue {
 	d := DiskQueue{
 		name:              name,
 		dataPath:          dataPath,
 		maxBytesPerFile:   maxBytesPerFile,
+		maxMsgSize:        maxMsgSize,
 		readChan:          make(chan []byte),
+		idleChan:          make(chan int),
 		writeChan:         make(chan []byte),
+		writeBatchChan:    make(chan [][]byte),
 		writeResponseChan: make(chan error),
 		emptyChan:         make(chan int),
 		emptyResponseChan: make(chan error),
+		peekChan:          make(chan int),
+		peekResponseChan:  make(chan peekResponse),
 		exitChan:          make(chan int),
 		exitSyncChan:      make(chan int),
 		syncEvery:         syncEvery,
+		syncTimeout:       syncTimeout,
+		lastSync:          time.Now().UnixNano(),
 	}
 
 	// no need to lock here, nothing else could possibly be touching this instance
@@ -78,6 +143,20 @@ func NewDiskQueue(name string, dataPath string, maxBytesPerFile int64, syncEvery
 		log.Printf("ERROR: diskqueue(%s) failed to retrieveMetaData - %s", d.name, err.Error())
 	}
 
+	// a partially written file without a header (written by an older version) isn't
+	// appended to, so that it can be read to its end
+	if d.writePos > 0 {
+		f, err := os.OpenFile(d.fileName(d.writeFileNum), os.O_RDONLY, 0600)
+		if err == nil {
+			_, headerSize, err := d.readFileHeader(f)
+			f.Close()
+			if err == nil && headerSize == 0 {
+				d.writeFileNum++
+				d.writePos = 0
+			}
+		}
+	}
+
 	go d.ioLoop()
 
 	return &d
@@ -88,11 +167,51 @@ func (d *DiskQueue) Depth() int64 {
 	return atomic.LoadInt64(&d.depth)
 }
 
+// CorruptCount returns the number of corrupt records that have been skipped
+func (d *DiskQueue) CorruptCount() int64 {
+	return atomic.LoadInt64(&d.corruptCount)
+}
+
+// SetSyncEveryWrite sets whether or not every write is synced before Put() returns
+func (d *DiskQueue) SetSyncEveryWrite(enabled bool) {
+	if enabled {
+		atomic.StoreInt32(&d.syncEveryWrite, 1)
+	} else {
+		atomic.StoreInt32(&d.syncEveryWrite, 0)
+	}
+}
+
+// LastSync returns the time of the last successful sync
+func (d *DiskQueue) LastSync() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&d.lastSync))
+}
+
 // ReadChan returns the []byte channel for reading data
 func (d *DiskQueue) ReadChan() chan []byte {
 	return d.readChan
 }
 
+// IdleChan returns a channel that receives when there is no data left to read
+// (unlike Depth(), which can be overstated after corrupt data was skipped)
+func (d *DiskQueue) IdleChan() chan int {
+	return d.idleChan
+}
+
+// Peek returns up to limit (or, if limit is 0, all) of the []byte in the
+// queue, oldest first, without removing them
+func (d *DiskQueue) Peek(limit int) ([][]byte, error) {
+	d.RLock()
+	defer d.RUnlock()
+
+	if d.exitFlag == 1 {
+		return nil, errors.New("exiting")
+	}
+
+	d.peekChan <- limit
+	resp := <-d.peekResponseChan
+	return resp.data, resp.err
+}
+
 // Put writes a []byte to the queue
 func (d *DiskQueue) Put(data []byte) error {
 	d.RLock()
@@ -106,6 +225,20 @@ func (d *DiskQueue) Put(data []byte) error {
 	return <-d.writeResponseChan
 }
 
+// PutBatch writes a batch of []byte to the queue with a single
+// filesystem write (per file) and at most one sync
+func (d *DiskQueue) PutBatch(data [][]byte) error {
+	d.RLock()
+	defer d.RUnlock()
+
+	if d.exitFlag == 1 {
+		return errors.New("exiting")
+	}
+
+	d.writeBatchChan <- data
+	return <-d.writeResponseChan
+}
+
 // Close cleans up the queue and persists metadata
 func (d *DiskQueue) Close() error {
 	d.Lock()
@@ -185,11 +318,47 @@ func (d *DiskQueue) doEmpty() error {
 	return nil
 }
 
+// doPeek reads ahead from the read position with readOne (through a file of
+// its own), then restores the read state so that nothing is consumed
+func (d *DiskQueue) doPeek(limit int) ([][]byte, error) {
+	var data [][]byte
+	var err error
+
+	readFile, reader := d.readFile, d.reader
+	readFileNum, readPos := d.readFileNum, d.readPos
+	nextReadFileNum, nextReadPos := d.nextReadFileNum, d.nextReadPos
+	readFileMaxBytes, readFileSize := d.readFileMaxBytes, d.readFileSize
+
+	d.readFile = nil
+	for (limit <= 0 || len(data) < limit) &&
+		((d.readFileNum < d.writeFileNum) || (d.readPos < d.writePos)) {
+		var dataRead []byte
+		dataRead, err = d.readOne()
+		if err != nil {
+			break
+		}
+		data = append(data, dataRead)
+		d.readFileNum = d.nextReadFileNum
+		d.readPos = d.nextReadPos
+	}
+	if d.readFile != nil {
+		d.readFile.Close()
+	}
+
+	d.readFile, d.reader = readFile, reader
+	d.readFileNum, d.readPos = readFileNum, readPos
+	d.nextReadFileNum, d.nextReadPos = nextReadFileNum, nextReadPos
+	d.readFileMaxBytes, d.readFileSize = readFileMaxBytes, readFileSize
+
+	return data, err
+}
+
 // readOne performs a low level filesystem read for a single []byte
 // while advancing read positions and rolling files, if necessary
 func (d *DiskQueue) readOne() ([]byte, error) {
 	var err error
-	var msgSize int32
+	var msgSize uint32
+	var checksum uint32
 
 	if d.readFile == nil {
 		curFileName := d.fileName(d.readFileNum)
@@ -200,6 +369,18 @@ func (d *DiskQueue) readOne() ([]byte, error) {
 
 		log.Printf("DISKQUEUE(%s): readOne() opened %s", d.name, curFileName)
 
+		var headerSize int64
+		d.readFileMaxBytes, headerSize, err = d.readFileHeader(d.readFile)
+		if err != nil {
+			d.readFile.Close()
+			d.readFile = nil
+			return nil, err
+		}
+
+		if d.readPos < headerSize {
+			d.readPos = headerSize
+		}
+
 		if d.readPos > 0 {
 			_, err = d.readFile.Seek(d.readPos, 0)
 			if err != nil {
@@ -210,34 +391,67 @@ func (d *DiskQueue) readOne() ([]byte, error) {
 		}
 
 		d.reader = bufio.NewReader(d.readFile)
+		d.readFileSize = -1
 	}
 
 	err = binary.Read(d.reader, binary.BigEndian, &msgSize)
+	if err != nil {
+		d.readFile.Close()
+		d.readFile = nil
+		return nil, &corruptRecordError{err.Error()}
+	}
+
+	headerBytes := int64(4)
+	hasChecksum := msgSize&crcFlag != 0
+	if hasChecksum {
+		msgSize &^= crcFlag
+		err = binary.Read(d.reader, binary.BigEndian, &checksum)
+		if err != nil {
+			d.readFile.Close()
+			d.readFile = nil
+			return nil, &corruptRecordError{err.Error()}
+		}
+		headerBytes += 4
+	}
+
+	// a record can't extend past what has been written to the file (its size isn't
+	// checked against maxMsgSize, which may have been lowered since it was written)
+	readEnd, err := d.readFileEnd()
 	if err != nil {
 		d.readFile.Close()
 		d.readFile = nil
 		return nil, err
 	}
+	if d.readPos+headerBytes+int64(msgSize) > readEnd {
+		d.readFile.Close()
+		d.readFile = nil
+		return nil, &corruptRecordError{fmt.Sprintf("invalid message size %d", msgSize)}
+	}
 
 	readBuf := make([]byte, msgSize)
 	_, err = io.ReadFull(d.reader, readBuf)
 	if err != nil {
 		d.readFile.Close()
 		d.readFile = nil
-		return nil, err
+		return nil, &corruptRecordError{err.Error()}
+	}
+
+	if hasChecksum && crc32.ChecksumIEEE(readBuf) != checksum {
+		d.readFile.Close()
+		d.readFile = nil
+		return nil, &corruptRecordError{"checksum mismatch"}
 	}
 
-	totalBytes := int64(4 + msgSize)
+	totalBytes := headerBytes + int64(msgSize)
 
 	// we only advance next* because we have not yet sent this to consumers
 	// (where readFileNum, readPos will actually be advanced)
 	d.nextReadPos = d.readPos + totalBytes
 	d.nextReadFileNum = d.readFileNum
 
-	// TODO: each data file should embed the maxBytesPerFile
-	// as the first 8 bytes (at creation time) ensuring that
-	// the value can change without affecting runtime
-	if d.nextReadPos > d.maxBytesPerFile {
+	// files without a header (see readFileHeader) are read to their end
+	if (d.readFileMaxBytes > 0 && d.nextReadPos > d.readFileMaxBytes) ||
+		(d.readFileMaxBytes == 0 && d.nextReadPos >= readEnd && d.readFileNum < d.writeFileNum) {
 		if d.readFile != nil {
 			d.readFile.Close()
 			d.readFile = nil
@@ -250,74 +464,281 @@ func (d *DiskQueue) readOne() ([]byte, error) {
 	return readBuf, nil
 }
 
-// writeOne performs a low level filesystem write for a single []byte
-// while advancing write positions and rolling files, if necessary
-func (d *DiskQueue) writeOne(data []byte) error {
-	var err error
-
-	if d.writeFile == nil {
-		curFileName := d.fileName(d.writeFileNum)
-		d.writeFile, err = os.OpenFile(curFileName, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+// readFileEnd returns the position up to which the current read file has been written,
+// a file that is no longer being written is only stat'd once
+func (d *DiskQueue) readFileEnd() (int64, error) {
+	if d.readFileNum == d.writeFileNum {
+		return d.writePos, nil
+	}
+	if d.readFileSize < 0 {
+		stat, err := d.readFile.Stat()
 		if err != nil {
-			return err
+			return 0, err
 		}
+		d.readFileSize = stat.Size()
+	}
+	return d.readFileSize, nil
+}
 
-		log.Printf("DISKQUEUE(%s): writeOne() opened %s", d.name, curFileName)
+// skipCorruptRecord advances the read position past a corrupt record, either
+// to the next valid (checksummed) record in the current file or, if there isn't
+// one, to the next file.  The skipped bytes are appended to a .bad file.
+func (d *DiskQueue) skipCorruptRecord() {
+	var data []byte
 
-		if d.writePos > 0 {
-			_, err = d.writeFile.Seek(d.writePos, 0)
-			if err != nil {
+	atomic.AddInt64(&d.corruptCount, 1)
+
+	if d.readFile != nil {
+		d.readFile.Close()
+		d.readFile = nil
+	}
+
+	fn := d.fileName(d.readFileNum)
+	badFn := fn + ".bad"
+
+	f, err := os.OpenFile(fn, os.O_RDONLY, 0600)
+	if err == nil {
+		_, err = f.Seek(d.readPos, 0)
+		if err == nil {
+			data, err = ioutil.ReadAll(f)
+		}
+		f.Close()
+	}
+	if err != nil {
+		log.Printf("ERROR: diskqueue(%s) failed to read %s for recovery - %s", d.name, fn, err.Error())
+	}
+
+	// nothing past writePos has been written by us
+	if d.readFileNum == d.writeFileNum && int64(len(data)) > d.writePos-d.readPos {
+		data = data[:d.writePos-d.readPos]
+	}
+
+	skip := findNextRecord(data)
+	if skip > 0 {
+		data = data[:skip]
+	}
+
+	bf, err := os.OpenFile(badFn, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err == nil {
+		_, err = bf.Write(data)
+		bf.Close()
+	}
+	if err != nil {
+		log.Printf("ERROR: diskqueue(%s) failed to save %d bad bytes to %s - %s", d.name, len(data), badFn, err.Error())
+	}
+
+	if skip > 0 {
+		log.Printf("NOTICE: diskqueue(%s) skipping %d bytes to next valid record (saved to %s)", d.name, skip, badFn)
+
+		d.readPos += skip
+	} else {
+		log.Printf("NOTICE: diskqueue(%s) jump to next file (saved %d bad bytes to %s)", d.name, len(data), badFn)
+
+		if d.readFileNum == d.writeFileNum {
+			// we can't continue to write to a file we can't read from
+			if d.writeFile != nil {
 				d.writeFile.Close()
 				d.writeFile = nil
-				return err
 			}
+			d.writeFileNum++
+			d.writePos = 0
 		}
+
+		// everything before readPos has already been consumed
+		err := os.Remove(fn)
+		if err != nil {
+			log.Printf("ERROR: failed to Remove(%s) - %s", fn, err.Error())
+		}
+
+		d.readFileNum++
+		d.readPos = 0
 	}
+	d.nextReadFileNum = d.readFileNum
+	d.nextReadPos = d.readPos
 
-	dataLen := len(data)
+	// at least one message was lost
+	if atomic.LoadInt64(&d.depth) > 0 {
+		atomic.AddInt64(&d.depth, -1)
+	}
 
-	d.writeBuf.Reset()
-	err = binary.Write(&d.writeBuf, binary.BigEndian, int32(dataLen))
+	// significant state change, make sure we persist
+	err = d.sync()
 	if err != nil {
-		return err
+		log.Printf("ERROR: diskqueue(%s) failed to sync - %s", d.name, err.Error())
 	}
+}
 
-	_, err = d.writeBuf.Write(data)
-	if err != nil {
-		return err
+// findNextRecord returns the offset of the first record in data (after
+// the first byte) with a valid checksum, or -1 if there isn't one
+func findNextRecord(data []byte) int64 {
+	for i := 1; i+8 <= len(data); i++ {
+		size := binary.BigEndian.Uint32(data[i:])
+		if size&crcFlag == 0 {
+			continue
+		}
+		size &^= crcFlag
+		if i+8+int(size) > len(data) {
+			continue
+		}
+		checksum := binary.BigEndian.Uint32(data[i+4:])
+		if crc32.ChecksumIEEE(data[i+8:i+8+int(size)]) == checksum {
+			return int64(i)
+		}
 	}
+	return -1
+}
 
-	// only write to the file once
-	_, err = d.writeFile.Write(d.writeBuf.Bytes())
-	if err != nil {
-		d.writeFile.Close()
-		d.writeFile = nil
-		return err
+// writeOne performs a low level filesystem write for a single []byte
+// while advancing write positions and rolling files, if necessary
+func (d *DiskQueue) writeOne(data []byte) error {
+	return d.writeMany([][]byte{data})
+}
+
+// writeMany performs a low level filesystem write for a batch of []byte
+// while advancing write positions and rolling files, if necessary
+//
+// the records destined for each file are buffered and written with a single syscall
+func (d *DiskQueue) writeMany(data [][]byte) error {
+	var err error
+
+	// validate the entire batch up front so that it's written all or nothing
+	for _, msg := range data {
+		if int64(len(msg)) > d.maxMsgSize {
+			return fmt.Errorf("invalid message write size (%d) maxMsgSize=%d", len(msg), d.maxMsgSize)
+		}
 	}
 
-	totalBytes := int64(4 + dataLen)
-	d.writePos += totalBytes
-	atomic.AddInt64(&d.depth, 1)
+	for len(data) > 0 {
+		if d.writeFile == nil {
+			curFileName := d.fileName(d.writeFileNum)
+			d.writeFile, err = os.OpenFile(curFileName, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+			if err != nil {
+				return err
+			}
+
+			log.Printf("DISKQUEUE(%s): writeMany() opened %s", d.name, curFileName)
 
-	if d.writePos > d.maxBytesPerFile {
-		d.writeFileNum++
-		d.writePos = 0
+			if d.writePos > 0 {
+				// continue with the roll size the file was created with
+				d.writeFileMaxBytes, _, err = d.readFileHeader(d.writeFile)
+				if err != nil {
+					d.writeFile.Close()
+					d.writeFile = nil
+					return err
+				}
 
-		// sync every time we start writing to a new file
-		err = d.sync()
-		if err != nil {
-			log.Printf("ERROR: diskqueue(%s) failed to sync - %s", d.name, err.Error())
+				_, err = d.writeFile.Seek(d.writePos, 0)
+				if err != nil {
+					d.writeFile.Close()
+					d.writeFile = nil
+					return err
+				}
+			} else {
+				err = d.writeFileHeader(d.writeFile)
+				if err != nil {
+					d.writeFile.Close()
+					d.writeFile = nil
+					return err
+				}
+
+				d.writeFileMaxBytes = d.maxBytesPerFile
+				d.writePos = segmentHeaderSize
+			}
+		}
+
+		// buffer as many records as fit in the current file
+		d.writeBuf.Reset()
+		writePos := d.writePos
+		count := 0
+		for _, msg := range data {
+			err = binary.Write(&d.writeBuf, binary.BigEndian, uint32(len(msg))|crcFlag)
+			if err != nil {
+				return err
+			}
+
+			err = binary.Write(&d.writeBuf, binary.BigEndian, crc32.ChecksumIEEE(msg))
+			if err != nil {
+				return err
+			}
+
+			_, err = d.writeBuf.Write(msg)
+			if err != nil {
+				return err
+			}
+
+			writePos += int64(8 + len(msg))
+			count++
+			if writePos > d.writeFileMaxBytes {
+				break
+			}
 		}
 
-		if d.writeFile != nil {
+		// only write to the file once
+		_, err = d.writeFile.Write(d.writeBuf.Bytes())
+		if err != nil {
 			d.writeFile.Close()
 			d.writeFile = nil
+			return err
+		}
+
+		d.writePos = writePos
+		atomic.AddInt64(&d.depth, int64(count))
+		data = data[count:]
+
+		if d.writePos > d.writeFileMaxBytes {
+			d.writeFileNum++
+			d.writePos = 0
+
+			// sync every time we start writing to a new file
+			err = d.sync()
+			if err != nil {
+				log.Printf("ERROR: diskqueue(%s) failed to sync - %s", d.name, err.Error())
+			}
+
+			if d.writeFile != nil {
+				d.writeFile.Close()
+				d.writeFile = nil
+			}
 		}
 	}
 
 	return err
 }
 
+// readFileHeader returns the maxBytesPerFile recorded in the header of f and the
+// size of that header (both 0 for files without one, whose maxBytesPerFile is unknown)
+func (d *DiskQueue) readFileHeader(f *os.File) (int64, int64, error) {
+	var header [segmentHeaderSize]byte
+
+	_, err := f.ReadAt(header[:], 0)
+	if err != nil && err != io.EOF {
+		return 0, 0, err
+	}
+
+	if err == io.EOF || string(header[:4]) != segmentMagic {
+		return 0, 0, nil
+	}
+
+	version := binary.BigEndian.Uint32(header[4:8])
+	if version != segmentVersion {
+		return 0, 0, fmt.Errorf("unsupported file version %d", version)
+	}
+
+	return int64(binary.BigEndian.Uint64(header[8:16])), segmentHeaderSize, nil
+}
+
+// writeFileHeader writes the header for a newly created file
+func (d *DiskQueue) writeFileHeader(f *os.File) error {
+	var header [segmentHeaderSize]byte
+
+	copy(header[:4], segmentMagic)
+	binary.BigEndian.PutUint32(header[4:8], segmentVersion)
+	binary.BigEndian.PutUint64(header[8:16], uint64(d.maxBytesPerFile))
+
+	_, err := f.Write(header[:])
+	return err
+}
+
 // sync fsyncs the current writeFile and persists metadata
 func (d *DiskQueue) sync() error {
 	if d.writeFile != nil {
@@ -329,7 +750,13 @@ func (d *DiskQueue) sync() error {
 		}
 	}
 
-	return d.persistMetaData()
+	err := d.persistMetaData()
+	if err != nil {
+		return err
+	}
+
+	atomic.StoreInt64(&d.lastSync, time.Now().UnixNano())
+	return nil
 }
 
 // retrieveMetaData initializes state from the filesystem
@@ -407,11 +834,13 @@ func (d *DiskQueue) ioLoop() {
 	var err error
 	var count int64
 	var r chan []byte
+	var idle chan int
+
+	syncTicker := time.NewTicker(d.syncTimeout)
 
 	for {
-		count++
 		// dont sync all the time :)
-		if count == d.syncEvery {
+		if count >= d.syncEvery {
 			err := d.sync()
 			if err != nil {
 				log.Printf("ERROR: diskqueue(%s) failed to sync - %s", d.name, err.Error())
@@ -426,6 +855,11 @@ func (d *DiskQueue) ioLoop() {
 					log.Printf("ERROR: reading from diskqueue(%s) at %d of %s - %s",
 						d.name, d.readPos, d.fileName(d.readFileNum), err.Error())
 
+					if _, ok := err.(*corruptRecordError); ok {
+						d.skipCorruptRecord()
+						continue
+					}
+
 					// jump to the next read file and rename the current (bad) file
 					if d.readFileNum == d.writeFileNum {
 						// if you can't properly read from the current write file it's safe to
@@ -460,14 +894,23 @@ func (d *DiskQueue) ioLoop() {
 				}
 			}
 			r = d.readChan
+			idle = nil
 		} else {
+			// skipping corrupt data can lose track of how many messages
+			// remained, correct that now that we know there are none
+			if atomic.LoadInt64(&d.depth) != 0 {
+				log.Printf("NOTICE: diskqueue(%s) resetting depth %d to 0", d.name, atomic.LoadInt64(&d.depth))
+				atomic.StoreInt64(&d.depth, 0)
+			}
 			r = nil
+			idle = d.idleChan
 		}
 
 		select {
 		// the Go channel spec dictates that nil channel operations (read or write)
 		// in a select are skipped, we set r to d.readChan only when there is data to read
 		case r <- dataRead:
+			count++
 			oldReadFileNum := d.readFileNum
 			d.readFileNum = d.nextReadFileNum
 			d.readPos = d.nextReadPos
@@ -489,10 +932,38 @@ func (d *DiskQueue) ioLoop() {
 					log.Printf("ERROR: failed to Remove(%s) - %s", fn, err.Error())
 				}
 			}
+		case idle <- 1:
 		case <-d.emptyChan:
 			d.emptyResponseChan <- d.doEmpty()
+		case limit := <-d.peekChan:
+			data, err := d.doPeek(limit)
+			d.peekResponseChan <- peekResponse{data, err}
 		case dataWrite := <-d.writeChan:
-			d.writeResponseChan <- d.writeOne(dataWrite)
+			count++
+			err = d.writeOne(dataWrite)
+			if err == nil && atomic.LoadInt32(&d.syncEveryWrite) == 1 {
+				err = d.sync()
+				count = 0
+			}
+			d.writeResponseChan <- err
+		case dataWrite := <-d.writeBatchChan:
+			count += int64(len(dataWrite))
+			err = d.writeMany(dataWrite)
+			if err == nil && atomic.LoadInt32(&d.syncEveryWrite) == 1 {
+				err = d.sync()
+				count = 0
+			}
+			d.writeResponseChan <- err
+		case <-syncTicker.C:
+			// only sync if something changed since the last one
+			if count == 0 {
+				continue
+			}
+			err = d.sync()
+			if err != nil {
+				log.Printf("ERROR: diskqueue(%s) failed to sync - %s", d.name, err.Error())
+			}
+			count = 0
 		case <-d.exitChan:
 			goto exit
 		}
@@ -500,5 +971,6 @@ func (d *DiskQueue) ioLoop() {
 
 exit:
 	log.Printf("DISKQUEUE(%s): closing ... ioLoop", d.name)
+	syncTicker.Stop()
 	d.exitSyncChan <- 1
 }
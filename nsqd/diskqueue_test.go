@@ -1,10 +1,14 @@
 package main
 
 import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
 	"github.com/bmizerany/assert"
 	"io/ioutil"
 	"log"
 	"os"
+	"path"
 	"strconv"
 	"sync"
 	"sync/atomic"
@@ -17,7 +21,7 @@ func TestDiskQueue(t *testing.T) {
 	defer log.SetOutput(os.Stdout)
 
 	dqName := "test_disk_queue" + strconv.Itoa(int(time.Now().Unix()))
-	dq := NewDiskQueue(dqName, os.TempDir(), 1024, 2500)
+	dq := NewDiskQueue(dqName, os.TempDir(), 1024, 1<<10, 2500, 2*time.Second)
 	assert.NotEqual(t, dq, nil)
 	assert.Equal(t, dq.Depth(), int64(0))
 
@@ -35,7 +39,7 @@ func TestDiskQueueRoll(t *testing.T) {
 	defer log.SetOutput(os.Stdout)
 
 	dqName := "test_disk_queue_roll" + strconv.Itoa(int(time.Now().Unix()))
-	dq := NewDiskQueue(dqName, os.TempDir(), 100, 2500)
+	dq := NewDiskQueue(dqName, os.TempDir(), 100, 1<<10, 2500, 2*time.Second)
 	assert.NotEqual(t, dq, nil)
 	assert.Equal(t, dq.Depth(), int64(0))
 
@@ -46,8 +50,8 @@ func TestDiskQueueRoll(t *testing.T) {
 		assert.Equal(t, dq.Depth(), int64(i+1))
 	}
 
-	assert.Equal(t, dq.(*DiskQueue).writeFileNum, int64(1))
-	assert.Equal(t, dq.(*DiskQueue).writePos, int64(28))
+	assert.Equal(t, dq.(*DiskQueue).writeFileNum, int64(2))
+	assert.Equal(t, dq.(*DiskQueue).writePos, int64(0))
 }
 
 func TestDiskQueueEmpty(t *testing.T) {
@@ -55,7 +59,7 @@ func TestDiskQueueEmpty(t *testing.T) {
 	defer log.SetOutput(os.Stdout)
 
 	dqName := "test_disk_queue_empty" + strconv.Itoa(int(time.Now().Unix()))
-	dq := NewDiskQueue(dqName, os.TempDir(), 100, 2500)
+	dq := NewDiskQueue(dqName, os.TempDir(), 100, 1<<10, 2500, 2*time.Second)
 	assert.NotEqual(t, dq, nil)
 	assert.Equal(t, dq.Depth(), int64(0))
 
@@ -115,7 +119,7 @@ func TestDiskQueueCorruption(t *testing.T) {
 	defer log.SetOutput(os.Stdout)
 
 	dqName := "test_disk_queue_corruption" + strconv.Itoa(int(time.Now().Unix()))
-	dq := NewDiskQueue(dqName, os.TempDir(), 1000, 5)
+	dq := NewDiskQueue(dqName, os.TempDir(), 1000, 1<<10, 5, 2*time.Second)
 
 	msg := make([]byte, 123)
 	for i := 0; i < 25; i++ {
@@ -141,6 +145,229 @@ func TestDiskQueueCorruption(t *testing.T) {
 	assert.Equal(t, <-dq.ReadChan(), msg)
 }
 
+func TestDiskQueueChecksum(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	dqName := "test_disk_queue_checksum" + strconv.Itoa(int(time.Now().Unix()))
+	dq := NewDiskQueue(dqName, os.TempDir(), 1000, 1<<10, 2500, 2*time.Second)
+
+	for i := 0; i < 5; i++ {
+		dq.Put([]byte(fmt.Sprintf("message %d", i)))
+	}
+
+	// flip a byte in the body of the 2nd record (each is 8 + 9 bytes)
+	dqFn := dq.(*DiskQueue).fileName(0)
+	f, _ := os.OpenFile(dqFn, os.O_RDWR, 0600)
+	f.WriteAt([]byte("X"), segmentHeaderSize+17+8+3)
+	f.Close()
+
+	assert.Equal(t, <-dq.ReadChan(), []byte("message 0"))
+	assert.Equal(t, <-dq.ReadChan(), []byte("message 2"))
+	assert.Equal(t, <-dq.ReadChan(), []byte("message 3"))
+	assert.Equal(t, <-dq.ReadChan(), []byte("message 4"))
+	assert.Equal(t, dq.(*DiskQueue).CorruptCount(), int64(1))
+
+	// the skipped record was saved
+	badBytes, err := ioutil.ReadFile(dqFn + ".bad")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(badBytes), 17)
+	os.Remove(dqFn + ".bad")
+
+	// the depth is corrected once there's nothing left to read
+	<-dq.IdleChan()
+	assert.Equal(t, dq.Depth(), int64(0))
+
+	dq.Put([]byte("message 5"))
+	assert.Equal(t, <-dq.ReadChan(), []byte("message 5"))
+}
+
+func TestDiskQueueLegacyRecords(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	dqName := "test_disk_queue_legacy" + strconv.Itoa(int(time.Now().Unix()))
+
+	// records written before checksums were added have no CRC, and files
+	// written before headers were added are read to their end (regardless
+	// of the maxBytesPerFile they were written with)
+	var buf bytes.Buffer
+	for i := 0; i < 6; i++ {
+		msg := []byte(fmt.Sprintf("message %d", i))
+		binary.Write(&buf, binary.BigEndian, int32(len(msg)))
+		buf.Write(msg)
+		if i == 3 || i == 5 {
+			dqFn := path.Join(os.TempDir(), fmt.Sprintf("%s.diskqueue.%06d.dat", dqName, i/4))
+			ioutil.WriteFile(dqFn, buf.Bytes(), 0600)
+			buf.Reset()
+		}
+	}
+	metaFn := path.Join(os.TempDir(), fmt.Sprintf("%s.diskqueue.meta.dat", dqName))
+	ioutil.WriteFile(metaFn, []byte(fmt.Sprintf("6\n0,0\n1,%d\n", 2*13)), 0600)
+
+	dq := NewDiskQueue(dqName, os.TempDir(), 20, 1<<10, 2500, 2*time.Second)
+	assert.Equal(t, dq.Depth(), int64(6))
+
+	// the partially written file isn't appended to
+	dq.Put([]byte("message 6"))
+	fi, err := os.Stat(dq.(*DiskQueue).fileName(1))
+	assert.Equal(t, err, nil)
+	assert.Equal(t, fi.Size(), int64(2*13))
+
+	for i := 0; i < 7; i++ {
+		assert.Equal(t, <-dq.ReadChan(), []byte(fmt.Sprintf("message %d", i)))
+	}
+	assert.Equal(t, dq.(*DiskQueue).CorruptCount(), int64(0))
+}
+
+func TestDiskQueueChangeMaxBytesPerFile(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	dqName := "test_disk_queue_max_bytes" + strconv.Itoa(int(time.Now().Unix()))
+	dq := NewDiskQueue(dqName, os.TempDir(), 100, 1<<10, 2500, 2*time.Second)
+
+	msg := []byte("aaaaaaaaaa")
+	for i := 0; i < 3; i++ {
+		dq.Put(msg)
+	}
+	dq.Close()
+
+	// the partially written file continues to roll at the size it was created with
+	dq = NewDiskQueue(dqName, os.TempDir(), 1000, 1<<10, 2500, 2*time.Second)
+	for i := 0; i < 5; i++ {
+		dq.Put(msg)
+	}
+	assert.Equal(t, dq.(*DiskQueue).writeFileNum, int64(1))
+	assert.Equal(t, dq.(*DiskQueue).writePos, int64(segmentHeaderSize+3*18))
+
+	f, _ := os.Open(dq.(*DiskQueue).fileName(1))
+	maxBytes, headerSize, err := dq.(*DiskQueue).readFileHeader(f)
+	f.Close()
+	assert.Equal(t, err, nil)
+	assert.Equal(t, maxBytes, int64(1000))
+	assert.Equal(t, headerSize, int64(segmentHeaderSize))
+
+	for i := 0; i < 8; i++ {
+		assert.Equal(t, <-dq.ReadChan(), msg)
+	}
+	assert.Equal(t, dq.(*DiskQueue).CorruptCount(), int64(0))
+}
+
+func TestDiskQueueLowerMaxMsgSize(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	dqName := "test_disk_queue_max_msg_size" + strconv.Itoa(int(time.Now().Unix()))
+	dq := NewDiskQueue(dqName, os.TempDir(), 1000, 1<<10, 2500, 2*time.Second)
+
+	msg := make([]byte, 100)
+	for i := 0; i < 3; i++ {
+		dq.Put(msg)
+	}
+	dq.Close()
+
+	// records written before the max message size was lowered are still valid
+	dq = NewDiskQueue(dqName, os.TempDir(), 1000, 10, 2500, 2*time.Second)
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, <-dq.ReadChan(), msg)
+	}
+	<-dq.IdleChan()
+	assert.Equal(t, dq.(*DiskQueue).CorruptCount(), int64(0))
+	assert.NotEqual(t, dq.Put(msg), nil)
+}
+
+func TestDiskQueueSyncTimeout(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	dqName := "test_disk_queue_sync_timeout" + strconv.Itoa(int(time.Now().Unix()))
+	dq := NewDiskQueue(dqName, os.TempDir(), 1024, 1<<10, 2500, 50*time.Millisecond)
+	defer dq.Close()
+
+	// nothing to sync
+	lastSync := dq.LastSync()
+	time.Sleep(150 * time.Millisecond)
+	assert.Equal(t, dq.LastSync(), lastSync)
+
+	dq.Put([]byte("test"))
+	time.Sleep(150 * time.Millisecond)
+	assert.Equal(t, dq.LastSync().After(lastSync), true)
+
+	// synced before Put() returns
+	dq.SetSyncEveryWrite(true)
+	start := time.Now()
+	dq.Put([]byte("test"))
+	assert.Equal(t, dq.LastSync().After(start), true)
+}
+
+func TestDiskQueuePutBatch(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	dqName := "test_disk_queue_put_batch" + strconv.Itoa(int(time.Now().Unix()))
+	dq := NewDiskQueue(dqName, os.TempDir(), 100, 1<<10, 2500, 2*time.Second)
+	defer dq.Close()
+
+	var batch [][]byte
+	for i := 0; i < 8; i++ {
+		batch = append(batch, []byte(fmt.Sprintf("message%d", i)))
+	}
+
+	// the batch spans two files (header + 6 * 16 bytes > 100)
+	err := dq.PutBatch(batch)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, dq.Depth(), int64(8))
+	assert.Equal(t, dq.(*DiskQueue).writeFileNum, int64(1))
+	assert.Equal(t, dq.(*DiskQueue).writePos, int64(segmentHeaderSize+2*16))
+
+	// a batch with an invalid message is rejected entirely
+	err = dq.PutBatch([][]byte{[]byte("test"), make([]byte, 1<<11)})
+	assert.NotEqual(t, err, nil)
+	assert.Equal(t, dq.Depth(), int64(8))
+
+	for i := 0; i < 8; i++ {
+		assert.Equal(t, <-dq.ReadChan(), batch[i])
+	}
+}
+
+func TestDiskQueuePeek(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	dqName := "test_disk_queue_peek" + strconv.Itoa(int(time.Now().Unix()))
+	dq := NewDiskQueue(dqName, os.TempDir(), 100, 1<<10, 2500, 2*time.Second)
+	defer dq.Close()
+
+	var batch [][]byte
+	for i := 0; i < 8; i++ {
+		batch = append(batch, []byte(fmt.Sprintf("message%d", i)))
+	}
+	err := dq.PutBatch(batch)
+	assert.Equal(t, err, nil)
+
+	// peeking (across files) doesn't consume anything
+	data, err := dq.Peek(0)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, data, batch)
+	data, err = dq.Peek(3)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, data, batch[:3])
+	assert.Equal(t, dq.Depth(), int64(8))
+
+	assert.Equal(t, <-dq.ReadChan(), batch[0])
+	data, err = dq.Peek(0)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, data, batch[1:])
+
+	for i := 1; i < 8; i++ {
+		assert.Equal(t, <-dq.ReadChan(), batch[i])
+	}
+	data, err = dq.Peek(0)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(data), 0)
+}
+
 func TestDiskQueueTorture(t *testing.T) {
 	log.SetOutput(ioutil.Discard)
 	defer log.SetOutput(os.Stdout)
@@ -148,7 +375,7 @@ func TestDiskQueueTorture(t *testing.T) {
 	var wg sync.WaitGroup
 
 	dqName := "test_disk_queue_torture" + strconv.Itoa(int(time.Now().Unix()))
-	dq := NewDiskQueue(dqName, os.TempDir(), 262144, 2500)
+	dq := NewDiskQueue(dqName, os.TempDir(), 262144, 1<<10, 2500, 2*time.Second)
 	assert.NotEqual(t, dq, nil)
 	assert.Equal(t, dq.Depth(), int64(0))
 
@@ -188,7 +415,7 @@ func TestDiskQueueTorture(t *testing.T) {
 	wg.Wait()
 
 	log.Printf("restarting diskqueue")
-	dq = NewDiskQueue(dqName, os.TempDir(), 262144, 2500)
+	dq = NewDiskQueue(dqName, os.TempDir(), 262144, 1<<10, 2500, 2*time.Second)
 	assert.NotEqual(t, dq, nil)
 	assert.Equal(t, dq.Depth(), depth)
 
@@ -232,7 +459,7 @@ func BenchmarkDiskQueuePut(b *testing.B) {
 	log.SetOutput(ioutil.Discard)
 	defer log.SetOutput(os.Stdout)
 	dqName := "bench_disk_queue_put" + strconv.Itoa(b.N) + strconv.Itoa(int(time.Now().Unix()))
-	dq := NewDiskQueue(dqName, os.TempDir(), 1024, 2500)
+	dq := NewDiskQueue(dqName, os.TempDir(), 1024, 1<<10, 2500, 2*time.Second)
 	b.StartTimer()
 
 	for i := 0; i < b.N; i++ {
@@ -248,7 +475,7 @@ func BenchmarkDiskQueueGet(b *testing.B) {
 	log.SetOutput(ioutil.Discard)
 	defer log.SetOutput(os.Stdout)
 	dqName := "bench_disk_queue_get" + strconv.Itoa(b.N) + strconv.Itoa(int(time.Now().Unix()))
-	dq := NewDiskQueue(dqName, os.TempDir(), 1024768, 2500)
+	dq := NewDiskQueue(dqName, os.TempDir(), 1024768, 1<<10, 2500, 2*time.Second)
 	for i := 0; i < b.N; i++ {
 		dq.Put([]byte("aaaaaaaaaaaaaaaaaaaaaaaaaaa"))
 	}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"hash/crc32"
+	"sort"
+)
+
+// the number of points each client has on a channel's hash ring (more
+// points spread the keys more evenly)
+const hashRingReplicas = 100
+
+type hashRingPoint struct {
+	hash   uint32
+	client Consumer
+}
+
+// hashRing maps partition keys (see nsq.PartitionKeyHeader) to a channel's
+// clients by consistent hashing, when a client is added (or removed) only
+// the keys of its points move
+type hashRing []hashRingPoint
+
+func newHashRing(clients []Consumer) hashRing {
+	ring := make(hashRing, 0, len(clients)*hashRingReplicas)
+	for _, client := range clients {
+		for i := 0; i < hashRingReplicas; i++ {
+			hash := crc32.ChecksumIEEE([]byte(fmt.Sprintf("%p-%d", client, i)))
+			ring = append(ring, hashRingPoint{hash, client})
+		}
+	}
+	sort.Sort(ring)
+	return ring
+}
+
+func (r hashRing) Len() int           { return len(r) }
+func (r hashRing) Less(i, j int) bool { return r[i].hash < r[j].hash }
+func (r hashRing) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+
+// Get returns the client owning key (nil if there are no clients)
+func (r hashRing) Get(key string) Consumer {
+	if len(r) == 0 {
+		return nil
+	}
+
+	hash := crc32.ChecksumIEEE([]byte(key))
+	i := sort.Search(len(r), func(i int) bool { return r[i].hash >= hash })
+	if i == len(r) {
+		i = 0
+	}
+	return r[i].client
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"github.com/bitly/nsq/nsq"
 	"github.com/bitly/nsq/util"
@@ -11,6 +12,7 @@ import (
 	"net/http"
 	"os"
 	"runtime/pprof"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -30,11 +32,17 @@ func httpServer(listener net.Listener) {
 	handler.HandleFunc("/empty_channel", emptyChannelHandler)
 	handler.HandleFunc("/delete_channel", deleteChannelHandler)
 	handler.HandleFunc("/mem_profile", memProfileHandler)
-	handler.HandleFunc("/cpu_profile", httpprof.Profile)
+	handler.HandleFunc("/cpu_profile", cpuProfileHandler)
 	handler.HandleFunc("/pause_channel", pauseChannelHandler)
 	handler.HandleFunc("/unpause_channel", pauseChannelHandler)
 	handler.HandleFunc("/create_topic", createTopicHandler)
 	handler.HandleFunc("/create_channel", createChannelHandler)
+	handler.HandleFunc("/set_max_attempts", setMaxAttemptsHandler)
+	handler.HandleFunc("/set_ordered", setOrderedHandler)
+	handler.HandleFunc("/set_sync_every_write", setSyncEveryWriteHandler)
+	handler.HandleFunc("/dead_letters", deadLettersHandler)
+	handler.HandleFunc("/requeue_dead_letters", requeueDeadLettersHandler)
+	handler.HandleFunc("/purge_dead_letters", purgeDeadLettersHandler)
 
 	// these timeouts are absolute per server connection NOT per request
 	// this means that a single persistent connection will only last N seconds
@@ -51,6 +59,10 @@ func httpServer(listener net.Listener) {
 }
 
 func memProfileHandler(w http.ResponseWriter, req *http.Request) {
+	if !checkHTTPAuth(w, req, permissionAdmin, "", "") {
+		return
+	}
+
 	log.Printf("MEMORY Profiling Enabled")
 	f, err := os.Create("nsqd.mprof")
 	if err != nil {
@@ -63,6 +75,14 @@ func memProfileHandler(w http.ResponseWriter, req *http.Request) {
 	io.WriteString(w, "OK")
 }
 
+func cpuProfileHandler(w http.ResponseWriter, req *http.Request) {
+	if !checkHTTPAuth(w, req, permissionAdmin, "", "") {
+		return
+	}
+
+	httpprof.Profile(w, req)
+}
+
 func pingHandler(w http.ResponseWriter, req *http.Request) {
 	w.Header().Set("Content-Length", "2")
 	io.WriteString(w, "OK")
@@ -95,21 +115,88 @@ func putHandler(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	if int64(len(reqParams.Body)) > nsqd.options.maxMessageSize {
+	if !checkHTTPAuth(w, req, permissionPublish, topicName, "") {
+		return
+	}
+
+	// an optional dedup key and partition key are stored in the message's
+	// headers, which (like those published via TCP) count towards the max
+	// message size
+	dedupKey, _ := reqParams.Get("dedup_key")
+	if len(dedupKey) > nsq.MaxMessageHeaders {
+		util.ApiResponse(w, 500, "INVALID_ARG_DEDUP_KEY", nil)
+		return
+	}
+	partitionKey, _ := reqParams.Get("partition_key")
+	if len(partitionKey) > nsq.MaxMessageHeaders {
+		util.ApiResponse(w, 500, "INVALID_ARG_PARTITION_KEY", nil)
+		return
+	}
+	size := len(reqParams.Body)
+	if dedupKey != "" || partitionKey != "" {
+		size += 2
+	}
+	if dedupKey != "" {
+		size += 2 + len(nsq.DedupKeyHeader) + 2 + len(dedupKey)
+	}
+	if partitionKey != "" {
+		size += 2 + len(nsq.PartitionKeyHeader) + 2 + len(partitionKey)
+	}
+	if int64(size) > nsqd.options.maxMessageSize {
 		util.ApiResponse(w, 500, "MSG_TOO_BIG", nil)
 		return
 	}
 
+	deferred, err := getDeferParam(reqParams)
+	if err != nil {
+		util.ApiResponse(w, 500, "INVALID_ARG_DEFER", nil)
+		return
+	}
+
+	returnIDs, err := getReturnIDsParam(reqParams)
+	if err != nil {
+		util.ApiResponse(w, 500, "INVALID_ARG_RETURN_IDS", nil)
+		return
+	}
+
+	// an optional producer supplied message ID
+	var msgID nsq.MessageID
+	idStr, err := reqParams.Get("id")
+	if err == nil {
+		if !nsq.IsValidMessageID([]byte(idStr)) {
+			util.ApiResponse(w, 500, "INVALID_ARG_ID", nil)
+			return
+		}
+		copy(msgID[:], idStr)
+	} else {
+		msgID = <-nsqd.idChan
+	}
+
+	if nsqd.IsExiting() {
+		util.ApiResponse(w, 500, "EXITING", nil)
+		return
+	}
+
 	topic := nsqd.GetTopic(topicName)
-	msg := nsq.NewMessage(<-nsqd.idChan, reqParams.Body)
+	msg := nsq.NewMessage(msgID, reqParams.Body)
+	msg.Deferred = deferred
+	if dedupKey != "" {
+		msg.SetHeader(nsq.DedupKeyHeader, dedupKey)
+	}
+	if partitionKey != "" {
+		msg.SetHeader(nsq.PartitionKeyHeader, partitionKey)
+	}
 	err = topic.PutMessage(msg)
+	if err == errDuplicateMessageID {
+		util.ApiResponse(w, 500, "DUPLICATE_ID", nil)
+		return
+	}
 	if err != nil {
 		util.ApiResponse(w, 500, "NOK", nil)
 		return
 	}
 
-	w.Header().Set("Content-Length", "2")
-	io.WriteString(w, "OK")
+	writePublishResponse(w, []*nsq.Message{msg}, returnIDs)
 }
 
 func mputHandler(w http.ResponseWriter, req *http.Request) {
@@ -131,7 +218,23 @@ func mputHandler(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	topic := nsqd.GetTopic(topicName)
+	if !checkHTTPAuth(w, req, permissionPublish, topicName, "") {
+		return
+	}
+
+	deferred, err := getDeferParam(reqParams)
+	if err != nil {
+		util.ApiResponse(w, 500, "INVALID_ARG_DEFER", nil)
+		return
+	}
+
+	returnIDs, err := getReturnIDsParam(reqParams)
+	if err != nil {
+		util.ApiResponse(w, 500, "INVALID_ARG_RETURN_IDS", nil)
+		return
+	}
+
+	var msgs []*nsq.Message
 	for _, block := range bytes.Split(reqParams.Body, []byte("\n")) {
 		if len(block) != 0 {
 			if int64(len(reqParams.Body)) > nsqd.options.maxMessageSize {
@@ -140,16 +243,71 @@ func mputHandler(w http.ResponseWriter, req *http.Request) {
 			}
 
 			msg := nsq.NewMessage(<-nsqd.idChan, block)
-			err := topic.PutMessage(msg)
-			if err != nil {
-				util.ApiResponse(w, 500, "NOK", nil)
-				return
-			}
+			msg.Deferred = deferred
+			msgs = append(msgs, msg)
 		}
 	}
 
-	w.Header().Set("Content-Length", "2")
-	io.WriteString(w, "OK")
+	if nsqd.IsExiting() {
+		util.ApiResponse(w, 500, "EXITING", nil)
+		return
+	}
+
+	topic := nsqd.GetTopic(topicName)
+	err = topic.PutMessages(msgs)
+	if err != nil {
+		util.ApiResponse(w, 500, "NOK", nil)
+		return
+	}
+
+	writePublishResponse(w, msgs, returnIDs)
+}
+
+// getReturnIDsParam parses the optional `return_ids` (boolean) parameter of /put and /mput
+func getReturnIDsParam(reqParams *util.ReqParams) (bool, error) {
+	returnIDsStr, err := reqParams.Get("return_ids")
+	if err != nil {
+		return false, nil
+	}
+	return strconv.ParseBool(returnIDsStr)
+}
+
+// writePublishResponse responds to /put and /mput with OK, or the IDs of the
+// messages (one per line) when requested via `return_ids`
+func writePublishResponse(w http.ResponseWriter, msgs []*nsq.Message, returnIDs bool) {
+	if !returnIDs {
+		w.Header().Set("Content-Length", "2")
+		io.WriteString(w, "OK")
+		return
+	}
+
+	ids := make([][]byte, len(msgs))
+	for i, msg := range msgs {
+		ids[i] = msg.Id[:]
+	}
+	resp := bytes.Join(ids, []byte("\n"))
+	w.Header().Set("Content-Length", strconv.Itoa(len(resp)))
+	w.Write(resp)
+}
+
+// getDeferParam parses the optional `defer` (in ms) parameter of /put and /mput
+func getDeferParam(reqParams *util.ReqParams) (time.Duration, error) {
+	deferStr, err := reqParams.Get("defer")
+	if err != nil {
+		return 0, nil
+	}
+
+	deferMs, err := strconv.ParseInt(deferStr, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+
+	deferred := time.Duration(deferMs) * time.Millisecond
+	if deferred < 0 || deferred > maxTimeout {
+		return 0, fmt.Errorf("defer %d out of range 0-%d", deferred, maxTimeout)
+	}
+
+	return deferred, nil
 }
 
 func createTopicHandler(w http.ResponseWriter, req *http.Request) {
@@ -171,6 +329,10 @@ func createTopicHandler(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	if !checkHTTPAuth(w, req, permissionPublish, topicName, "") {
+		return
+	}
+
 	nsqd.GetTopic(topicName)
 	util.ApiResponse(w, 200, "OK", nil)
 }
@@ -189,6 +351,10 @@ func deleteTopicHandler(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	if !checkHTTPAuth(w, req, permissionAdmin, topicName, "") {
+		return
+	}
+
 	err = nsqd.DeleteExistingTopic(topicName)
 	if err != nil {
 		util.ApiResponse(w, 500, "INVALID_TOPIC", nil)
@@ -212,6 +378,10 @@ func createChannelHandler(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	if !checkHTTPAuth(w, req, permissionSubscribe, topicName, channelName) {
+		return
+	}
+
 	topic, err := nsqd.GetExistingTopic(topicName)
 	if err != nil {
 		util.ApiResponse(w, 500, "INVALID_TOPIC", nil)
@@ -236,6 +406,10 @@ func emptyChannelHandler(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	if !checkHTTPAuth(w, req, permissionAdmin, topicName, channelName) {
+		return
+	}
+
 	topic, err := nsqd.GetExistingTopic(topicName)
 	if err != nil {
 		util.ApiResponse(w, 500, "INVALID_TOPIC", nil)
@@ -271,6 +445,10 @@ func deleteChannelHandler(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	if !checkHTTPAuth(w, req, permissionAdmin, topicName, channelName) {
+		return
+	}
+
 	topic, err := nsqd.GetExistingTopic(topicName)
 	if err != nil {
 		util.ApiResponse(w, 500, "INVALID_TOPIC", nil)
@@ -300,6 +478,10 @@ func pauseChannelHandler(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	if !checkHTTPAuth(w, req, permissionSubscribe, topicName, channelName) {
+		return
+	}
+
 	topic, err := nsqd.GetExistingTopic(topicName)
 	if err != nil {
 		util.ApiResponse(w, 500, "INVALID_TOPIC", nil)
@@ -321,6 +503,345 @@ func pauseChannelHandler(w http.ResponseWriter, req *http.Request) {
 	util.ApiResponse(w, 200, "OK", nil)
 }
 
+func setMaxAttemptsHandler(w http.ResponseWriter, req *http.Request) {
+	reqParams, err := util.NewReqParams(req)
+	if err != nil {
+		log.Printf("ERROR: failed to parse request params - %s", err.Error())
+		util.ApiResponse(w, 500, "INVALID_REQUEST", nil)
+		return
+	}
+
+	channel, err := getExistingChannelArgs(reqParams)
+	if err != nil {
+		util.ApiResponse(w, 500, err.Error(), nil)
+		return
+	}
+
+	if !checkHTTPAuth(w, req, permissionSubscribe, channel.topicName, channel.name) {
+		return
+	}
+
+	maxAttemptsStr, err := reqParams.Get("max_attempts")
+	if err != nil {
+		util.ApiResponse(w, 500, "MISSING_ARG_MAX_ATTEMPTS", nil)
+		return
+	}
+
+	maxAttempts, err := strconv.ParseUint(maxAttemptsStr, 10, 16)
+	if err != nil {
+		util.ApiResponse(w, 500, "INVALID_ARG_MAX_ATTEMPTS", nil)
+		return
+	}
+
+	channel.SetMaxAttempts(uint16(maxAttempts))
+
+	util.ApiResponse(w, 200, "OK", nil)
+}
+
+func setOrderedHandler(w http.ResponseWriter, req *http.Request) {
+	reqParams, err := util.NewReqParams(req)
+	if err != nil {
+		log.Printf("ERROR: failed to parse request params - %s", err.Error())
+		util.ApiResponse(w, 500, "INVALID_REQUEST", nil)
+		return
+	}
+
+	channel, err := getExistingChannelArgs(reqParams)
+	if err != nil {
+		util.ApiResponse(w, 500, err.Error(), nil)
+		return
+	}
+
+	if !checkHTTPAuth(w, req, permissionSubscribe, channel.topicName, channel.name) {
+		return
+	}
+
+	orderedStr, err := reqParams.Get("ordered")
+	if err != nil {
+		util.ApiResponse(w, 500, "MISSING_ARG_ORDERED", nil)
+		return
+	}
+
+	ordered, err := strconv.ParseBool(orderedStr)
+	if err != nil {
+		util.ApiResponse(w, 500, "INVALID_ARG_ORDERED", nil)
+		return
+	}
+
+	channel.SetOrdered(ordered)
+
+	util.ApiResponse(w, 200, "OK", nil)
+}
+
+func setSyncEveryWriteHandler(w http.ResponseWriter, req *http.Request) {
+	reqParams, err := util.NewReqParams(req)
+	if err != nil {
+		log.Printf("ERROR: failed to parse request params - %s", err.Error())
+		util.ApiResponse(w, 500, "INVALID_REQUEST", nil)
+		return
+	}
+
+	topicName, err := reqParams.Get("topic")
+	if err != nil {
+		util.ApiResponse(w, 500, "MISSING_ARG_TOPIC", nil)
+		return
+	}
+
+	if !checkHTTPAuth(w, req, permissionPublish, topicName, "") {
+		return
+	}
+
+	topic, err := nsqd.GetExistingTopic(topicName)
+	if err != nil {
+		util.ApiResponse(w, 500, "INVALID_TOPIC", nil)
+		return
+	}
+
+	syncEveryWriteStr, err := reqParams.Get("sync_every_write")
+	if err != nil {
+		util.ApiResponse(w, 500, "MISSING_ARG_SYNC_EVERY_WRITE", nil)
+		return
+	}
+
+	syncEveryWrite, err := strconv.ParseBool(syncEveryWriteStr)
+	if err != nil {
+		util.ApiResponse(w, 500, "INVALID_ARG_SYNC_EVERY_WRITE", nil)
+		return
+	}
+
+	topic.SetSyncEveryWrite(syncEveryWrite)
+
+	util.ApiResponse(w, 200, "OK", nil)
+}
+
+type deadLetter struct {
+	Id        string            `json:"id"`
+	Body      []byte            `json:"body"`
+	Headers   map[string]string `json:"headers,omitempty"`
+	Timestamp int64             `json:"timestamp"`
+	Attempts  uint16            `json:"attempts"`
+}
+
+func deadLettersHandler(w http.ResponseWriter, req *http.Request) {
+	reqParams, err := util.NewReqParams(req)
+	if err != nil {
+		log.Printf("ERROR: failed to parse request params - %s", err.Error())
+		util.ApiResponse(w, 500, "INVALID_REQUEST", nil)
+		return
+	}
+
+	channel, err := getExistingChannelArgs(reqParams)
+	if err != nil {
+		util.ApiResponse(w, 500, err.Error(), nil)
+		return
+	}
+
+	if !checkHTTPAuth(w, req, permissionSubscribe, channel.topicName, channel.name) {
+		return
+	}
+
+	limit, err := getLimitParam(reqParams)
+	if err != nil {
+		util.ApiResponse(w, 500, "INVALID_ARG_LIMIT", nil)
+		return
+	}
+
+	msgs, err := channel.DeadLetters(limit)
+	if err != nil {
+		log.Printf("ERROR: failed to read dead letters - %s", err.Error())
+		util.ApiResponse(w, 500, "INTERNAL_ERROR", nil)
+		return
+	}
+
+	deadLetters := make([]deadLetter, len(msgs))
+	for i, msg := range msgs {
+		deadLetters[i] = deadLetter{
+			Id:        string(msg.Id[:]),
+			Body:      msg.Body,
+			Headers:   msg.Headers,
+			Timestamp: msg.Timestamp,
+			Attempts:  msg.Attempts,
+		}
+	}
+
+	util.ApiResponse(w, 200, "OK", struct {
+		Messages []deadLetter `json:"messages"`
+	}{deadLetters})
+}
+
+func requeueDeadLettersHandler(w http.ResponseWriter, req *http.Request) {
+	reqParams, err := util.NewReqParams(req)
+	if err != nil {
+		log.Printf("ERROR: failed to parse request params - %s", err.Error())
+		util.ApiResponse(w, 500, "INVALID_REQUEST", nil)
+		return
+	}
+
+	channel, err := getExistingChannelArgs(reqParams)
+	if err != nil {
+		util.ApiResponse(w, 500, err.Error(), nil)
+		return
+	}
+
+	if !checkHTTPAuth(w, req, permissionSubscribe, channel.topicName, channel.name) {
+		return
+	}
+
+	ids, err := getDeadLetterIDs(reqParams)
+	if err != nil {
+		util.ApiResponse(w, 500, err.Error(), nil)
+		return
+	}
+
+	count, err := channel.RequeueDeadLetters(ids...)
+	if err == errDeadLetterNotFound {
+		util.ApiResponse(w, 500, "INVALID_ID", nil)
+		return
+	}
+	if err != nil {
+		log.Printf("ERROR: failed to requeue dead letters - %s", err.Error())
+		util.ApiResponse(w, 500, "INTERNAL_ERROR", nil)
+		return
+	}
+
+	util.ApiResponse(w, 200, "OK", struct {
+		Count int `json:"count"`
+	}{count})
+}
+
+func purgeDeadLettersHandler(w http.ResponseWriter, req *http.Request) {
+	reqParams, err := util.NewReqParams(req)
+	if err != nil {
+		log.Printf("ERROR: failed to parse request params - %s", err.Error())
+		util.ApiResponse(w, 500, "INVALID_REQUEST", nil)
+		return
+	}
+
+	channel, err := getExistingChannelArgs(reqParams)
+	if err != nil {
+		util.ApiResponse(w, 500, err.Error(), nil)
+		return
+	}
+
+	if !checkHTTPAuth(w, req, permissionAdmin, channel.topicName, channel.name) {
+		return
+	}
+
+	ids, err := getDeadLetterIDs(reqParams)
+	if err != nil {
+		util.ApiResponse(w, 500, err.Error(), nil)
+		return
+	}
+
+	count, err := channel.PurgeDeadLetters(ids...)
+	if err == errDeadLetterNotFound {
+		util.ApiResponse(w, 500, "INVALID_ID", nil)
+		return
+	}
+	if err != nil {
+		log.Printf("ERROR: failed to purge dead letters - %s", err.Error())
+		util.ApiResponse(w, 500, "INTERNAL_ERROR", nil)
+		return
+	}
+
+	util.ApiResponse(w, 200, "OK", struct {
+		Count int `json:"count"`
+	}{count})
+}
+
+// getLimitParam parses the optional `limit` parameter of /dead_letters
+// (0, the default, is unlimited)
+func getLimitParam(reqParams *util.ReqParams) (int, error) {
+	limitStr, err := reqParams.Get("limit")
+	if err != nil {
+		return 0, nil
+	}
+
+	limit, err := strconv.Atoi(limitStr)
+	if err != nil {
+		return 0, err
+	}
+	if limit < 0 {
+		return 0, fmt.Errorf("limit %d must not be negative", limit)
+	}
+
+	return limit, nil
+}
+
+// getDeadLetterIDs returns the id params of a request (without any
+// the entire dead letter queue is affected)
+func getDeadLetterIDs(reqParams *util.ReqParams) ([]nsq.MessageID, error) {
+	var ids []nsq.MessageID
+
+	idStrs, _ := reqParams.GetAll("id")
+	for _, idStr := range idStrs {
+		var id nsq.MessageID
+		if len(idStr) != nsq.MsgIdLength {
+			return nil, errors.New("INVALID_ARG_ID")
+		}
+		copy(id[:], idStr)
+		ids = append(ids, id)
+	}
+
+	return ids, nil
+}
+
+// checkHTTPAuth responds (and returns false) when auth is enabled and the secret
+// of the request (in the X-NSQ-Auth-Secret header) does not grant the permission
+// for the topic/channel
+func checkHTTPAuth(w http.ResponseWriter, req *http.Request, permission string, topicName string, channelName string) bool {
+	if !nsqd.IsAuthEnabled() {
+		return true
+	}
+
+	secret := req.Header.Get("X-NSQ-Auth-Secret")
+	if secret == "" {
+		util.ApiResponse(w, 403, "UNAUTHORIZED", nil)
+		return false
+	}
+
+	remoteIP, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		util.ApiResponse(w, 500, "INVALID_REQUEST", nil)
+		return false
+	}
+
+	authState, err := nsqd.authCache.Get(secret, remoteIP, req.TLS != nil)
+	if err != nil {
+		log.Printf("ERROR: HTTP auth failed - %s", err.Error())
+		util.ApiResponse(w, 500, "AUTH_FAILED", nil)
+		return false
+	}
+
+	if !authState.IsAllowed(permission, topicName, channelName) {
+		util.ApiResponse(w, 403, "UNAUTHORIZED", nil)
+		return false
+	}
+
+	return true
+}
+
+// getExistingChannelArgs returns the existing channel for the topic/channel params
+// (the error is suitable for use as the status_txt of the response)
+func getExistingChannelArgs(reqParams *util.ReqParams) (*Channel, error) {
+	topicName, channelName, err := util.GetTopicChannelArgs(reqParams)
+	if err != nil {
+		return nil, err
+	}
+
+	topic, err := nsqd.GetExistingTopic(topicName)
+	if err != nil {
+		return nil, errors.New("INVALID_TOPIC")
+	}
+
+	channel, err := topic.GetExistingChannel(channelName)
+	if err != nil {
+		return nil, errors.New("INVALID_CHANNEL")
+	}
+
+	return channel, nil
+}
+
 func statsHandler(w http.ResponseWriter, req *http.Request) {
 	reqParams, err := util.NewReqParams(req)
 	if err != nil {
@@ -349,11 +870,14 @@ func statsHandler(w http.ResponseWriter, req *http.Request) {
 			return
 		}
 		for _, t := range stats {
-			io.WriteString(w, fmt.Sprintf("\n[%-15s] depth: %-5d be-depth: %-5d msgs: %-8d\n",
+			io.WriteString(w, fmt.Sprintf("\n[%-15s] depth: %-5d be-depth: %-5d msgs: %-8d be-sync: %dms ago dedup: %d/%d\n",
 				t.TopicName,
 				t.Depth,
 				t.BackendDepth,
-				t.MessageCount))
+				t.MessageCount,
+				t.BackendLastSyncAge,
+				t.DedupHitCount,
+				t.DedupHitCount+t.DedupMissCount))
 			for _, c := range t.Channels {
 				var pausedPrefix string
 				if c.Paused {
@@ -362,7 +886,7 @@ func statsHandler(w http.ResponseWriter, req *http.Request) {
 					pausedPrefix = "    "
 				}
 				io.WriteString(w,
-					fmt.Sprintf("%s[%-25s] depth: %-5d be-depth: %-5d inflt: %-4d def: %-4d re-q: %-5d timeout: %-5d msgs: %-8d\n",
+					fmt.Sprintf("%s[%-25s] depth: %-5d be-depth: %-5d inflt: %-4d def: %-4d re-q: %-5d timeout: %-5d dead: %-4d msgs: %-8d\n",
 						pausedPrefix,
 						c.ChannelName,
 						c.Depth,
@@ -371,6 +895,7 @@ func statsHandler(w http.ResponseWriter, req *http.Request) {
 						c.DeferredCount,
 						c.RequeueCount,
 						c.TimeoutCount,
+						c.DeadLetterDepth,
 						c.MessageCount))
 				for _, client := range c.Clients {
 					connectTime := time.Unix(client.ConnectTime, 0)
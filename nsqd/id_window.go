@@ -0,0 +1,56 @@
+package main
+
+import (
+	"github.com/bitly/nsq/nsq"
+	"sync"
+)
+
+// idWindow holds the IDs of a topic's most recent messages (up to size) so that
+// a producer supplied ID can be rejected when it isn't unique
+type idWindow struct {
+	sync.Mutex
+	ids  []nsq.MessageID
+	next int
+	set  map[nsq.MessageID]bool
+}
+
+func newIDWindow(size int) *idWindow {
+	return &idWindow{
+		ids: make([]nsq.MessageID, 0, size),
+		set: make(map[nsq.MessageID]bool, size),
+	}
+}
+
+// Add records the IDs of msgs, unless any of them is already in the window
+// (or repeated in msgs) in which case none are recorded and it returns false
+func (w *idWindow) Add(msgs []*nsq.Message) bool {
+	size := cap(w.ids)
+	if size == 0 {
+		return true
+	}
+
+	w.Lock()
+	defer w.Unlock()
+
+	for i, msg := range msgs {
+		if w.set[msg.Id] {
+			for _, added := range msgs[:i] {
+				delete(w.set, added.Id)
+			}
+			return false
+		}
+		w.set[msg.Id] = true
+	}
+
+	for _, msg := range msgs {
+		if len(w.ids) < size {
+			w.ids = append(w.ids, msg.Id)
+		} else {
+			delete(w.set, w.ids[w.next])
+			w.ids[w.next] = msg.Id
+		}
+		w.next = (w.next + 1) % size
+	}
+
+	return true
+}
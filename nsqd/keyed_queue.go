@@ -0,0 +1,121 @@
+package main
+
+import (
+	"github.com/bitly/nsq/nsq"
+	"github.com/bitly/nsq/util"
+	"sync"
+)
+
+// the number of messages with a partition key buffered in a client's msgChan,
+// the rest wait (in order) in its keyedQueue
+const keyedMsgChanSize = 32
+
+// keyedQueue holds the messages with a partition key owned by a client in the
+// order they were sent and feeds them to the client's msgChan, so that a slow
+// client neither holds up the channel's other clients nor reorders its keys
+type keyedQueue struct {
+	sync.Mutex
+	msgs       []*nsq.Message
+	msgChan    chan *nsq.Message
+	notifyChan chan int
+	exitChan   chan int
+	waitGroup  util.WaitGroupWrapper
+}
+
+func newKeyedQueue() *keyedQueue {
+	q := &keyedQueue{
+		msgChan:    make(chan *nsq.Message, keyedMsgChanSize),
+		notifyChan: make(chan int, 1),
+		exitChan:   make(chan int),
+	}
+	q.waitGroup.Wrap(func() { q.pump() })
+	return q
+}
+
+// Put appends msg to the queue (it doesn't block)
+func (q *keyedQueue) Put(msg *nsq.Message) {
+	q.Lock()
+	q.msgs = append(q.msgs, msg)
+	q.Unlock()
+
+	select {
+	case q.notifyChan <- 1:
+	default:
+	}
+}
+
+// Len returns the number of messages the client has yet to receive
+func (q *keyedQueue) Len() int {
+	q.Lock()
+	defer q.Unlock()
+
+	return len(q.msgChan) + len(q.msgs)
+}
+
+// Empty discards the messages the client has yet to receive
+func (q *keyedQueue) Empty() {
+	q.Lock()
+	defer q.Unlock()
+
+	q.msgs = nil
+	q.drainMsgChan()
+}
+
+// Close stops feeding the client and returns (in order) the messages it
+// has yet to receive
+func (q *keyedQueue) Close() []*nsq.Message {
+	close(q.exitChan)
+	q.waitGroup.Wait()
+
+	q.Lock()
+	defer q.Unlock()
+
+	msgs := append(q.drainMsgChan(), q.msgs...)
+	q.msgs = nil
+	return msgs
+}
+
+// drainMsgChan returns the messages buffered in msgChan, the lock must be held
+func (q *keyedQueue) drainMsgChan() []*nsq.Message {
+	var msgs []*nsq.Message
+	for {
+		select {
+		case msg := <-q.msgChan:
+			msgs = append(msgs, msg)
+		default:
+			return msgs
+		}
+	}
+}
+
+// pump moves the oldest message to msgChan whenever the client has room for it
+func (q *keyedQueue) pump() {
+	for {
+		q.Lock()
+		if len(q.msgs) == 0 {
+			q.Unlock()
+			select {
+			case <-q.notifyChan:
+				continue
+			case <-q.exitChan:
+				return
+			}
+		}
+		msg := q.msgs[0]
+		q.Unlock()
+
+		select {
+		case q.msgChan <- msg:
+		case <-q.exitChan:
+			return
+		}
+
+		q.Lock()
+		// (unless it was discarded by Empty in the meantime)
+		if len(q.msgs) > 0 && q.msgs[0] == msg {
+			q.msgs[0] = nil
+			q.msgs = q.msgs[1:]
+		}
+		q.Unlock()
+	}
+}
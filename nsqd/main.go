@@ -9,6 +9,7 @@ import (
 	"hash/crc32"
 	"io"
 	"log"
+	"math"
 	"net"
 	"os"
 	"os/signal"
@@ -26,21 +27,43 @@ var (
 	memQueueSize     = flag.Int64("mem-queue-size", 10000, "number of messages to keep in memory (per topic/channel)")
 	maxBytesPerFile  = flag.Int64("max-bytes-per-file", 104857600, "number of bytes per diskqueue file before rolling")
 	syncEvery        = flag.Int64("sync-every", 2500, "number of messages between diskqueue syncs")
+	syncTimeout      = flag.Duration("sync-timeout", 2*time.Second, "duration of time between diskqueue syncs (if there were writes)")
 	msgTimeout       = flag.String("msg-timeout", "60s", "duration to wait before auto-requeing a message")
 	maxMessageSize   = flag.Int64("max-message-size", 1024768, "maximum size of a single message in bytes")
 	maxBodySize      = flag.Int64("max-body-size", 5*1024768, "maximum size of a single command body")
 	maxMsgTimeout    = flag.Duration("max-msg-timeout", 15*time.Minute, "maximum duration before a message will timeout")
+	maxAttempts      = flag.Int("max-attempts", 0, "default number of attempts before a message is moved to a channel's dead letter queue (0 is unlimited)")
+	maxRdyCount      = flag.Int64("max-rdy-count", nsq.MaxReadyCount, "maximum RDY count for a client")
 	dataPath         = flag.String("data-path", "", "path to store disk-backed messages")
 	workerId         = flag.Int64("worker-id", 0, "unique identifier (int) for this worker (will default to a hash of hostname)")
 	verbose          = flag.Bool("verbose", false, "enable verbose logging")
 	statsdAddress    = flag.String("statsd-address", "", "UDP <addr>:<port> of a statsd daemon for writing stats")
 	statsdInterval   = flag.Int("statsd-interval", 30, "seconds between pushing to statsd")
 	broadcastAddress = flag.String("broadcast-address", "", "address that will be registered with lookupd, (default to the OS hostname)")
+	httpsAddress     = flag.String("https-address", "", "<addr>:<port> to listen on for HTTPS clients (requires --tls-cert and --tls-key)")
+	tlsCert          = flag.String("tls-cert", "", "path to certificate file (enables TLS for clients that request it via IDENTIFY)")
+	tlsKey           = flag.String("tls-key", "", "path to private key file")
+	tlsRootCAFile    = flag.String("tls-root-ca-file", "", "path to certificate authority file (clients must present a certificate signed by it)")
+	deflateEnabled   = flag.Bool("deflate", true, "enable deflate feature negotiation (client compression)")
+	maxDeflateLevel  = flag.Int("max-deflate-level", 6, "max deflate compression level a client can negotiate (> values == > nsqd CPU usage)")
+	snappyEnabled    = flag.Bool("snappy", true, "enable snappy feature negotiation (client compression)")
 	lookupdTCPAddrs  = util.StringArray{}
+	authHTTPAddrs    = util.StringArray{}
+
+	maxOutputBufferSize    = flag.Int64("max-output-buffer-size", 64*1024, "maximum client configurable size (in bytes) for a client output buffer")
+	maxOutputBufferTimeout = flag.Duration("max-output-buffer-timeout", 1*time.Second, "maximum client configurable duration of time between flushing to a client")
+
+	drainTimeout = flag.Duration("drain-timeout", 30*time.Second, "duration to wait on exit for clients (sent CLOSE_WAIT) to FIN/REQ their in-flight messages")
+
+	dedupWindow  = flag.Duration("dedup-window", 10*time.Minute, "duration a producer supplied dedup key is remembered (per topic, 0 disables dedup)")
+	maxDedupKeys = flag.Int("max-dedup-keys", 10000, "maximum number of dedup keys remembered (per topic)")
+
+	maxRecentIDs = flag.Int("max-recent-ids", 10000, "number of message IDs remembered (per topic) that a producer supplied ID must be unique among")
 )
 
 func init() {
 	flag.Var(&lookupdTCPAddrs, "lookupd-tcp-address", "lookupd TCP address (may be given multiple times)")
+	flag.Var(&authHTTPAddrs, "auth-http-address", "<addr>:<port> of an HTTP auth service (enables AUTH, may be given multiple times)")
 }
 
 var nsqd *NSQd
@@ -75,6 +98,29 @@ func main() {
 		log.Fatal(err)
 	}
 
+	var httpsAddr *net.TCPAddr
+	if *httpsAddress != "" {
+		if *tlsCert == "" || *tlsKey == "" {
+			log.Fatalf("--https-address requires --tls-cert and --tls-key")
+		}
+		httpsAddr, err = net.ResolveTCPAddr("tcp", *httpsAddress)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if *maxAttempts < 0 || *maxAttempts > math.MaxUint16 {
+		log.Fatalf("ERROR: --max-attempts %d out of range 0-%d", *maxAttempts, math.MaxUint16)
+	}
+
+	if *syncTimeout <= 0 {
+		log.Fatalf("ERROR: --sync-timeout %s must be greater than 0", *syncTimeout)
+	}
+
+	if *maxRecentIDs <= 0 {
+		log.Fatalf("ERROR: --max-recent-ids %d must be greater than 0", *maxRecentIDs)
+	}
+
 	if *broadcastAddress == "" {
 		*broadcastAddress = hostname
 	}
@@ -119,13 +165,30 @@ func main() {
 	options.dataPath = *dataPath
 	options.maxBytesPerFile = *maxBytesPerFile
 	options.syncEvery = *syncEvery
+	options.syncTimeout = *syncTimeout
 	options.msgTimeout = msgTimeoutDuration
 	options.maxMsgTimeout = *maxMsgTimeout
+	options.maxAttempts = uint16(*maxAttempts)
+	options.maxRdyCount = *maxRdyCount
+	options.maxOutputBufferSize = *maxOutputBufferSize
+	options.maxOutputBufferTimeout = *maxOutputBufferTimeout
+	options.drainTimeout = *drainTimeout
+	options.dedupWindow = *dedupWindow
+	options.maxDedupKeys = *maxDedupKeys
+	options.maxRecentIDs = *maxRecentIDs
 	options.broadcastAddress = *broadcastAddress
+	options.tlsCert = *tlsCert
+	options.tlsKey = *tlsKey
+	options.tlsRootCAFile = *tlsRootCAFile
+	options.deflateEnabled = *deflateEnabled
+	options.maxDeflateLevel = *maxDeflateLevel
+	options.snappyEnabled = *snappyEnabled
+	options.authHTTPAddresses = authHTTPAddrs
 
 	nsqd = NewNSQd(*workerId, options)
 	nsqd.tcpAddr = tcpAddr
 	nsqd.httpAddr = httpAddr
+	nsqd.httpsAddr = httpsAddr
 	nsqd.lookupdTCPAddrs = lookupdTCPAddrs
 
 	nsqd.LoadMetadata()
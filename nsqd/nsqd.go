@@ -1,6 +1,8 @@
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -14,6 +16,7 @@ import (
 	"path"
 	"runtime"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -29,13 +32,18 @@ type NSQd struct {
 	lookupdTCPAddrs util.StringArray
 	tcpAddr         *net.TCPAddr
 	httpAddr        *net.TCPAddr
+	httpsAddr       *net.TCPAddr
 	tcpListener     net.Listener
 	httpListener    net.Listener
+	httpsListener   net.Listener
+	tlsConfig       *tls.Config
+	authCache       *authCache
 	idChan          chan nsq.MessageID
 	exitChan        chan int
 	waitGroup       util.WaitGroupWrapper
 	lookupPeers     []*nsq.LookupPeer
 	notifyChan      chan interface{}
+	exitFlag        int32
 }
 
 type nsqdOptions struct {
@@ -45,10 +53,40 @@ type nsqdOptions struct {
 	maxBodySize      int64
 	maxBytesPerFile  int64
 	syncEvery        int64
+	syncTimeout      time.Duration
 	msgTimeout       time.Duration
 	maxMsgTimeout    time.Duration
+	maxAttempts      uint16
+	maxRdyCount      int64
 	clientTimeout    time.Duration
 	broadcastAddress string
+
+	// TLS (negotiated via IDENTIFY and for HTTPS)
+	tlsCert       string
+	tlsKey        string
+	tlsRootCAFile string
+
+	// compression (negotiated via IDENTIFY)
+	deflateEnabled  bool
+	maxDeflateLevel int
+	snappyEnabled   bool
+
+	// auth services queried for the permissions of a client's AUTH secret
+	authHTTPAddresses []string
+
+	// bounds for client configurable output buffering (via IDENTIFY)
+	maxOutputBufferSize    int64
+	maxOutputBufferTimeout time.Duration
+
+	// duration to wait on exit for clients (sent CLOSE_WAIT) to FIN/REQ their in-flight messages
+	drainTimeout time.Duration
+
+	// the duration (and maximum number) of producer supplied dedup keys remembered per topic
+	dedupWindow  time.Duration
+	maxDedupKeys int
+
+	// the number of recent message IDs remembered per topic (producer supplied IDs must be unique among them)
+	maxRecentIDs int
 }
 
 func NewNsqdOptions() *nsqdOptions {
@@ -59,10 +97,27 @@ func NewNsqdOptions() *nsqdOptions {
 		maxBodySize:      5 * 1024768,
 		maxBytesPerFile:  104857600,
 		syncEvery:        2500,
+		syncTimeout:      2 * time.Second,
 		msgTimeout:       60 * time.Second,
 		maxMsgTimeout:    15 * time.Minute,
+		maxAttempts:      0,
+		maxRdyCount:      nsq.MaxReadyCount,
 		clientTimeout:    nsq.DefaultClientTimeout,
 		broadcastAddress: "",
+
+		deflateEnabled:  true,
+		maxDeflateLevel: 6,
+		snappyEnabled:   true,
+
+		maxOutputBufferSize:    64 * 1024,
+		maxOutputBufferTimeout: 1 * time.Second,
+
+		drainTimeout: 30 * time.Second,
+
+		dedupWindow:  10 * time.Minute,
+		maxDedupKeys: 10000,
+
+		maxRecentIDs: 10000,
 	}
 }
 
@@ -76,11 +131,51 @@ func NewNSQd(workerId int64, options *nsqdOptions) *NSQd {
 		notifyChan: make(chan interface{}),
 	}
 
+	if options.tlsCert != "" || options.tlsKey != "" {
+		tlsConfig, err := buildTLSConfig(options)
+		if err != nil {
+			log.Fatalf("FATAL: failed to build TLS config - %s", err.Error())
+		}
+		n.tlsConfig = tlsConfig
+	}
+
+	if len(options.authHTTPAddresses) > 0 {
+		n.authCache = newAuthCache(options.authHTTPAddresses)
+	}
+
 	n.waitGroup.Wrap(func() { n.idPump() })
 
 	return n
 }
 
+func buildTLSConfig(options *nsqdOptions) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(options.tlsCert, options.tlsKey)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.VerifyClientCertIfGiven,
+	}
+
+	// when a root CA is specified clients must present a certificate signed by it
+	if options.tlsRootCAFile != "" {
+		caCertFile, err := ioutil.ReadFile(options.tlsRootCAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsCertPool := x509.NewCertPool()
+		if !tlsCertPool.AppendCertsFromPEM(caCertFile) {
+			return nil, errors.New("failed to append certificates from root CA file")
+		}
+		tlsConfig.ClientCAs = tlsCertPool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return tlsConfig, nil
+}
+
 func (n *NSQd) Main() {
 	n.waitGroup.Wrap(func() { n.lookupLoop() })
 
@@ -97,6 +192,15 @@ func (n *NSQd) Main() {
 	}
 	n.httpListener = httpListener
 	n.waitGroup.Wrap(func() { httpServer(n.httpListener) })
+
+	if n.tlsConfig != nil && n.httpsAddr != nil {
+		httpsListener, err := tls.Listen("tcp", n.httpsAddr.String(), n.tlsConfig)
+		if err != nil {
+			log.Fatalf("FATAL: listen (%s) failed - %s", n.httpsAddr, err.Error())
+		}
+		n.httpsListener = httpsListener
+		n.waitGroup.Wrap(func() { httpServer(n.httpsListener) })
+	}
 }
 
 func (n *NSQd) LoadMetadata() {
@@ -135,6 +239,11 @@ func (n *NSQd) LoadMetadata() {
 		}
 		topic := n.GetTopic(topicName)
 
+		syncEveryWrite, _ := topicJs.Get("sync_every_write").Bool()
+		if syncEveryWrite {
+			topic.SetSyncEveryWrite(true)
+		}
+
 		channels, err := topicJs.Get("channels").Array()
 		if err != nil {
 			log.Printf("ERROR: failed to parse metadata - %s", err.Error())
@@ -159,6 +268,16 @@ func (n *NSQd) LoadMetadata() {
 			if paused {
 				channel.Pause()
 			}
+
+			maxAttempts, err := channelJs.Get("max_attempts").Int()
+			if err == nil {
+				channel.SetMaxAttempts(uint16(maxAttempts))
+			}
+
+			ordered, _ := channelJs.Get("ordered").Bool()
+			if ordered {
+				channel.SetOrdered(true)
+			}
 		}
 	}
 }
@@ -174,6 +293,7 @@ func (n *NSQd) PersistMetadata() {
 	for _, topic := range n.topicMap {
 		topicData := make(map[string]interface{})
 		topicData["name"] = topic.name
+		topicData["sync_every_write"] = topic.SyncEveryWrite()
 		channels := make([]interface{}, 0)
 		topic.Lock()
 		for _, channel := range topic.channelMap {
@@ -182,6 +302,8 @@ func (n *NSQd) PersistMetadata() {
 				channelData := make(map[string]interface{})
 				channelData["name"] = channel.name
 				channelData["paused"] = channel.IsPaused()
+				channelData["max_attempts"] = channel.MaxAttempts()
+				channelData["ordered"] = channel.IsOrdered()
 				channels = append(channels, channelData)
 			}
 			channel.Unlock()
@@ -222,6 +344,9 @@ func (n *NSQd) PersistMetadata() {
 }
 
 func (n *NSQd) Exit() {
+	// stop accepting publishes and subscriptions
+	atomic.StoreInt32(&n.exitFlag, 1)
+
 	if n.tcpListener != nil {
 		n.tcpListener.Close()
 	}
@@ -230,6 +355,12 @@ func (n *NSQd) Exit() {
 		n.httpListener.Close()
 	}
 
+	if n.httpsListener != nil {
+		n.httpsListener.Close()
+	}
+
+	n.drain()
+
 	n.Lock()
 	n.PersistMetadata()
 	log.Printf("NSQ: closing topics")
@@ -244,6 +375,55 @@ func (n *NSQd) Exit() {
 	n.waitGroup.Wait()
 }
 
+// drain sends each subscribed client CLOSE_WAIT (as if it had sent CLS) and waits,
+// up to --drain-timeout, for them to FIN/REQ their in-flight messages
+//
+// anything still in-flight afterwards is persisted when the channels close
+func (n *NSQd) drain() {
+	var channels []*Channel
+
+	n.RLock()
+	for _, topic := range n.topicMap {
+		topic.RLock()
+		for _, channel := range topic.channelMap {
+			channels = append(channels, channel)
+		}
+		topic.RUnlock()
+	}
+	n.RUnlock()
+
+	for _, channel := range channels {
+		channel.Drain()
+	}
+
+	deadline := time.Now().Add(n.options.drainTimeout)
+	for {
+		inFlightCount := 0
+		for _, channel := range channels {
+			inFlightCount += channel.InFlightCount()
+		}
+		if inFlightCount == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			log.Printf("NSQ: drain timed out with %d messages in-flight", inFlightCount)
+			return
+		}
+		time.Sleep(defaultWorkerWait)
+	}
+}
+
+// IsAuthEnabled returns whether clients must AUTH (ie. auth services are configured)
+func (n *NSQd) IsAuthEnabled() bool {
+	return n.authCache != nil
+}
+
+// IsExiting returns whether nsqd is shutting down (ie. no longer accepting
+// publishes or subscriptions)
+func (n *NSQd) IsExiting() bool {
+	return atomic.LoadInt32(&n.exitFlag) == 1
+}
+
 // GetTopic performs a thread safe operation
 // to return a pointer to a Topic object (potentially new)
 func (n *NSQd) GetTopic(topicName string) *Topic {
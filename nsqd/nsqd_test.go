@@ -18,7 +18,7 @@ func TestStartup(t *testing.T) {
 	iterations := 300
 	doneExitChan := make(chan int)
 
-	options := NewNsqdOptions()
+	options := testNsqdOptions()
 	options.memQueueSize = 100
 	options.maxBytesPerFile = 10240
 	mustStartNSQd(options)
@@ -61,7 +61,7 @@ func TestStartup(t *testing.T) {
 
 	// start up a new nsqd w/ the same folder
 
-	options = NewNsqdOptions()
+	options = testNsqdOptions()
 	options.memQueueSize = 100
 	options.maxBytesPerFile = 10240
 	mustStartNSQd(options)
@@ -103,7 +103,7 @@ func TestEphemeralChannel(t *testing.T) {
 	log.SetOutput(ioutil.Discard)
 	defer log.SetOutput(os.Stdout)
 
-	options := NewNsqdOptions()
+	options := testNsqdOptions()
 	options.memQueueSize = 100
 	mustStartNSQd(options)
 
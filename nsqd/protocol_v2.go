@@ -9,6 +9,7 @@ import (
 	"github.com/bitly/nsq/util"
 	"io"
 	"log"
+	"math/rand"
 	"net"
 	"sync/atomic"
 	"time"
@@ -16,6 +17,10 @@ import (
 
 const maxTimeout = time.Hour
 
+// maxBatchSize is the maximum number of message IDs in a single FIN, REQ, or
+// TOUCH (so that the command fits in a client's read buffer)
+const maxBatchSize = 500
+
 type ProtocolV2 struct {
 	nsq.Protocol
 }
@@ -65,8 +70,9 @@ func (p *ProtocolV2) IOLoop(conn net.Conn) error {
 			}
 			log.Printf("ERROR: [%s] - %s%s", client, err.Error(), context)
 
-			err = p.Send(client, nsq.FrameTypeError, []byte(err.Error()))
-			if err != nil {
+			sendErr := p.Send(client, nsq.FrameTypeError, []byte(err.Error()))
+			if sendErr != nil {
+				err = sendErr
 				break
 			}
 
@@ -86,7 +92,6 @@ func (p *ProtocolV2) IOLoop(conn net.Conn) error {
 	}
 
 	log.Printf("PROTOCOL(V2): [%s] exiting ioloop", client)
-	// TODO: gracefully send clients the close signal
 	conn.Close()
 	close(client.ExitChan)
 
@@ -100,7 +105,7 @@ func (p *ProtocolV2) SendMessage(client *ClientV2, msg *nsq.Message, buf *bytes.
 	}
 
 	buf.Reset()
-	err := msg.Write(buf)
+	err := msg.WriteVersion(buf, client.MessageVersion)
 	if err != nil {
 		return err
 	}
@@ -116,10 +121,79 @@ func (p *ProtocolV2) SendMessage(client *ClientV2, msg *nsq.Message, buf *bytes.
 	return nil
 }
 
+// SendMessageBatch sends msg, along with any further messages immediately available
+// from msgChan (up to batchSize and the client's RDY count), in a single frame
+func (p *ProtocolV2) SendMessageBatch(client *ClientV2, msg *nsq.Message, msgChan chan *nsq.Message,
+	batchSize int32, sampleRate int32, buf *bytes.Buffer) error {
+	msgs := []*nsq.Message{msg}
+	client.Channel.StartInFlightTimeout(msg, client)
+	client.SendingMessage()
+
+gather:
+	for int32(len(msgs)) < batchSize && client.IsReadyForMessages() {
+		select {
+		case next, ok := <-msgChan:
+			if !ok {
+				// the channel is exiting (messagePump notices on its next receive)
+				break gather
+			}
+			if !isSampled(client, next, sampleRate) {
+				continue
+			}
+			client.Channel.StartInFlightTimeout(next, client)
+			client.SendingMessage()
+			msgs = append(msgs, next)
+		default:
+			break gather
+		}
+	}
+
+	if *verbose {
+		for _, msg := range msgs {
+			log.Printf("PROTOCOL(V2): writing msg(%s) to client(%s) - %s",
+				msg.Id, client, msg.Body)
+		}
+	}
+
+	buf.Reset()
+	if len(msgs) == 1 {
+		err := msg.WriteVersion(buf, client.MessageVersion)
+		if err != nil {
+			return err
+		}
+		return p.Send(client, nsq.FrameTypeMessage, buf.Bytes())
+	}
+
+	err := binary.Write(buf, binary.BigEndian, int32(len(msgs)))
+	if err != nil {
+		return err
+	}
+	for _, msg := range msgs {
+		// each message is prefixed by its size (filled in once it's written)
+		offset := buf.Len()
+		err = binary.Write(buf, binary.BigEndian, int32(0))
+		if err != nil {
+			return err
+		}
+		err = msg.WriteVersion(buf, client.MessageVersion)
+		if err != nil {
+			return err
+		}
+		binary.BigEndian.PutUint32(buf.Bytes()[offset:], uint32(buf.Len()-offset-4))
+	}
+
+	return p.Send(client, nsq.FrameTypeMessageBatch, buf.Bytes())
+}
+
 func (p *ProtocolV2) Send(client *ClientV2, frameType int32, data []byte) error {
 	client.Lock()
 	defer client.Unlock()
 
+	return p.send(client, frameType, data)
+}
+
+// send expects the caller to hold the client's lock
+func (p *ProtocolV2) send(client *ClientV2, frameType int32, data []byte) error {
 	client.SetWriteDeadline(time.Now().Add(time.Second))
 	_, err := nsq.SendFramedResponse(client.Writer, frameType, data)
 	if err != nil {
@@ -127,7 +201,7 @@ func (p *ProtocolV2) Send(client *ClientV2, frameType int32, data []byte) error
 	}
 
 	if frameType != nsq.FrameTypeMessage {
-		err = client.Writer.Flush()
+		err = client.Flush()
 	}
 
 	return err
@@ -137,9 +211,9 @@ func (p *ProtocolV2) Flush(client *ClientV2) error {
 	client.Lock()
 	defer client.Unlock()
 
-	if client.Writer.Buffered() > 0 {
+	if client.NeedsFlush() {
 		client.SetWriteDeadline(time.Now().Add(time.Second))
-		return client.Writer.Flush()
+		return client.Flush()
 	}
 
 	return nil
@@ -165,8 +239,12 @@ func (p *ProtocolV2) Exec(client *ClientV2, params [][]byte) ([]byte, error) {
 		return p.PUB(client, params)
 	case bytes.Equal(params[0], []byte("MPUB")):
 		return p.MPUB(client, params)
+	case bytes.Equal(params[0], []byte("DPUB")):
+		return p.DPUB(client, params)
 	case bytes.Equal(params[0], []byte("TOUCH")):
 		return p.TOUCH(client, params)
+	case bytes.Equal(params[0], []byte("AUTH")):
+		return p.AUTH(client, params)
 	}
 	return nil, nsq.NewFatalClientErr(nil, "E_INVALID", fmt.Sprintf("invalid command %s", params[0]))
 }
@@ -175,8 +253,12 @@ func (p *ProtocolV2) messagePump(client *ClientV2) {
 	var err error
 	var buf bytes.Buffer
 	var clientMsgChan chan *nsq.Message
+	var keyedMsgChan chan *nsq.Message
+	var subKeyedMsgChan chan *nsq.Message
 	var subChannel *Channel
 	var flusherChan <-chan time.Time
+	var outputBufferTickerChan <-chan time.Time
+	var heartbeatChan <-chan time.Time
 
 	// v2 opportunistically buffers data to clients to reduce write system calls
 	// we force flush in two cases:
@@ -184,19 +266,39 @@ func (p *ProtocolV2) messagePump(client *ClientV2) {
 	//    2. we're buffered and the channel has nothing left to send us
 	//       (ie. we would block in this loop anyway)
 	//
-	// NOTE: `flusher` is used to bound message latency for
+	// NOTE: `outputBufferTicker` is used to bound message latency for
 	// the pathological case of a channel on a low volume topic
 	// with >1 clients having >1 RDY counts
-	flusher := time.NewTicker(5 * time.Millisecond)
+	//
+	// the client may configure (or disable) it via IDENTIFY
+	var outputBufferTicker *time.Ticker
+	client.Lock()
+	outputBufferTimeout := client.OutputBufferTimeout
+	client.Unlock()
+	if outputBufferTimeout > 0 {
+		outputBufferTicker = time.NewTicker(outputBufferTimeout)
+		outputBufferTickerChan = outputBufferTicker.C
+	}
 	flushed := true
 	subEventChan := client.SubEventChan
-	heartbeat := time.NewTicker(client.HeartbeatInterval)
 	heartbeatUpdateChan := client.HeartbeatUpdateChan
+	outputBufferTimeoutUpdateChan := client.OutputBufferTimeoutUpdateChan
+	drainChan := client.DrainChan
+	var sampleRate int32
+	var messageBatchSize int32
+
+	// IDENTIFY may have already disabled heartbeats by the time we get here
+	var heartbeat *time.Ticker
+	if client.HeartbeatInterval > 0 {
+		heartbeat = time.NewTicker(client.HeartbeatInterval)
+		heartbeatChan = heartbeat.C
+	}
 
 	for {
 		if subChannel == nil || !client.IsReadyForMessages() {
 			// the client is not ready to receive messages...
 			clientMsgChan = nil
+			keyedMsgChan = nil
 			flusherChan = nil
 			// force flush
 			err = p.Flush(client)
@@ -208,12 +310,14 @@ func (p *ProtocolV2) messagePump(client *ClientV2) {
 			// last iteration we flushed...
 			// do not select on the flusher ticker channel
 			clientMsgChan = subChannel.clientMsgChan
+			keyedMsgChan = subKeyedMsgChan
 			flusherChan = nil
 		} else {
 			// we're buffered (if there isn't any more data we should flush)...
 			// select on the flusher ticker channel, too
 			clientMsgChan = subChannel.clientMsgChan
-			flusherChan = flusher.C
+			keyedMsgChan = subKeyedMsgChan
+			flusherChan = outputBufferTickerChan
 		}
 
 		select {
@@ -229,16 +333,46 @@ func (p *ProtocolV2) messagePump(client *ClientV2) {
 		case subChannel = <-subEventChan:
 			// you can't subscribe anymore
 			subEventChan = nil
+			subKeyedMsgChan = subChannel.KeyedMsgChan(client)
+			// IDENTIFY (which sets the sample rate and batch size) can only precede SUB
+			sampleRate = atomic.LoadInt32(&client.SampleRate)
+			messageBatchSize = atomic.LoadInt32(&client.MessageBatchSize)
 		case <-client.ReadyStateChan:
 		case interval := <-heartbeatUpdateChan:
-			heartbeat.Stop()
+			if heartbeat != nil {
+				heartbeat.Stop()
+			}
+			heartbeatChan = nil
 			if interval > 0 {
 				heartbeat = time.NewTicker(interval)
+				heartbeatChan = heartbeat.C
 			}
 
 			// you can't update heartbeat anymore
 			heartbeatUpdateChan = nil
-		case <-heartbeat.C:
+		case timeout := <-outputBufferTimeoutUpdateChan:
+			if outputBufferTicker != nil {
+				outputBufferTicker.Stop()
+			}
+			outputBufferTickerChan = nil
+			if timeout > 0 {
+				outputBufferTicker = time.NewTicker(timeout)
+				outputBufferTickerChan = outputBufferTicker.C
+			}
+
+			// you can't update output buffer timeout anymore
+			outputBufferTimeoutUpdateChan = nil
+		case <-drainChan:
+			// nsqd is exiting, ask the client to close (as if it had sent CLS)
+			if atomic.LoadInt32(&client.State) != nsq.StateSubscribed {
+				continue
+			}
+			client.StartClose(nsqd.options.drainTimeout)
+			err = p.Send(client, nsq.FrameTypeResponse, []byte("CLOSE_WAIT"))
+			if err != nil {
+				goto exit
+			}
+		case <-heartbeatChan:
 			err = p.Send(client, nsq.FrameTypeResponse, []byte("_heartbeat_"))
 			if err != nil {
 				log.Printf("PROTOCOL(V2): error sending heartbeat - %s", err.Error())
@@ -247,8 +381,14 @@ func (p *ProtocolV2) messagePump(client *ClientV2) {
 			if !ok {
 				goto exit
 			}
-
-			err = p.SendMessage(client, msg, &buf)
+			err = p.sendSampled(client, msg, clientMsgChan, messageBatchSize, sampleRate, &buf)
+			if err != nil {
+				goto exit
+			}
+			flushed = false
+		case msg := <-keyedMsgChan:
+			// a message whose partition key this client owns
+			err = p.sendSampled(client, msg, keyedMsgChan, messageBatchSize, sampleRate, &buf)
 			if err != nil {
 				goto exit
 			}
@@ -260,8 +400,12 @@ func (p *ProtocolV2) messagePump(client *ClientV2) {
 
 exit:
 	log.Printf("PROTOCOL(V2): [%s] exiting messagePump", client)
-	heartbeat.Stop()
-	flusher.Stop()
+	if heartbeat != nil {
+		heartbeat.Stop()
+	}
+	if outputBufferTicker != nil {
+		outputBufferTicker.Stop()
+	}
 	if subChannel != nil {
 		subChannel.RemoveClient(client)
 	}
@@ -270,6 +414,29 @@ exit:
 	}
 }
 
+// sendSampled sends msg (batched with further messages from msgChan when
+// the client asked for batches) unless the client's sample rate discards it
+func (p *ProtocolV2) sendSampled(client *ClientV2, msg *nsq.Message, msgChan chan *nsq.Message,
+	batchSize int32, sampleRate int32, buf *bytes.Buffer) error {
+	if !isSampled(client, msg, sampleRate) {
+		return nil
+	}
+	if batchSize > 1 {
+		return p.SendMessageBatch(client, msg, msgChan, batchSize, sampleRate, buf)
+	}
+	return p.SendMessage(client, msg, buf)
+}
+
+// isSampled returns whether a message is delivered to a client with the sample
+// rate, messages that aren't are discarded (ie. implicitly finished)
+func isSampled(client *ClientV2, msg *nsq.Message, sampleRate int32) bool {
+	if sampleRate <= 0 || rand.Int31n(100) < sampleRate {
+		return true
+	}
+	client.Channel.orderedDone(msg.Id)
+	return false
+}
+
 func (p *ProtocolV2) IDENTIFY(client *ClientV2, params [][]byte) ([]byte, error) {
 	var err error
 
@@ -277,6 +444,10 @@ func (p *ProtocolV2) IDENTIFY(client *ClientV2, params [][]byte) ([]byte, error)
 		return nil, nsq.NewFatalClientErr(nil, "E_INVALID", "cannot IDENTIFY in current state")
 	}
 
+	if !atomic.CompareAndSwapInt32(&client.Identified, 0, 1) {
+		return nil, nsq.NewFatalClientErr(nil, "E_INVALID", "cannot IDENTIFY again")
+	}
+
 	var bodyLen int32
 	err = binary.Read(client.Reader, binary.BigEndian, &bodyLen)
 	if err != nil {
@@ -296,9 +467,21 @@ func (p *ProtocolV2) IDENTIFY(client *ClientV2, params [][]byte) ([]byte, error)
 
 	// body is a json structure with producer information
 	clientInfo := struct {
-		ShortId           string `json:"short_id"`
-		LongId            string `json:"long_id"`
-		HeartbeatInterval int    `json:"heartbeat_interval"`
+		ShortId             string `json:"short_id"`
+		LongId              string `json:"long_id"`
+		HeartbeatInterval   int    `json:"heartbeat_interval"`
+		OutputBufferSize    int    `json:"output_buffer_size"`
+		OutputBufferTimeout int    `json:"output_buffer_timeout"`
+		MsgTimeout          int    `json:"msg_timeout"`
+		SampleRate          int32  `json:"sample_rate"`
+		MessageBatchSize    int32  `json:"message_batch_size"`
+		MessageVersion      int    `json:"message_version"`
+		ReturnMessageIDs    bool   `json:"return_message_ids"`
+		FeatureNegotiation  bool   `json:"feature_negotiation"`
+		TLSv1               bool   `json:"tls_v1"`
+		Deflate             bool   `json:"deflate"`
+		DeflateLevel        int    `json:"deflate_level"`
+		Snappy              bool   `json:"snappy"`
 	}{}
 	err = json.Unmarshal(body, &clientInfo)
 	if err != nil {
@@ -328,7 +511,216 @@ func (p *ProtocolV2) IDENTIFY(client *ClientV2, params [][]byte) ([]byte, error)
 		client.HeartbeatInterval = interval
 	}
 
-	return []byte("OK"), nil
+	var outputBufferSize int
+	switch {
+	case clientInfo.OutputBufferSize == -1:
+		// effectively no buffer (every write goes directly to the connection)
+		outputBufferSize = 1
+	case clientInfo.OutputBufferSize == 0:
+	case clientInfo.OutputBufferSize >= 64 && int64(clientInfo.OutputBufferSize) <= nsqd.options.maxOutputBufferSize:
+		outputBufferSize = clientInfo.OutputBufferSize
+	default:
+		return nil, nsq.NewFatalClientErr(nil, "E_INVALID",
+			fmt.Sprintf("IDENTIFY Invalid output_buffer_size (%d) must be -1 or 64-%d",
+				clientInfo.OutputBufferSize, nsqd.options.maxOutputBufferSize))
+	}
+
+	var outputBufferTimeout time.Duration
+	switch {
+	case clientInfo.OutputBufferTimeout == -1:
+	case clientInfo.OutputBufferTimeout == 0:
+	case clientInfo.OutputBufferTimeout >= 1 &&
+		time.Duration(clientInfo.OutputBufferTimeout)*time.Millisecond <= nsqd.options.maxOutputBufferTimeout:
+		outputBufferTimeout = time.Duration(clientInfo.OutputBufferTimeout) * time.Millisecond
+	default:
+		return nil, nsq.NewFatalClientErr(nil, "E_INVALID",
+			fmt.Sprintf("IDENTIFY Invalid output_buffer_timeout (%d) must be -1 or 1-%d",
+				clientInfo.OutputBufferTimeout, int64(nsqd.options.maxOutputBufferTimeout/time.Millisecond)))
+	}
+
+	// leave the default output buffering in place
+	if outputBufferSize != 0 {
+		err = client.SetOutputBufferSize(outputBufferSize)
+		if err != nil {
+			return nil, nsq.NewFatalClientErr(err, "E_IDENTIFY_FAILED", "IDENTIFY failed "+err.Error())
+		}
+	}
+	if clientInfo.OutputBufferTimeout != 0 {
+		client.SetOutputBufferTimeout(outputBufferTimeout)
+	}
+
+	var msgTimeout time.Duration
+	switch {
+	case clientInfo.MsgTimeout == 0:
+	case clientInfo.MsgTimeout >= 1000 &&
+		time.Duration(clientInfo.MsgTimeout)*time.Millisecond <= nsqd.options.maxMsgTimeout:
+		msgTimeout = time.Duration(clientInfo.MsgTimeout) * time.Millisecond
+	default:
+		return nil, nsq.NewFatalClientErr(nil, "E_INVALID",
+			fmt.Sprintf("IDENTIFY Invalid msg_timeout (%d) must be 1000-%d",
+				clientInfo.MsgTimeout, int64(nsqd.options.maxMsgTimeout/time.Millisecond)))
+	}
+
+	// leave the default msg timeout in place
+	if msgTimeout != 0 {
+		client.MsgTimeout = msgTimeout
+	}
+
+	if clientInfo.SampleRate < 0 || clientInfo.SampleRate > 99 {
+		return nil, nsq.NewFatalClientErr(nil, "E_INVALID",
+			fmt.Sprintf("IDENTIFY Invalid sample_rate (%d) must be 0-99", clientInfo.SampleRate))
+	}
+	atomic.StoreInt32(&client.SampleRate, clientInfo.SampleRate)
+
+	if clientInfo.MessageBatchSize < 0 {
+		return nil, nsq.NewFatalClientErr(nil, "E_INVALID",
+			fmt.Sprintf("IDENTIFY Invalid message_batch_size (%d) must be >= 0", clientInfo.MessageBatchSize))
+	}
+	// a batch can't be larger than a client's RDY count anyway
+	messageBatchSize := clientInfo.MessageBatchSize
+	if int64(messageBatchSize) > nsqd.options.maxRdyCount {
+		messageBatchSize = int32(nsqd.options.maxRdyCount)
+	}
+	atomic.StoreInt32(&client.MessageBatchSize, messageBatchSize)
+
+	switch clientInfo.MessageVersion {
+	case 0:
+	case nsq.MessageVersion1, nsq.MessageVersion2:
+		client.MessageVersion = clientInfo.MessageVersion
+	default:
+		return nil, nsq.NewFatalClientErr(nil, "E_INVALID",
+			fmt.Sprintf("IDENTIFY Invalid message_version (%d) must be %d-%d",
+				clientInfo.MessageVersion, nsq.MessageVersion1, nsq.MessageVersion2))
+	}
+
+	client.ReturnMessageIDs = clientInfo.ReturnMessageIDs
+
+	if clientInfo.Deflate && clientInfo.Snappy {
+		return nil, nsq.NewFatalClientErr(nil, "E_INVALID", "IDENTIFY cannot enable both deflate and snappy compression")
+	}
+
+	if clientInfo.DeflateLevel < 0 || clientInfo.DeflateLevel > 9 {
+		return nil, nsq.NewFatalClientErr(nil, "E_INVALID", "IDENTIFY Invalid deflate_level")
+	}
+
+	if !clientInfo.FeatureNegotiation && !clientInfo.TLSv1 && !clientInfo.Deflate && !clientInfo.Snappy {
+		return []byte("OK"), nil
+	}
+
+	// clients that request feature negotiation (or TLS or compression) are told
+	// (in a JSON response) our limits and which features we agree to
+	tlsv1 := clientInfo.TLSv1 && nsqd.tlsConfig != nil
+	deflate := clientInfo.Deflate && nsqd.options.deflateEnabled
+	deflateLevel := 0
+	if deflate {
+		deflateLevel = clientInfo.DeflateLevel
+		if deflateLevel == 0 {
+			deflateLevel = 6
+		}
+		if deflateLevel > nsqd.options.maxDeflateLevel {
+			deflateLevel = nsqd.options.maxDeflateLevel
+		}
+	}
+	snappy := clientInfo.Snappy && nsqd.options.snappyEnabled
+
+	resp, err := json.Marshal(struct {
+		MaxRdyCount         int64  `json:"max_rdy_count"`
+		Version             string `json:"version"`
+		MaxMsgTimeout       int64  `json:"max_msg_timeout"`
+		MsgTimeout          int64  `json:"msg_timeout"`
+		MaxMessageSize      int64  `json:"max_message_size"`
+		MaxBodySize         int64  `json:"max_body_size"`
+		OutputBufferSize    int    `json:"output_buffer_size"`
+		OutputBufferTimeout int64  `json:"output_buffer_timeout"`
+		SampleRate          int32  `json:"sample_rate"`
+		MaxBatchSize        int    `json:"max_batch_size"`
+		MessageBatchSize    int32  `json:"message_batch_size"`
+		MessageVersion      int    `json:"message_version"`
+		ReturnMessageIDs    bool   `json:"return_message_ids"`
+		TLSv1               bool   `json:"tls_v1"`
+		Deflate             bool   `json:"deflate"`
+		DeflateLevel        int    `json:"deflate_level"`
+		MaxDeflateLevel     int    `json:"max_deflate_level"`
+		Snappy              bool   `json:"snappy"`
+		AuthRequired        bool   `json:"auth_required"`
+	}{
+		MaxRdyCount:         nsqd.options.maxRdyCount,
+		Version:             util.BINARY_VERSION,
+		MaxMsgTimeout:       int64(nsqd.options.maxMsgTimeout / time.Millisecond),
+		MsgTimeout:          int64(client.MsgTimeout / time.Millisecond),
+		MaxMessageSize:      nsqd.options.maxMessageSize,
+		MaxBodySize:         nsqd.options.maxBodySize,
+		OutputBufferSize:    client.OutputBufferSize,
+		OutputBufferTimeout: int64(client.OutputBufferTimeout / time.Millisecond),
+		SampleRate:          atomic.LoadInt32(&client.SampleRate),
+		MaxBatchSize:        maxBatchSize,
+		MessageBatchSize:    atomic.LoadInt32(&client.MessageBatchSize),
+		MessageVersion:      client.MessageVersion,
+		ReturnMessageIDs:    client.ReturnMessageIDs,
+		TLSv1:               tlsv1,
+		Deflate:             deflate,
+		DeflateLevel:        deflateLevel,
+		MaxDeflateLevel:     nsqd.options.maxDeflateLevel,
+		Snappy:              snappy,
+		AuthRequired:        nsqd.IsAuthEnabled(),
+	})
+	if err != nil {
+		return nil, nsq.NewFatalClientErr(err, "E_IDENTIFY_FAILED", "IDENTIFY failed "+err.Error())
+	}
+
+	if !tlsv1 && !deflate && !snappy {
+		return resp, nil
+	}
+
+	// the response and upgrades happen under the client's lock so that nothing
+	// else (ie. a heartbeat) is written in between
+	//
+	// each upgrade is followed by an OK response (over the upgraded connection)
+	client.Lock()
+	defer client.Unlock()
+
+	err = p.send(client, nsq.FrameTypeResponse, resp)
+	if err != nil {
+		return nil, nsq.NewFatalClientErr(err, "E_IDENTIFY_FAILED", "IDENTIFY failed "+err.Error())
+	}
+
+	if tlsv1 {
+		log.Printf("PROTOCOL(V2): [%s] upgrading connection to TLS", client)
+		err = client.UpgradeTLS()
+		if err != nil {
+			return nil, nsq.NewFatalClientErr(err, "E_IDENTIFY_FAILED", "IDENTIFY failed "+err.Error())
+		}
+
+		err = p.send(client, nsq.FrameTypeResponse, []byte("OK"))
+		if err != nil {
+			return nil, nsq.NewFatalClientErr(err, "E_IDENTIFY_FAILED", "IDENTIFY failed "+err.Error())
+		}
+	}
+
+	if snappy {
+		log.Printf("PROTOCOL(V2): [%s] upgrading connection to snappy", client)
+		client.UpgradeSnappy()
+
+		err = p.send(client, nsq.FrameTypeResponse, []byte("OK"))
+		if err != nil {
+			return nil, nsq.NewFatalClientErr(err, "E_IDENTIFY_FAILED", "IDENTIFY failed "+err.Error())
+		}
+	}
+
+	if deflate {
+		log.Printf("PROTOCOL(V2): [%s] upgrading connection to deflate", client)
+		err = client.UpgradeDeflate(deflateLevel)
+		if err != nil {
+			return nil, nsq.NewFatalClientErr(err, "E_IDENTIFY_FAILED", "IDENTIFY failed "+err.Error())
+		}
+
+		err = p.send(client, nsq.FrameTypeResponse, []byte("OK"))
+		if err != nil {
+			return nil, nsq.NewFatalClientErr(err, "E_IDENTIFY_FAILED", "IDENTIFY failed "+err.Error())
+		}
+	}
+
+	return nil, nil
 }
 
 func (p *ProtocolV2) SUB(client *ClientV2, params [][]byte) ([]byte, error) {
@@ -356,6 +748,15 @@ func (p *ProtocolV2) SUB(client *ClientV2, params [][]byte) ([]byte, error) {
 			fmt.Sprintf("SUB channel name '%s' is not valid", channelName))
 	}
 
+	err := p.checkAuth(client, "SUB", permissionSubscribe, topicName, channelName)
+	if err != nil {
+		return nil, err
+	}
+
+	if nsqd.IsExiting() {
+		return nil, nsq.NewFatalClientErr(nil, "E_INVALID", "cannot SUB while nsqd is exiting")
+	}
+
 	topic := nsqd.GetTopic(topicName)
 	channel := topic.GetChannel(channelName)
 	channel.AddClient(client)
@@ -391,11 +792,11 @@ func (p *ProtocolV2) RDY(client *ClientV2, params [][]byte) ([]byte, error) {
 		count = int64(b10)
 	}
 
-	if count < 0 || count > nsq.MaxReadyCount {
+	if count < 0 || count > nsqd.options.maxRdyCount {
 		// this needs to be a fatal error otherwise clients would have
 		// inconsistent state
 		return nil, nsq.NewFatalClientErr(nil, "E_INVALID",
-			fmt.Sprintf("RDY count %d out of range 0-%d", count, nsq.MaxReadyCount))
+			fmt.Sprintf("RDY count %d out of range 0-%d", count, nsqd.options.maxRdyCount))
 	}
 
 	client.SetReadyCount(count)
@@ -415,14 +816,35 @@ func (p *ProtocolV2) FIN(client *ClientV2, params [][]byte) ([]byte, error) {
 		return nil, nsq.NewFatalClientErr(nil, "E_INVALID", "FIN insufficient number of params")
 	}
 
-	copy(id[:], params[1])
-	err := client.Channel.FinishMessage(client, id)
-	if err != nil {
-		return nil, nsq.NewClientErr(err, "E_FIN_FAILED",
-			fmt.Sprintf("FIN %s failed %s", id, err.Error()))
+	ids := params[1:]
+	if len(ids) > maxBatchSize {
+		return nil, nsq.NewFatalClientErr(nil, "E_INVALID",
+			fmt.Sprintf("FIN too many message IDs %d > %d", len(ids), maxBatchSize))
 	}
 
-	client.FinishedMessage()
+	for _, param := range ids {
+		if len(param) != nsq.MsgIdLength {
+			err := p.sendBatchErr(client, nsq.NewClientErr(nil, "E_INVALID",
+				fmt.Sprintf("FIN invalid message ID %s", param)))
+			if err != nil {
+				return nil, nsq.NewFatalClientErr(err, "E_FIN_FAILED", "FIN failed "+err.Error())
+			}
+			continue
+		}
+
+		copy(id[:], param)
+		err := client.Channel.FinishMessage(client, id)
+		if err != nil {
+			err = p.sendBatchErr(client, nsq.NewClientErr(err, "E_FIN_FAILED",
+				fmt.Sprintf("FIN %s failed %s", id, err.Error())))
+			if err != nil {
+				return nil, nsq.NewFatalClientErr(err, "E_FIN_FAILED", "FIN failed "+err.Error())
+			}
+			continue
+		}
+
+		client.FinishedMessage()
+	}
 
 	return nil, nil
 }
@@ -439,11 +861,18 @@ func (p *ProtocolV2) REQ(client *ClientV2, params [][]byte) ([]byte, error) {
 		return nil, nsq.NewFatalClientErr(nil, "E_INVALID", "REQ insufficient number of params")
 	}
 
-	copy(id[:], params[1])
-	timeoutMs, err := util.ByteToBase10(params[2])
+	// the timeout follows the message ID(s)
+	ids := params[1 : len(params)-1]
+	if len(ids) > maxBatchSize {
+		return nil, nsq.NewFatalClientErr(nil, "E_INVALID",
+			fmt.Sprintf("REQ too many message IDs %d > %d", len(ids), maxBatchSize))
+	}
+
+	timeoutParam := params[len(params)-1]
+	timeoutMs, err := util.ByteToBase10(timeoutParam)
 	if err != nil {
 		return nil, nsq.NewFatalClientErr(err, "E_INVALID",
-			fmt.Sprintf("REQ could not parse timeout %s", params[2]))
+			fmt.Sprintf("REQ could not parse timeout %s", timeoutParam))
 	}
 	timeoutDuration := time.Duration(timeoutMs) * time.Millisecond
 
@@ -452,23 +881,53 @@ func (p *ProtocolV2) REQ(client *ClientV2, params [][]byte) ([]byte, error) {
 			fmt.Sprintf("REQ timeout %d out of range 0-%d", timeoutDuration, maxTimeout))
 	}
 
-	err = client.Channel.RequeueMessage(client, id, timeoutDuration)
-	if err != nil {
-		return nil, nsq.NewClientErr(err, "E_REQ_FAILED",
-			fmt.Sprintf("REQ %s failed %s", id, err.Error()))
-	}
+	for _, param := range ids {
+		if len(param) != nsq.MsgIdLength {
+			err := p.sendBatchErr(client, nsq.NewClientErr(nil, "E_INVALID",
+				fmt.Sprintf("REQ invalid message ID %s", param)))
+			if err != nil {
+				return nil, nsq.NewFatalClientErr(err, "E_REQ_FAILED", "REQ failed "+err.Error())
+			}
+			continue
+		}
+
+		copy(id[:], param)
+		err = client.Channel.RequeueMessage(client, id, timeoutDuration)
+		if err != nil {
+			err = p.sendBatchErr(client, nsq.NewClientErr(err, "E_REQ_FAILED",
+				fmt.Sprintf("REQ %s failed %s", id, err.Error())))
+			if err != nil {
+				return nil, nsq.NewFatalClientErr(err, "E_REQ_FAILED", "REQ failed "+err.Error())
+			}
+			continue
+		}
 
-	client.RequeuedMessage()
+		client.RequeuedMessage()
+	}
 
 	return nil, nil
 }
 
+// sendBatchErr sends the error for a single message ID of a FIN, REQ, or TOUCH
+// (the rest of the IDs are still processed, successes have no response)
+func (p *ProtocolV2) sendBatchErr(client *ClientV2, err *nsq.ClientErr) error {
+	context := ""
+	if parentErr := err.Parent(); parentErr != nil {
+		context = " - " + parentErr.Error()
+	}
+	log.Printf("ERROR: [%s] - %s%s", client, err.Error(), context)
+
+	return p.Send(client, nsq.FrameTypeError, []byte(err.Error()))
+}
+
 func (p *ProtocolV2) CLS(client *ClientV2, params [][]byte) ([]byte, error) {
 	if atomic.LoadInt32(&client.State) != nsq.StateSubscribed {
 		return nil, nsq.NewFatalClientErr(nil, "E_INVALID", "cannot CLS in current state")
 	}
 
-	client.StartClose()
+	// by the time the client's msg timeout elapses its in-flight messages would
+	// have been requeued anyway
+	client.StartClose(client.MsgTimeout)
 
 	return []byte("CLOSE_WAIT"), nil
 }
@@ -491,6 +950,22 @@ func (p *ProtocolV2) PUB(client *ClientV2, params [][]byte) ([]byte, error) {
 			fmt.Sprintf("PUB topic name '%s' is not valid", topicName))
 	}
 
+	// copied because params are only valid until the body is read
+	var id *nsq.MessageID
+	if len(params) > 2 {
+		if !nsq.IsValidMessageID(params[2]) {
+			return nil, nsq.NewFatalClientErr(nil, "E_INVALID",
+				fmt.Sprintf("PUB invalid message ID %s", params[2]))
+		}
+		id = new(nsq.MessageID)
+		copy(id[:], params[2])
+	}
+
+	err = p.checkAuth(client, "PUB", permissionPublish, topicName, "")
+	if err != nil {
+		return nil, err
+	}
+
 	err = binary.Read(client.Reader, binary.BigEndian, &bodyLen)
 	if err != nil {
 		return nil, nsq.NewFatalClientErr(err, "E_BAD_MESSAGE", "PUB failed to read message body size")
@@ -507,14 +982,144 @@ func (p *ProtocolV2) PUB(client *ClientV2, params [][]byte) ([]byte, error) {
 		return nil, nsq.NewFatalClientErr(err, "E_BAD_MESSAGE", "PUB failed to read message body")
 	}
 
+	if nsqd.IsExiting() {
+		return nil, nsq.NewFatalClientErr(nil, "E_PUB_FAILED", "PUB failed nsqd is exiting")
+	}
+
+	msg, err := p.newMessage(client, "PUB", id, messageBody)
+	if err != nil {
+		return nil, err
+	}
+
 	topic := nsqd.GetTopic(topicName)
-	msg := nsq.NewMessage(<-nsqd.idChan, messageBody)
 	err = topic.PutMessage(msg)
+	if err == errDuplicateMessageID {
+		return nil, nsq.NewClientErr(err, "E_DUPLICATE_ID", fmt.Sprintf("PUB failed duplicate message ID %s", msg.Id))
+	}
 	if err != nil {
 		return nil, nsq.NewFatalClientErr(err, "E_PUB_FAILED", "PUB failed "+err.Error())
 	}
 
-	return []byte("OK"), nil
+	return p.publishResponse(client, []*nsq.Message{msg}), nil
+}
+
+// newMessage creates a message from a published body, which is prefixed by
+// its headers when the client negotiated nsq.MessageVersion2, with the producer
+// supplied id (or a generated one when it's nil)
+func (p *ProtocolV2) newMessage(client *ClientV2, cmd string, id *nsq.MessageID, body []byte) (*nsq.Message, error) {
+	var headers map[string]string
+	if client.MessageVersion == nsq.MessageVersion2 {
+		var err error
+		headers, body, err = nsq.UnpackHeaders(body)
+		if err != nil {
+			return nil, nsq.NewFatalClientErr(err, "E_BAD_MESSAGE",
+				fmt.Sprintf("%s failed to decode message headers", cmd))
+		}
+	}
+
+	var msgID nsq.MessageID
+	if id != nil {
+		msgID = *id
+	} else {
+		msgID = <-nsqd.idChan
+	}
+
+	msg := nsq.NewMessage(msgID, body)
+	msg.Headers = headers
+	return msg, nil
+}
+
+// publishResponse is the response to a successful PUB/DPUB/MPUB, the
+// (concatenated) IDs of the messages when the client requested them via IDENTIFY
+func (p *ProtocolV2) publishResponse(client *ClientV2, msgs []*nsq.Message) []byte {
+	if !client.ReturnMessageIDs {
+		return []byte("OK")
+	}
+	resp := make([]byte, 0, len(msgs)*nsq.MsgIdLength)
+	for _, msg := range msgs {
+		resp = append(resp, msg.Id[:]...)
+	}
+	return resp
+}
+
+func (p *ProtocolV2) DPUB(client *ClientV2, params [][]byte) ([]byte, error) {
+	var err error
+	var bodyLen int32
+
+	if len(params) < 3 {
+		return nil, nsq.NewFatalClientErr(nil, "E_INVALID", "DPUB insufficient number of parameters")
+	}
+
+	topicName := string(params[1])
+	if !nsq.IsValidTopicName(topicName) {
+		return nil, nsq.NewFatalClientErr(nil, "E_BAD_TOPIC",
+			fmt.Sprintf("DPUB topic name '%s' is not valid", topicName))
+	}
+
+	err = p.checkAuth(client, "DPUB", permissionPublish, topicName, "")
+	if err != nil {
+		return nil, err
+	}
+
+	timeoutMs, err := util.ByteToBase10(params[2])
+	if err != nil {
+		return nil, nsq.NewFatalClientErr(err, "E_INVALID",
+			fmt.Sprintf("DPUB could not parse timeout %s", params[2]))
+	}
+	timeoutDuration := time.Duration(timeoutMs) * time.Millisecond
+
+	if timeoutDuration < 0 || timeoutDuration > maxTimeout {
+		return nil, nsq.NewFatalClientErr(nil, "E_INVALID",
+			fmt.Sprintf("DPUB timeout %d out of range 0-%d", timeoutDuration, maxTimeout))
+	}
+
+	// copied because params are only valid until the body is read
+	var id *nsq.MessageID
+	if len(params) > 3 {
+		if !nsq.IsValidMessageID(params[3]) {
+			return nil, nsq.NewFatalClientErr(nil, "E_INVALID",
+				fmt.Sprintf("DPUB invalid message ID %s", params[3]))
+		}
+		id = new(nsq.MessageID)
+		copy(id[:], params[3])
+	}
+
+	err = binary.Read(client.Reader, binary.BigEndian, &bodyLen)
+	if err != nil {
+		return nil, nsq.NewFatalClientErr(err, "E_BAD_MESSAGE", "DPUB failed to read message body size")
+	}
+
+	if int64(bodyLen) > nsqd.options.maxMessageSize {
+		return nil, nsq.NewFatalClientErr(nil, "E_BAD_MESSAGE",
+			fmt.Sprintf("DPUB message too big %d > %d", bodyLen, nsqd.options.maxMessageSize))
+	}
+
+	messageBody := make([]byte, bodyLen)
+	_, err = io.ReadFull(client.Reader, messageBody)
+	if err != nil {
+		return nil, nsq.NewFatalClientErr(err, "E_BAD_MESSAGE", "DPUB failed to read message body")
+	}
+
+	if nsqd.IsExiting() {
+		return nil, nsq.NewFatalClientErr(nil, "E_DPUB_FAILED", "DPUB failed nsqd is exiting")
+	}
+
+	msg, err := p.newMessage(client, "DPUB", id, messageBody)
+	if err != nil {
+		return nil, err
+	}
+	msg.Deferred = timeoutDuration
+
+	topic := nsqd.GetTopic(topicName)
+	err = topic.PutMessage(msg)
+	if err == errDuplicateMessageID {
+		return nil, nsq.NewClientErr(err, "E_DUPLICATE_ID", fmt.Sprintf("DPUB failed duplicate message ID %s", msg.Id))
+	}
+	if err != nil {
+		return nil, nsq.NewFatalClientErr(err, "E_DPUB_FAILED", "DPUB failed "+err.Error())
+	}
+
+	return p.publishResponse(client, []*nsq.Message{msg}), nil
 }
 
 func (p *ProtocolV2) MPUB(client *ClientV2, params [][]byte) ([]byte, error) {
@@ -533,6 +1138,25 @@ func (p *ProtocolV2) MPUB(client *ClientV2, params [][]byte) ([]byte, error) {
 			fmt.Sprintf("E_BAD_TOPIC MPUB topic name '%s' is not valid", topicName))
 	}
 
+	if len(params[2:]) > maxBatchSize {
+		return nil, nsq.NewFatalClientErr(nil, "E_INVALID",
+			fmt.Sprintf("MPUB too many message IDs %d > %d", len(params[2:]), maxBatchSize))
+	}
+	// copied because params are only valid until the body is read
+	ids := make([]nsq.MessageID, len(params[2:]))
+	for i, id := range params[2:] {
+		if !nsq.IsValidMessageID(id) {
+			return nil, nsq.NewFatalClientErr(nil, "E_INVALID",
+				fmt.Sprintf("MPUB invalid message ID %s", id))
+		}
+		copy(ids[i][:], id)
+	}
+
+	err = p.checkAuth(client, "MPUB", permissionPublish, topicName, "")
+	if err != nil {
+		return nil, err
+	}
+
 	err = binary.Read(client.Reader, binary.BigEndian, &bodyLen)
 	if err != nil {
 		return nil, nsq.NewFatalClientErr(err, "E_BAD_BODY", "MPUB failed to read body size")
@@ -548,6 +1172,11 @@ func (p *ProtocolV2) MPUB(client *ClientV2, params [][]byte) ([]byte, error) {
 		return nil, nsq.NewFatalClientErr(err, "E_BAD_BODY", "MPUB failed to read message count")
 	}
 
+	if len(ids) > 0 && int32(len(ids)) != numMessages {
+		return nil, nsq.NewFatalClientErr(nil, "E_BAD_BODY",
+			fmt.Sprintf("MPUB message count %d doesn't match the number of message IDs %d", numMessages, len(ids)))
+	}
+
 	messages := make([]*nsq.Message, 0, numMessages)
 	for i := int32(0); i < numMessages; i++ {
 		err = binary.Read(client.Reader, binary.BigEndian, &messageSize)
@@ -567,20 +1196,36 @@ func (p *ProtocolV2) MPUB(client *ClientV2, params [][]byte) ([]byte, error) {
 			return nil, nsq.NewFatalClientErr(err, "E_BAD_MESSAGE", "MPUB failed to read message body")
 		}
 
-		messages = append(messages, nsq.NewMessage(<-nsqd.idChan, msgBody))
+		var id *nsq.MessageID
+		if len(ids) > 0 {
+			id = &ids[i]
+		}
+		msg, err := p.newMessage(client, "MPUB", id, msgBody)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, msg)
+	}
+
+	if nsqd.IsExiting() {
+		return nil, nsq.NewFatalClientErr(nil, "E_MPUB_FAILED", "MPUB failed nsqd is exiting")
 	}
 
 	topic := nsqd.GetTopic(topicName)
 
 	// if we've made it this far we've validated all the input,
-	// the only possible error is that the topic is exiting during
-	// this next call (and no messages will be queued in that case)
+	// the only possible errors are a duplicate (producer supplied) message ID
+	// or that the topic is exiting during this next call (and no messages will
+	// be queued in either case)
 	err = topic.PutMessages(messages)
+	if err == errDuplicateMessageID {
+		return nil, nsq.NewClientErr(err, "E_DUPLICATE_ID", "MPUB failed duplicate message ID")
+	}
 	if err != nil {
 		return nil, nsq.NewFatalClientErr(err, "E_MPUB_FAILED", "MPUB failed "+err.Error())
 	}
 
-	return []byte("OK"), nil
+	return p.publishResponse(client, messages), nil
 }
 
 func (p *ProtocolV2) TOUCH(client *ClientV2, params [][]byte) ([]byte, error) {
@@ -595,12 +1240,130 @@ func (p *ProtocolV2) TOUCH(client *ClientV2, params [][]byte) ([]byte, error) {
 		return nil, nsq.NewFatalClientErr(nil, "E_INVALID", "TOUCH insufficient number of params")
 	}
 
-	copy(id[:], params[1])
-	err := client.Channel.TouchMessage(client, id)
-	if err != nil {
-		return nil, nsq.NewClientErr(err, "E_TOUCH_FAILED",
-			fmt.Sprintf("TOUCH %s failed %s", id, err.Error()))
+	ids := params[1:]
+	if len(ids) > maxBatchSize {
+		return nil, nsq.NewFatalClientErr(nil, "E_INVALID",
+			fmt.Sprintf("TOUCH too many message IDs %d > %d", len(ids), maxBatchSize))
+	}
+
+	for _, param := range ids {
+		if len(param) != nsq.MsgIdLength {
+			err := p.sendBatchErr(client, nsq.NewClientErr(nil, "E_INVALID",
+				fmt.Sprintf("TOUCH invalid message ID %s", param)))
+			if err != nil {
+				return nil, nsq.NewFatalClientErr(err, "E_TOUCH_FAILED", "TOUCH failed "+err.Error())
+			}
+			continue
+		}
+
+		copy(id[:], param)
+		err := client.Channel.TouchMessage(client, id)
+		if err != nil {
+			err = p.sendBatchErr(client, nsq.NewClientErr(err, "E_TOUCH_FAILED",
+				fmt.Sprintf("TOUCH %s failed %s", id, err.Error())))
+			if err != nil {
+				return nil, nsq.NewFatalClientErr(err, "E_TOUCH_FAILED", "TOUCH failed "+err.Error())
+			}
+		}
 	}
 
 	return nil, nil
 }
+
+func (p *ProtocolV2) AUTH(client *ClientV2, params [][]byte) ([]byte, error) {
+	var err error
+	var bodyLen int32
+
+	if atomic.LoadInt32(&client.State) != nsq.StateInit {
+		return nil, nsq.NewFatalClientErr(nil, "E_INVALID", "cannot AUTH in current state")
+	}
+
+	if len(params) != 1 {
+		return nil, nsq.NewFatalClientErr(nil, "E_INVALID", "AUTH invalid number of parameters")
+	}
+
+	err = binary.Read(client.Reader, binary.BigEndian, &bodyLen)
+	if err != nil {
+		return nil, nsq.NewFatalClientErr(err, "E_BAD_BODY", "AUTH failed to read body size")
+	}
+
+	if int64(bodyLen) > nsqd.options.maxBodySize {
+		return nil, nsq.NewFatalClientErr(nil, "E_BAD_BODY",
+			fmt.Sprintf("AUTH body too big %d > %d", bodyLen, nsqd.options.maxBodySize))
+	}
+
+	body := make([]byte, bodyLen)
+	_, err = io.ReadFull(client.Reader, body)
+	if err != nil {
+		return nil, nsq.NewFatalClientErr(err, "E_BAD_BODY", "AUTH failed to read body")
+	}
+
+	if client.HasAuthed() {
+		return nil, nsq.NewFatalClientErr(nil, "E_INVALID", "AUTH already set")
+	}
+
+	if !nsqd.IsAuthEnabled() {
+		return nil, nsq.NewFatalClientErr(nil, "E_AUTH_DISABLED", "AUTH disabled")
+	}
+
+	err = client.Auth(string(body))
+	if err != nil {
+		log.Printf("PROTOCOL(V2): [%s] AUTH failed - %s", client, err.Error())
+		return nil, nsq.NewFatalClientErr(err, "E_AUTH_FAILED", "AUTH failed")
+	}
+
+	client.authLock.RLock()
+	authState := client.AuthState
+	client.authLock.RUnlock()
+
+	if len(authState.Authorizations) == 0 {
+		return nil, nsq.NewFatalClientErr(nil, "E_UNAUTHORIZED", "AUTH no authorizations found")
+	}
+
+	resp, err := json.Marshal(struct {
+		Identity        string `json:"identity"`
+		IdentityURL     string `json:"identity_url"`
+		PermissionCount int    `json:"permission_count"`
+	}{
+		Identity:        authState.Identity,
+		IdentityURL:     authState.IdentityURL,
+		PermissionCount: len(authState.Authorizations),
+	})
+	if err != nil {
+		return nil, nsq.NewFatalClientErr(err, "E_AUTH_FAILED", "AUTH failed "+err.Error())
+	}
+
+	return resp, nil
+}
+
+// checkAuth returns an error when auth is enabled and the client's AUTH secret
+// does not grant the permission for the topic/channel
+func (p *ProtocolV2) checkAuth(client *ClientV2, cmd string, permission string, topicName string, channelName string) error {
+	if !nsqd.IsAuthEnabled() {
+		return nil
+	}
+
+	if !client.HasAuthed() {
+		return nsq.NewFatalClientErr(nil, "E_UNAUTHORIZED", fmt.Sprintf("%s AUTH required", cmd))
+	}
+
+	ok, err := client.IsAuthorized(permission, topicName, channelName)
+	if err != nil {
+		log.Printf("PROTOCOL(V2): [%s] AUTH failed - %s", client, err.Error())
+		return nsq.NewFatalClientErr(err, "E_AUTH_FAILED", fmt.Sprintf("%s AUTH failed", cmd))
+	}
+
+	if !ok {
+		return nsq.NewFatalClientErr(nil, "E_UNAUTHORIZED",
+			fmt.Sprintf("%s unauthorized for %s", cmd, formatTopicChannel(topicName, channelName)))
+	}
+
+	return nil
+}
+
+func formatTopicChannel(topicName string, channelName string) string {
+	if channelName == "" {
+		return topicName
+	}
+	return topicName + ":" + channelName
+}
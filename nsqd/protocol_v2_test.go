@@ -3,21 +3,38 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"compress/flate"
+	"crypto/tls"
+	"encoding/json"
 	"fmt"
 	"github.com/bitly/nsq/nsq"
+	"github.com/bitly/nsq/util"
 	"github.com/bmizerany/assert"
+	"github.com/golang/snappy"
+	"io"
 	"io/ioutil"
 	"log"
 	"math"
 	"net"
+	"net/http"
 	"os"
 	"runtime"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
 
+// testNsqdOptions returns the default options, except that test clients don't
+// respond to CLOSE_WAIT (or FIN their messages), so nsqd doesn't wait on them
+// to drain when exiting (see TestDrain)
+func testNsqdOptions() *nsqdOptions {
+	options := NewNsqdOptions()
+	options.drainTimeout = 50 * time.Millisecond
+	return options
+}
+
 func mustStartNSQd(options *nsqdOptions) (*net.TCPAddr, *net.TCPAddr) {
 	tcpAddr, _ := net.ResolveTCPAddr("tcp", "127.0.0.1:0")
 	httpAddr, _ := net.ResolveTCPAddr("tcp", "127.0.0.1:0")
@@ -97,7 +114,7 @@ func TestBasicV2(t *testing.T) {
 	log.SetOutput(ioutil.Discard)
 	defer log.SetOutput(os.Stdout)
 
-	options := NewNsqdOptions()
+	options := testNsqdOptions()
 	options.clientTimeout = 60 * time.Second
 	tcpAddr, _ := mustStartNSQd(options)
 	defer nsqd.Exit()
@@ -132,7 +149,7 @@ func TestMultipleConsumerV2(t *testing.T) {
 
 	msgChan := make(chan *nsq.Message)
 
-	options := NewNsqdOptions()
+	options := testNsqdOptions()
 	options.clientTimeout = 60 * time.Second
 	tcpAddr, _ := mustStartNSQd(options)
 	defer nsqd.Exit()
@@ -178,7 +195,7 @@ func TestClientTimeout(t *testing.T) {
 
 	topicName := "test_client_timeout_v2" + strconv.Itoa(int(time.Now().Unix()))
 
-	options := NewNsqdOptions()
+	options := testNsqdOptions()
 	options.clientTimeout = 50 * time.Millisecond
 	tcpAddr, _ := mustStartNSQd(options)
 	defer nsqd.Exit()
@@ -214,7 +231,7 @@ func TestClientHeartbeat(t *testing.T) {
 
 	topicName := "test_hb_v2" + strconv.Itoa(int(time.Now().Unix()))
 
-	options := NewNsqdOptions()
+	options := testNsqdOptions()
 	options.clientTimeout = 100 * time.Millisecond
 	tcpAddr, _ := mustStartNSQd(options)
 	defer nsqd.Exit()
@@ -250,7 +267,7 @@ func TestClientHeartbeatDisableSUB(t *testing.T) {
 
 	topicName := "test_hb_v2" + strconv.Itoa(int(time.Now().Unix()))
 
-	options := NewNsqdOptions()
+	options := testNsqdOptions()
 	options.clientTimeout = 200 * time.Millisecond
 	tcpAddr, _ := mustStartNSQd(options)
 	defer nsqd.Exit()
@@ -266,7 +283,7 @@ func TestClientHeartbeatDisable(t *testing.T) {
 	log.SetOutput(ioutil.Discard)
 	defer log.SetOutput(os.Stdout)
 
-	options := NewNsqdOptions()
+	options := testNsqdOptions()
 	options.clientTimeout = 100 * time.Millisecond
 	tcpAddr, _ := mustStartNSQd(options)
 	defer nsqd.Exit()
@@ -289,7 +306,7 @@ func TestPausing(t *testing.T) {
 
 	topicName := "test_pause_v2" + strconv.Itoa(int(time.Now().Unix()))
 
-	tcpAddr, _ := mustStartNSQd(NewNsqdOptions())
+	tcpAddr, _ := mustStartNSQd(testNsqdOptions())
 	defer nsqd.Exit()
 
 	conn, err := mustConnectNSQd(tcpAddr)
@@ -352,7 +369,7 @@ func TestEmptyCommand(t *testing.T) {
 	log.SetOutput(ioutil.Discard)
 	defer log.SetOutput(os.Stdout)
 
-	tcpAddr, _ := mustStartNSQd(NewNsqdOptions())
+	tcpAddr, _ := mustStartNSQd(testNsqdOptions())
 	defer nsqd.Exit()
 
 	conn, err := mustConnectNSQd(tcpAddr)
@@ -368,7 +385,7 @@ func TestSizeLimits(t *testing.T) {
 	log.SetOutput(ioutil.Discard)
 	defer log.SetOutput(os.Stdout)
 
-	options := NewNsqdOptions()
+	options := testNsqdOptions()
 	*verbose = true
 	options.maxMessageSize = 100
 	options.maxBodySize = 1000
@@ -450,7 +467,7 @@ func TestTouch(t *testing.T) {
 	defer log.SetOutput(os.Stdout)
 
 	*verbose = true
-	options := NewNsqdOptions()
+	options := testNsqdOptions()
 	options.msgTimeout = 50 * time.Millisecond
 	tcpAddr, _ := mustStartNSQd(options)
 	defer nsqd.Exit()
@@ -491,157 +508,1183 @@ func TestTouch(t *testing.T) {
 	assert.Equal(t, channel.timeoutCount, uint64(0))
 }
 
-func BenchmarkProtocolV2Exec(b *testing.B) {
-	b.StopTimer()
+func TestDPUB(t *testing.T) {
+	testDPUB(t, testNsqdOptions().memQueueSize)
+}
+
+// with no memory queue the deferred message is written to (and read from)
+// the topic's backend
+func TestDPUBDiskQueue(t *testing.T) {
+	testDPUB(t, 0)
+}
+
+func testDPUB(t *testing.T, memQueueSize int64) {
 	log.SetOutput(ioutil.Discard)
 	defer log.SetOutput(os.Stdout)
-	p := &ProtocolV2{}
-	c := NewClientV2(nil)
-	params := [][]byte{[]byte("NOP")}
-	b.StartTimer()
 
-	for i := 0; i < b.N; i++ {
-		p.Exec(c, params)
+	options := testNsqdOptions()
+	options.memQueueSize = memQueueSize
+	tcpAddr, _ := mustStartNSQd(options)
+	defer nsqd.Exit()
+
+	topicName := "test_dpub" + strconv.Itoa(int(memQueueSize)) + strconv.Itoa(int(time.Now().Unix()))
+
+	conn, err := mustConnectNSQd(tcpAddr)
+	assert.Equal(t, err, nil)
+
+	identify(t, conn)
+	sub(t, conn, topicName, "ch")
+
+	err = nsq.Ready(1).Write(conn)
+	assert.Equal(t, err, nil)
+
+	pubConn, err := mustConnectNSQd(tcpAddr)
+	assert.Equal(t, err, nil)
+
+	identify(t, pubConn)
+
+	start := time.Now()
+	err = nsq.DeferredPublish(topicName, 50*time.Millisecond, []byte("test body")).Write(pubConn)
+	assert.Equal(t, err, nil)
+	readValidateOK(t, pubConn)
+
+	// an out of range timeout is an error
+	err = nsq.DeferredPublish(topicName, 2*maxTimeout, []byte("test body")).Write(pubConn)
+	assert.Equal(t, err, nil)
+	resp, _ := nsq.ReadResponse(pubConn)
+	frameType, _, _ := nsq.UnpackResponse(resp)
+	assert.Equal(t, frameType, nsq.FrameTypeError)
+
+	time.Sleep(10 * time.Millisecond)
+
+	channel, err := nsqd.GetTopic(topicName).GetExistingChannel("ch")
+	assert.Equal(t, err, nil)
+	channel.Lock()
+	numDeferred := len(channel.deferredMessages)
+	channel.Unlock()
+	assert.Equal(t, numDeferred, 1)
+
+	resp, err = nsq.ReadResponse(conn)
+	assert.Equal(t, err, nil)
+	frameType, data, err := nsq.UnpackResponse(resp)
+	msgOut, _ := nsq.DecodeMessage(data)
+	assert.Equal(t, frameType, nsq.FrameTypeMessage)
+	assert.Equal(t, msgOut.Body, []byte("test body"))
+	assert.Equal(t, time.Now().Sub(start) >= 50*time.Millisecond, true)
+}
+
+type identifyResponse struct {
+	MaxRdyCount         int64  `json:"max_rdy_count"`
+	Version             string `json:"version"`
+	MaxMsgTimeout       int64  `json:"max_msg_timeout"`
+	MsgTimeout          int64  `json:"msg_timeout"`
+	MaxMessageSize      int64  `json:"max_message_size"`
+	MaxBodySize         int64  `json:"max_body_size"`
+	OutputBufferSize    int    `json:"output_buffer_size"`
+	OutputBufferTimeout int64  `json:"output_buffer_timeout"`
+	SampleRate          int32  `json:"sample_rate"`
+	MaxBatchSize        int    `json:"max_batch_size"`
+	MessageBatchSize    int32  `json:"message_batch_size"`
+	MessageVersion      int    `json:"message_version"`
+	ReturnMessageIDs    bool   `json:"return_message_ids"`
+	TLSv1               bool   `json:"tls_v1"`
+	Deflate             bool   `json:"deflate"`
+	DeflateLevel        int    `json:"deflate_level"`
+	MaxDeflateLevel     int    `json:"max_deflate_level"`
+	Snappy              bool   `json:"snappy"`
+	AuthRequired        bool   `json:"auth_required"`
+}
+
+func identifyFeatureNegotiation(t *testing.T, conn net.Conn, features map[string]interface{}) identifyResponse {
+	var r identifyResponse
+	ci := make(map[string]interface{})
+	ci["short_id"] = "test"
+	ci["long_id"] = "test"
+	ci["feature_negotiation"] = true
+	for k, v := range features {
+		ci[k] = v
 	}
+	cmd, _ := nsq.Identify(ci)
+	err := cmd.Write(conn)
+	assert.Equal(t, err, nil)
+	resp, err := nsq.ReadResponse(conn)
+	assert.Equal(t, err, nil)
+	frameType, data, err := nsq.UnpackResponse(resp)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, frameType, nsq.FrameTypeResponse)
+	err = json.Unmarshal(data, &r)
+	assert.Equal(t, err, nil)
+	return r
 }
 
-func benchmarkProtocolV2Pub(b *testing.B, size int) {
-	var wg sync.WaitGroup
-	b.StopTimer()
+func TestIdentifyFeatureNegotiation(t *testing.T) {
 	log.SetOutput(ioutil.Discard)
 	defer log.SetOutput(os.Stdout)
-	options := NewNsqdOptions()
-	options.memQueueSize = int64(b.N)
+
+	options := testNsqdOptions()
+	options.maxRdyCount = 50
+	options.msgTimeout = 30 * time.Second
 	tcpAddr, _ := mustStartNSQd(options)
-	msg := make([]byte, size)
-	batchSize := 200
-	batch := make([][]byte, 0)
-	for i := 0; i < batchSize; i++ {
-		batch = append(batch, msg)
-	}
-	topicName := "bench_v2_pub" + strconv.Itoa(int(time.Now().Unix()))
-	b.SetBytes(int64(len(msg)))
-	b.StartTimer()
+	defer nsqd.Exit()
 
-	for j := 0; j < runtime.GOMAXPROCS(0); j++ {
-		wg.Add(1)
-		go func() {
-			conn, err := mustConnectNSQd(tcpAddr)
-			if err != nil {
-				panic(err.Error())
-			}
-			rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+	topicName := "test_features" + strconv.Itoa(int(time.Now().Unix()))
 
-			num := b.N / runtime.GOMAXPROCS(0) / batchSize
-			for i := 0; i < num; i += 1 {
-				cmd, _ := nsq.MultiPublish(topicName, batch)
-				err := cmd.Write(rw)
-				if err != nil {
-					panic(err.Error())
-				}
-				err = rw.Flush()
-				if err != nil {
-					panic(err.Error())
-				}
-				resp, err := nsq.ReadResponse(rw)
-				if err != nil {
-					panic(err.Error())
-				}
-				_, data, _ := nsq.UnpackResponse(resp)
-				if !bytes.Equal(data, []byte("OK")) {
-					panic("invalid response")
-				}
-			}
-			wg.Done()
-		}()
-	}
+	conn, err := mustConnectNSQd(tcpAddr)
+	assert.Equal(t, err, nil)
 
-	wg.Wait()
+	r := identifyFeatureNegotiation(t, conn, nil)
+	assert.Equal(t, r.MaxRdyCount, int64(50))
+	assert.Equal(t, r.Version, util.BINARY_VERSION)
+	assert.Equal(t, r.MaxMsgTimeout, int64(15*60*1000))
+	assert.Equal(t, r.MsgTimeout, int64(30*1000))
+	assert.Equal(t, r.MaxMessageSize, options.maxMessageSize)
+	assert.Equal(t, r.MaxBodySize, options.maxBodySize)
+	assert.Equal(t, r.TLSv1, false)
+	assert.Equal(t, r.Deflate, false)
+	assert.Equal(t, r.MaxDeflateLevel, 6)
+	assert.Equal(t, r.Snappy, false)
+	assert.Equal(t, r.AuthRequired, false)
 
-	b.StopTimer()
-	nsqd.Exit()
+	sub(t, conn, topicName, "ch")
+
+	// RDY is bounded by --max-rdy-count
+	err = nsq.Ready(51).Write(conn)
+	assert.Equal(t, err, nil)
+	resp, err := nsq.ReadResponse(conn)
+	assert.Equal(t, err, nil)
+	frameType, data, err := nsq.UnpackResponse(resp)
+	assert.Equal(t, frameType, nsq.FrameTypeError)
+	assert.Equal(t, string(data), "E_INVALID RDY count 51 out of range 0-50")
 }
 
-func BenchmarkProtocolV2Pub256(b *testing.B)  { benchmarkProtocolV2Pub(b, 256) }
-func BenchmarkProtocolV2Pub512(b *testing.B)  { benchmarkProtocolV2Pub(b, 512) }
-func BenchmarkProtocolV2Pub1k(b *testing.B)   { benchmarkProtocolV2Pub(b, 1024) }
-func BenchmarkProtocolV2Pub2k(b *testing.B)   { benchmarkProtocolV2Pub(b, 2*1024) }
-func BenchmarkProtocolV2Pub4k(b *testing.B)   { benchmarkProtocolV2Pub(b, 4*1024) }
-func BenchmarkProtocolV2Pub8k(b *testing.B)   { benchmarkProtocolV2Pub(b, 8*1024) }
-func BenchmarkProtocolV2Pub16k(b *testing.B)  { benchmarkProtocolV2Pub(b, 16*1024) }
-func BenchmarkProtocolV2Pub32k(b *testing.B)  { benchmarkProtocolV2Pub(b, 32*1024) }
-func BenchmarkProtocolV2Pub64k(b *testing.B)  { benchmarkProtocolV2Pub(b, 64*1024) }
-func BenchmarkProtocolV2Pub128k(b *testing.B) { benchmarkProtocolV2Pub(b, 128*1024) }
-func BenchmarkProtocolV2Pub256k(b *testing.B) { benchmarkProtocolV2Pub(b, 256*1024) }
-func BenchmarkProtocolV2Pub512k(b *testing.B) { benchmarkProtocolV2Pub(b, 512*1024) }
-func BenchmarkProtocolV2Pub1m(b *testing.B)   { benchmarkProtocolV2Pub(b, 1024*1024) }
+func TestIdentifyTwice(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
 
-func benchmarkProtocolV2Sub(b *testing.B, size int) {
-	var wg sync.WaitGroup
-	b.StopTimer()
+	tcpAddr, _ := mustStartNSQd(testNsqdOptions())
+	defer nsqd.Exit()
+
+	conn, err := mustConnectNSQd(tcpAddr)
+	assert.Equal(t, err, nil)
+
+	identify(t, conn)
+
+	ci := make(map[string]interface{})
+	ci["short_id"] = "test"
+	ci["long_id"] = "test"
+	cmd, _ := nsq.Identify(ci)
+	err = cmd.Write(conn)
+	assert.Equal(t, err, nil)
+	resp, err := nsq.ReadResponse(conn)
+	assert.Equal(t, err, nil)
+	frameType, data, err := nsq.UnpackResponse(resp)
+	assert.Equal(t, frameType, nsq.FrameTypeError)
+	assert.Equal(t, string(data), "E_INVALID cannot IDENTIFY again")
+}
+
+func TestOutputBuffering(t *testing.T) {
 	log.SetOutput(ioutil.Discard)
 	defer log.SetOutput(os.Stdout)
-	options := NewNsqdOptions()
-	options.memQueueSize = int64(b.N)
+
+	options := testNsqdOptions()
 	tcpAddr, _ := mustStartNSQd(options)
-	msg := make([]byte, size)
-	topicName := "bench_v2_sub" + strconv.Itoa(b.N) + strconv.Itoa(int(time.Now().Unix()))
+	defer nsqd.Exit()
+
+	topicName := "test_output_buffering" + strconv.Itoa(int(time.Now().Unix()))
+
+	conn, err := mustConnectNSQd(tcpAddr)
+	assert.Equal(t, err, nil)
+
+	r := identifyFeatureNegotiation(t, conn, map[string]interface{}{
+		"output_buffer_size":    256,
+		"output_buffer_timeout": 100,
+	})
+	assert.Equal(t, r.OutputBufferSize, 256)
+	assert.Equal(t, r.OutputBufferTimeout, int64(100))
+
+	sub(t, conn, topicName, "ch")
+
+	// with RDY > 1 the message is buffered until the output buffer timeout
 	topic := nsqd.GetTopic(topicName)
-	for i := 0; i < b.N; i++ {
-		msg := nsq.NewMessage(<-nsqd.idChan, msg)
-		topic.PutMessage(msg)
-	}
-	topic.GetChannel("ch")
-	b.SetBytes(int64(len(msg)))
-	goChan := make(chan int)
-	rdyChan := make(chan int)
-	workers := runtime.GOMAXPROCS(0)
-	for j := 0; j < workers; j++ {
-		wg.Add(1)
-		go func() {
-			subWorker(b.N, workers, tcpAddr, topicName, rdyChan, goChan)
-			wg.Done()
-		}()
-		<-rdyChan
-	}
-	b.StartTimer()
+	msg := nsq.NewMessage(<-nsqd.idChan, []byte("test body"))
+	topic.PutMessage(msg)
 
-	close(goChan)
-	wg.Wait()
+	err = nsq.Ready(10).Write(conn)
+	assert.Equal(t, err, nil)
 
-	b.StopTimer()
-	nsqd.Exit()
+	resp, err := nsq.ReadResponse(conn)
+	assert.Equal(t, err, nil)
+	frameType, data, err := nsq.UnpackResponse(resp)
+	msgOut, _ := nsq.DecodeMessage(data)
+	assert.Equal(t, frameType, nsq.FrameTypeMessage)
+	assert.Equal(t, msgOut.Body, []byte("test body"))
+
+	channel, err := topic.GetExistingChannel("ch")
+	assert.Equal(t, err, nil)
+	channel.RLock()
+	client := channel.clients[0].(*ClientV2)
+	channel.RUnlock()
+	client.Lock()
+	assert.Equal(t, client.Writer.Available()+client.Writer.Buffered(), 256)
+	client.Unlock()
 }
 
-func subWorker(n int, workers int, tcpAddr *net.TCPAddr, topicName string, rdyChan chan int, goChan chan int) {
+func TestOutputBufferingValidity(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	options := testNsqdOptions()
+	options.maxOutputBufferSize = 1024
+	options.maxOutputBufferTimeout = time.Second
+	tcpAddr, _ := mustStartNSQd(options)
+	defer nsqd.Exit()
+
 	conn, err := mustConnectNSQd(tcpAddr)
-	if err != nil {
-		panic(err.Error())
+	assert.Equal(t, err, nil)
+	r := identifyFeatureNegotiation(t, conn, map[string]interface{}{
+		"output_buffer_size":    -1,
+		"output_buffer_timeout": -1,
+	})
+	assert.Equal(t, r.OutputBufferSize, 1)
+	assert.Equal(t, r.OutputBufferTimeout, int64(0))
+	conn.Close()
+
+	for _, ci := range []map[string]interface{}{
+		{"output_buffer_size": 63},
+		{"output_buffer_size": 1025},
+		{"output_buffer_timeout": 1001},
+		{"output_buffer_timeout": -2},
+	} {
+		conn, err := mustConnectNSQd(tcpAddr)
+		assert.Equal(t, err, nil)
+		cmd, _ := nsq.Identify(ci)
+		err = cmd.Write(conn)
+		assert.Equal(t, err, nil)
+		resp, err := nsq.ReadResponse(conn)
+		assert.Equal(t, err, nil)
+		frameType, data, err := nsq.UnpackResponse(resp)
+		assert.Equal(t, frameType, nsq.FrameTypeError)
+		assert.Equal(t, bytes.HasPrefix(data, []byte("E_INVALID IDENTIFY Invalid output_buffer_")), true)
+		conn.Close()
 	}
-	rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+}
 
-	identify(nil, conn)
-	sub(nil, conn, topicName, "ch")
+func TestClientMsgTimeout(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
 
-	rdyCount := int(math.Min(math.Max(float64(n/workers), 1), 2500))
-	rdyChan <- 1
-	<-goChan
-	nsq.Ready(rdyCount).Write(rw)
-	rw.Flush()
-	num := n / workers
-	numRdy := num/rdyCount - 1
-	rdy := rdyCount
-	for i := 0; i < num; i += 1 {
-		resp, err := nsq.ReadResponse(rw)
-		if err != nil {
-			panic(err.Error())
-		}
+	options := testNsqdOptions()
+	options.maxMsgTimeout = 2 * time.Second
+	tcpAddr, _ := mustStartNSQd(options)
+	defer nsqd.Exit()
+
+	topicName := "test_cmsg_timeout" + strconv.Itoa(int(time.Now().Unix()))
+
+	for _, msgTimeout := range []int{999, 2001} {
+		conn, err := mustConnectNSQd(tcpAddr)
+		assert.Equal(t, err, nil)
+		cmd, _ := nsq.Identify(map[string]interface{}{"msg_timeout": msgTimeout})
+		err = cmd.Write(conn)
+		assert.Equal(t, err, nil)
+		resp, err := nsq.ReadResponse(conn)
+		assert.Equal(t, err, nil)
 		frameType, data, err := nsq.UnpackResponse(resp)
-		if err != nil {
-			panic(err.Error())
-		}
-		if frameType != nsq.FrameTypeMessage {
-			panic("got something else")
+		assert.Equal(t, frameType, nsq.FrameTypeError)
+		assert.Equal(t, string(data), fmt.Sprintf("E_INVALID IDENTIFY Invalid msg_timeout (%d) must be 1000-2000", msgTimeout))
+		conn.Close()
+	}
+
+	conn, err := mustConnectNSQd(tcpAddr)
+	assert.Equal(t, err, nil)
+	r := identifyFeatureNegotiation(t, conn, map[string]interface{}{"msg_timeout": 1000})
+	assert.Equal(t, r.MsgTimeout, int64(1000))
+	sub(t, conn, topicName, "ch")
+
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("ch")
+	msg := nsq.NewMessage(<-nsqd.idChan, []byte("test body"))
+	topic.PutMessage(msg)
+
+	// the message times out (well before nsqd's default of 60s) and is redelivered
+	for i := 1; i <= 2; i++ {
+		err = nsq.Ready(1).Write(conn)
+		assert.Equal(t, err, nil)
+		resp, err := nsq.ReadResponse(conn)
+		assert.Equal(t, err, nil)
+		frameType, data, err := nsq.UnpackResponse(resp)
+		assert.Equal(t, frameType, nsq.FrameTypeMessage)
+		msgOut, _ := nsq.DecodeMessage(data)
+		assert.Equal(t, msgOut.Id, msg.Id)
+		assert.Equal(t, msgOut.Attempts, uint16(i))
+	}
+
+	assert.Equal(t, channel.timeoutCount, uint64(1))
+}
+
+func TestSampling(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	num := 2000
+	sampleRate := 42
+
+	options := testNsqdOptions()
+	options.maxRdyCount = int64(num)
+	tcpAddr, _ := mustStartNSQd(options)
+	defer nsqd.Exit()
+
+	topicName := "test_sampling" + strconv.Itoa(int(time.Now().Unix()))
+
+	conn, err := mustConnectNSQd(tcpAddr)
+	assert.Equal(t, err, nil)
+	cmd, _ := nsq.Identify(map[string]interface{}{"sample_rate": 100})
+	err = cmd.Write(conn)
+	assert.Equal(t, err, nil)
+	resp, err := nsq.ReadResponse(conn)
+	assert.Equal(t, err, nil)
+	frameType, data, err := nsq.UnpackResponse(resp)
+	assert.Equal(t, frameType, nsq.FrameTypeError)
+	assert.Equal(t, string(data), "E_INVALID IDENTIFY Invalid sample_rate (100) must be 0-99")
+	conn.Close()
+
+	conn, err = mustConnectNSQd(tcpAddr)
+	assert.Equal(t, err, nil)
+	r := identifyFeatureNegotiation(t, conn, map[string]interface{}{"sample_rate": sampleRate})
+	assert.Equal(t, r.SampleRate, int32(sampleRate))
+	sub(t, conn, topicName, "ch")
+
+	topic := nsqd.GetTopic(topicName)
+	for i := 0; i < num; i++ {
+		msg := nsq.NewMessage(<-nsqd.idChan, []byte("test body"))
+		topic.PutMessage(msg)
+	}
+
+	err = nsq.Ready(num).Write(conn)
+	assert.Equal(t, err, nil)
+
+	// read until nsqd has nothing left to send
+	count := 0
+	for {
+		conn.SetReadDeadline(time.Now().Add(250 * time.Millisecond))
+		resp, err := nsq.ReadResponse(conn)
+		if err != nil {
+			break
+		}
+		frameType, _, _ := nsq.UnpackResponse(resp)
+		if frameType == nsq.FrameTypeMessage {
+			count++
+		}
+	}
+
+	actualSampleRate := float64(count) / float64(num) * 100
+	assert.Equal(t, actualSampleRate > float64(sampleRate)-5, true)
+	assert.Equal(t, actualSampleRate < float64(sampleRate)+5, true)
+
+	channel := topic.GetChannel("ch")
+	assert.Equal(t, channel.Depth(), int64(0))
+	assert.Equal(t, len(channel.inFlightMessages), count)
+}
+
+func TestCloseTimeout(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	options := testNsqdOptions()
+	tcpAddr, _ := mustStartNSQd(options)
+	defer nsqd.Exit()
+
+	topicName := "test_close_timeout" + strconv.Itoa(int(time.Now().Unix()))
+
+	conn, err := mustConnectNSQd(tcpAddr)
+	assert.Equal(t, err, nil)
+	identifyFeatureNegotiation(t, conn, map[string]interface{}{"msg_timeout": 1000})
+	sub(t, conn, topicName, "ch")
+
+	err = nsq.StartClose().Write(conn)
+	assert.Equal(t, err, nil)
+	resp, err := nsq.ReadResponse(conn)
+	assert.Equal(t, err, nil)
+	frameType, data, err := nsq.UnpackResponse(resp)
+	assert.Equal(t, frameType, nsq.FrameTypeResponse)
+	assert.Equal(t, data, []byte("CLOSE_WAIT"))
+
+	// nsqd closes the connection (after the client's msg timeout) when the client doesn't
+	start := time.Now()
+	_, err = nsq.ReadResponse(conn)
+	assert.NotEqual(t, err, nil)
+	assert.Equal(t, time.Now().Sub(start) >= 900*time.Millisecond, true)
+}
+
+func TestDrain(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	options := testNsqdOptions()
+	tcpAddr, _ := mustStartNSQd(options)
+	nsqd.options.drainTimeout = 5 * time.Second
+
+	topicName := "test_drain" + strconv.Itoa(int(time.Now().Unix()))
+
+	producer, err := mustConnectNSQd(tcpAddr)
+	assert.Equal(t, err, nil)
+	identify(t, producer)
+
+	conn, err := mustConnectNSQd(tcpAddr)
+	assert.Equal(t, err, nil)
+	identify(t, conn)
+	sub(t, conn, topicName, "ch")
+
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("ch")
+	msg := nsq.NewMessage(<-nsqd.idChan, []byte("test body"))
+	topic.PutMessage(msg)
+
+	err = nsq.Ready(1).Write(conn)
+	assert.Equal(t, err, nil)
+	resp, err := nsq.ReadResponse(conn)
+	assert.Equal(t, err, nil)
+	frameType, _, err := nsq.UnpackResponse(resp)
+	assert.Equal(t, frameType, nsq.FrameTypeMessage)
+
+	exitChan := make(chan int)
+	go func() {
+		nsqd.Exit()
+		close(exitChan)
+	}()
+
+	// subscribed clients are sent CLOSE_WAIT
+	resp, err = nsq.ReadResponse(conn)
+	assert.Equal(t, err, nil)
+	frameType, data, err := nsq.UnpackResponse(resp)
+	assert.Equal(t, frameType, nsq.FrameTypeResponse)
+	assert.Equal(t, data, []byte("CLOSE_WAIT"))
+
+	// new connections and publishes are refused
+	_, err = net.DialTimeout("tcp", tcpAddr.String(), time.Second)
+	assert.NotEqual(t, err, nil)
+	frameType, data = pubCmd(t, producer, topicName)
+	assert.Equal(t, frameType, nsq.FrameTypeError)
+	assert.Equal(t, string(data), "E_PUB_FAILED PUB failed nsqd is exiting")
+
+	// nsqd waits for the in-flight message to be FINished (well before the drain timeout)
+	select {
+	case <-exitChan:
+		t.Fatalf("nsqd exited before the in-flight message was FINished")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	err = nsq.Finish(msg.Id).Write(conn)
+	assert.Equal(t, err, nil)
+
+	select {
+	case <-exitChan:
+	case <-time.After(time.Second):
+		t.Fatalf("nsqd did not exit once drained")
+	}
+	assert.Equal(t, channel.Depth(), int64(0))
+}
+
+func TestBatchedCommands(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	options := testNsqdOptions()
+	tcpAddr, _ := mustStartNSQd(options)
+	defer nsqd.Exit()
+
+	topicName := "test_batched" + strconv.Itoa(int(time.Now().Unix()))
+
+	conn, err := mustConnectNSQd(tcpAddr)
+	assert.Equal(t, err, nil)
+	r := identifyFeatureNegotiation(t, conn, nil)
+	assert.Equal(t, r.MaxBatchSize, maxBatchSize)
+	sub(t, conn, topicName, "ch")
+
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("ch")
+	client := channel.clients[0].(*ClientV2)
+	for i := 0; i < 4; i++ {
+		msg := nsq.NewMessage(<-nsqd.idChan, []byte("test body"))
+		topic.PutMessage(msg)
+	}
+
+	err = nsq.Ready(4).Write(conn)
+	assert.Equal(t, err, nil)
+
+	var ids []nsq.MessageID
+	for i := 0; i < 4; i++ {
+		resp, err := nsq.ReadResponse(conn)
+		assert.Equal(t, err, nil)
+		frameType, data, err := nsq.UnpackResponse(resp)
+		assert.Equal(t, frameType, nsq.FrameTypeMessage)
+		msgOut, _ := nsq.DecodeMessage(data)
+		ids = append(ids, msgOut.Id)
+	}
+
+	err = nsq.MultiTouch(ids).Write(conn)
+	assert.Equal(t, err, nil)
+
+	// only the IDs that fail get a response
+	badId := nsq.MessageID{'b', 'a', 'd'}
+	err = nsq.MultiFinish([]nsq.MessageID{ids[0], badId, ids[1]}).Write(conn)
+	assert.Equal(t, err, nil)
+	resp, err := nsq.ReadResponse(conn)
+	assert.Equal(t, err, nil)
+	frameType, data, err := nsq.UnpackResponse(resp)
+	assert.Equal(t, frameType, nsq.FrameTypeError)
+	assert.Equal(t, string(data), fmt.Sprintf("E_FIN_FAILED FIN %s failed ID not in flight", badId))
+
+	err = nsq.MultiRequeue(ids[2:], 0).Write(conn)
+	assert.Equal(t, err, nil)
+
+	// a PUB round trip (ie. the batches have been processed)
+	err = nsq.Publish(topicName+"_other", []byte("test body")).Write(conn)
+	assert.Equal(t, err, nil)
+	readValidateOK(t, conn)
+
+	assert.Equal(t, atomic.LoadUint64(&client.FinishCount), uint64(2))
+	assert.Equal(t, atomic.LoadUint64(&client.RequeueCount), uint64(2))
+	assert.Equal(t, atomic.LoadInt64(&client.InFlightCount), int64(0))
+	assert.Equal(t, atomic.LoadUint64(&channel.requeueCount), uint64(2))
+
+	// an ID of the wrong length fails on its own, too
+	for _, cmd := range []string{"FIN", "REQ", "TOUCH"} {
+		params := [][]byte{[]byte("short")}
+		if cmd == "REQ" {
+			params = append(params, []byte("0"))
+		}
+		err = (&nsq.Command{Name: []byte(cmd), Params: params}).Write(conn)
+		assert.Equal(t, err, nil)
+		resp, err = nsq.ReadResponse(conn)
+		assert.Equal(t, err, nil)
+		frameType, data, err = nsq.UnpackResponse(resp)
+		assert.Equal(t, frameType, nsq.FrameTypeError)
+		assert.Equal(t, string(data), fmt.Sprintf("E_INVALID %s invalid message ID short", cmd))
+	}
+
+	tooMany := make([]nsq.MessageID, maxBatchSize+1)
+	err = nsq.MultiFinish(tooMany).Write(conn)
+	assert.Equal(t, err, nil)
+	resp, err = nsq.ReadResponse(conn)
+	assert.Equal(t, err, nil)
+	frameType, data, err = nsq.UnpackResponse(resp)
+	assert.Equal(t, frameType, nsq.FrameTypeError)
+	assert.Equal(t, string(data), fmt.Sprintf("E_INVALID FIN too many message IDs %d > %d", maxBatchSize+1, maxBatchSize))
+}
+
+func TestMessageBatch(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	num := 200
+
+	options := testNsqdOptions()
+	options.maxRdyCount = int64(num)
+	tcpAddr, _ := mustStartNSQd(options)
+	defer nsqd.Exit()
+
+	topicName := "test_message_batch" + strconv.Itoa(int(time.Now().Unix()))
+
+	conn, err := mustConnectNSQd(tcpAddr)
+	assert.Equal(t, err, nil)
+	r := identifyFeatureNegotiation(t, conn, map[string]interface{}{"message_batch_size": 1000})
+	// capped at the max RDY count
+	assert.Equal(t, r.MessageBatchSize, int32(num))
+	sub(t, conn, topicName, "ch")
+
+	topic := nsqd.GetTopic(topicName)
+	for i := 0; i < num; i++ {
+		msg := nsq.NewMessage(<-nsqd.idChan, []byte("test body"))
+		topic.PutMessage(msg)
+	}
+
+	err = nsq.Ready(num).Write(conn)
+	assert.Equal(t, err, nil)
+
+	batchFrameCount := 0
+	ids := make(map[nsq.MessageID]bool)
+	for len(ids) < num {
+		resp, err := nsq.ReadResponse(conn)
+		assert.Equal(t, err, nil)
+		frameType, data, err := nsq.UnpackResponse(resp)
+		assert.Equal(t, err, nil)
+		switch frameType {
+		case nsq.FrameTypeMessage:
+			msg, err := nsq.DecodeMessage(data)
+			assert.Equal(t, err, nil)
+			ids[msg.Id] = true
+		case nsq.FrameTypeMessageBatch:
+			batchFrameCount++
+			msgs, err := nsq.DecodeMessageBatch(data)
+			assert.Equal(t, err, nil)
+			for _, msg := range msgs {
+				assert.Equal(t, msg.Body, []byte("test body"))
+				ids[msg.Id] = true
+			}
+		default:
+			t.Fatalf("unexpected frame type %d", frameType)
+		}
+	}
+	assert.Equal(t, len(ids), num)
+	assert.Equal(t, batchFrameCount > 0, true)
+
+	channel := topic.GetChannel("ch")
+	assert.Equal(t, channel.InFlightCount(), num)
+}
+
+func readMessage(t *testing.T, conn net.Conn) *nsq.Message {
+	resp, err := nsq.ReadResponse(conn)
+	assert.Equal(t, err, nil)
+	frameType, data, err := nsq.UnpackResponse(resp)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, frameType, nsq.FrameTypeMessage)
+	msg, err := nsq.DecodeMessage(data)
+	assert.Equal(t, err, nil)
+	return msg
+}
+
+func TestMessageHeaders(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	options := testNsqdOptions()
+	// messages go through the DiskQueue
+	options.memQueueSize = 0
+	tcpAddr, _ := mustStartNSQd(options)
+	defer nsqd.Exit()
+
+	topicName := "test_message_headers" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	topic.GetChannel("ch")
+	topic.GetChannel("ch_v1")
+
+	conn, err := mustConnectNSQd(tcpAddr)
+	assert.Equal(t, err, nil)
+	cmd, _ := nsq.Identify(map[string]interface{}{"message_version": 3})
+	err = cmd.Write(conn)
+	assert.Equal(t, err, nil)
+	resp, _ := nsq.ReadResponse(conn)
+	frameType, data, _ := nsq.UnpackResponse(resp)
+	assert.Equal(t, frameType, nsq.FrameTypeError)
+	assert.Equal(t, string(data), "E_INVALID IDENTIFY Invalid message_version (3) must be 1-2")
+	conn.Close()
+
+	pubConn, err := mustConnectNSQd(tcpAddr)
+	assert.Equal(t, err, nil)
+	r := identifyFeatureNegotiation(t, pubConn, map[string]interface{}{"message_version": nsq.MessageVersion2})
+	assert.Equal(t, r.MessageVersion, nsq.MessageVersion2)
+
+	headers := map[string]string{"content_type": "text/plain", "trace_id": "abc123"}
+	body, err := nsq.PackHeaders(headers, []byte("test body"))
+	assert.Equal(t, err, nil)
+	pubBody, err := nsq.PackHeaders(nil, []byte("no headers"))
+	assert.Equal(t, err, nil)
+	cmd, _ = nsq.MultiPublish(topicName, [][]byte{body, pubBody})
+	err = cmd.Write(pubConn)
+	assert.Equal(t, err, nil)
+	readValidateOK(t, pubConn)
+
+	// the body of a client that negotiated headers must be prefixed by them
+	err = nsq.Publish(topicName, []byte("x")).Write(pubConn)
+	assert.Equal(t, err, nil)
+	resp, _ = nsq.ReadResponse(pubConn)
+	frameType, data, _ = nsq.UnpackResponse(resp)
+	assert.Equal(t, frameType, nsq.FrameTypeError)
+	assert.Equal(t, string(data), "E_BAD_MESSAGE PUB failed to decode message headers")
+	pubConn.Close()
+
+	conn, err = mustConnectNSQd(tcpAddr)
+	assert.Equal(t, err, nil)
+	identifyFeatureNegotiation(t, conn, map[string]interface{}{"message_version": nsq.MessageVersion2})
+	sub(t, conn, topicName, "ch")
+	err = nsq.Ready(2).Write(conn)
+	assert.Equal(t, err, nil)
+
+	msg := readMessage(t, conn)
+	assert.Equal(t, msg.Body, []byte("test body"))
+	assert.Equal(t, msg.Headers, headers)
+	assert.Equal(t, msg.Header("trace_id"), "abc123")
+	msg = readMessage(t, conn)
+	assert.Equal(t, msg.Body, []byte("no headers"))
+	assert.Equal(t, len(msg.Headers), 0)
+
+	// headers are dropped for clients that didn't negotiate them
+	conn, err = mustConnectNSQd(tcpAddr)
+	assert.Equal(t, err, nil)
+	identify(t, conn)
+	sub(t, conn, topicName, "ch_v1")
+	err = nsq.Ready(1).Write(conn)
+	assert.Equal(t, err, nil)
+
+	msg = readMessage(t, conn)
+	assert.Equal(t, msg.Body, []byte("test body"))
+	assert.Equal(t, len(msg.Headers), 0)
+}
+
+func TestPublishMessageIDs(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	options := testNsqdOptions()
+	tcpAddr, httpAddr := mustStartNSQd(options)
+	defer nsqd.Exit()
+
+	topicName := "test_publish_ids" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	topic.GetChannel("ch")
+
+	conn, err := mustConnectNSQd(tcpAddr)
+	assert.Equal(t, err, nil)
+	r := identifyFeatureNegotiation(t, conn, map[string]interface{}{"return_message_ids": true})
+	assert.Equal(t, r.ReturnMessageIDs, true)
+
+	pub := func(cmd *nsq.Command) (int32, []byte) {
+		err := cmd.Write(conn)
+		assert.Equal(t, err, nil)
+		resp, err := nsq.ReadResponse(conn)
+		assert.Equal(t, err, nil)
+		frameType, data, err := nsq.UnpackResponse(resp)
+		assert.Equal(t, err, nil)
+		return frameType, data
+	}
+
+	frameType, data := pub(nsq.Publish(topicName, []byte("test body")))
+	assert.Equal(t, frameType, nsq.FrameTypeResponse)
+	assert.Equal(t, len(data), nsq.MsgIdLength)
+	generatedID := string(data)
+
+	id := []byte("producer-id-0001")
+	cmd := &nsq.Command{Name: []byte("PUB"), Params: [][]byte{[]byte(topicName), id}, Body: []byte("test body")}
+	frameType, data = pub(cmd)
+	assert.Equal(t, frameType, nsq.FrameTypeResponse)
+	assert.Equal(t, data, id)
+
+	// IDs must be unique within the topic's recent messages (and the
+	// connection remains usable)
+	frameType, data = pub(cmd)
+	assert.Equal(t, frameType, nsq.FrameTypeError)
+	assert.Equal(t, string(data), "E_DUPLICATE_ID PUB failed duplicate message ID producer-id-0001")
+
+	cmd, _ = nsq.MultiPublish(topicName, [][]byte{[]byte("body 2"), []byte("body 3")})
+	cmd.Params = append(cmd.Params, []byte("producer-id-0002"), []byte("producer-id-0003"))
+	frameType, data = pub(cmd)
+	assert.Equal(t, frameType, nsq.FrameTypeResponse)
+	assert.Equal(t, string(data), "producer-id-0002producer-id-0003")
+
+	cmd.Params = [][]byte{[]byte(topicName), []byte("producer-id-0004"), []byte(generatedID)}
+	frameType, data = pub(cmd)
+	assert.Equal(t, frameType, nsq.FrameTypeError)
+	assert.Equal(t, string(data), "E_DUPLICATE_ID MPUB failed duplicate message ID")
+
+	cmd = &nsq.Command{Name: []byte("PUB"), Params: [][]byte{[]byte(topicName), []byte("bad-id")}, Body: []byte("test body")}
+	frameType, data = pub(cmd)
+	assert.Equal(t, frameType, nsq.FrameTypeError)
+	assert.Equal(t, string(data), "E_INVALID PUB invalid message ID bad-id")
+	conn.Close()
+
+	endpoint := fmt.Sprintf("http://%s/put?topic=%s&return_ids=true&id=producer-id-0005", httpAddr, topicName)
+	resp, err := http.Post(endpoint, "application/octet-stream", bytes.NewBufferString("test body"))
+	assert.Equal(t, err, nil)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, string(body), "producer-id-0005")
+
+	endpoint = fmt.Sprintf("http://%s/mput?topic=%s&return_ids=true", httpAddr, topicName)
+	resp, err = http.Post(endpoint, "application/octet-stream", bytes.NewBufferString("body 6\nbody 7"))
+	assert.Equal(t, err, nil)
+	body, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, len(bytes.Split(body, []byte("\n"))), 2)
+
+	conn, err = mustConnectNSQd(tcpAddr)
+	assert.Equal(t, err, nil)
+	identify(t, conn)
+	sub(t, conn, topicName, "ch")
+	err = nsq.Ready(5).Write(conn)
+	assert.Equal(t, err, nil)
+
+	ids := []string{generatedID, "producer-id-0001", "producer-id-0002", "producer-id-0003", "producer-id-0005"}
+	for _, id := range ids {
+		msg := readMessage(t, conn)
+		assert.Equal(t, string(msg.Id[:]), id)
+	}
+}
+
+func TestDedupPublish(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	options := testNsqdOptions()
+	tcpAddr, httpAddr := mustStartNSQd(options)
+	defer nsqd.Exit()
+
+	topicName := "test_dedup_pub" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	topic.GetChannel("ch")
+
+	conn, err := mustConnectNSQd(tcpAddr)
+	assert.Equal(t, err, nil)
+	identifyFeatureNegotiation(t, conn, map[string]interface{}{
+		"message_version":    nsq.MessageVersion2,
+		"return_message_ids": true,
+	})
+
+	body, _ := nsq.PackHeaders(map[string]string{nsq.DedupKeyHeader: "key1"}, []byte("test body"))
+	cmd, _ := nsq.MultiPublish(topicName, [][]byte{body, body})
+	err = cmd.Write(conn)
+	assert.Equal(t, err, nil)
+	resp, _ := nsq.ReadResponse(conn)
+	frameType, data, _ := nsq.UnpackResponse(resp)
+	assert.Equal(t, frameType, nsq.FrameTypeResponse)
+	// the duplicate is dropped but has the ID of the original
+	assert.Equal(t, len(data), 2*nsq.MsgIdLength)
+	assert.Equal(t, data[:nsq.MsgIdLength], data[nsq.MsgIdLength:])
+	conn.Close()
+
+	endpoint := fmt.Sprintf("http://%s/put?topic=%s&dedup_key=key1", httpAddr, topicName)
+	httpResp, err := http.Post(endpoint, "application/octet-stream", bytes.NewBufferString("test body"))
+	assert.Equal(t, err, nil)
+	httpResp.Body.Close()
+	assert.Equal(t, httpResp.StatusCode, 200)
+
+	assert.Equal(t, atomic.LoadUint64(&topic.messageCount), uint64(1))
+	assert.Equal(t, atomic.LoadUint64(&topic.dedup.hitCount), uint64(2))
+	assert.Equal(t, atomic.LoadUint64(&topic.dedup.missCount), uint64(1))
+}
+
+func TestTLS(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	options := testNsqdOptions()
+	options.tlsCert = "./test/cert.pem"
+	options.tlsKey = "./test/key.pem"
+	tcpAddr, _ := mustStartNSQd(options)
+	defer nsqd.Exit()
+
+	topicName := "test_tls" + strconv.Itoa(int(time.Now().Unix()))
+
+	conn, err := mustConnectNSQd(tcpAddr)
+	assert.Equal(t, err, nil)
+
+	r := identifyFeatureNegotiation(t, conn, map[string]interface{}{"tls_v1": true})
+	assert.Equal(t, r.TLSv1, true)
+
+	tlsConn := tls.Client(conn, &tls.Config{InsecureSkipVerify: true})
+	err = tlsConn.Handshake()
+	assert.Equal(t, err, nil)
+	readValidateOK(t, tlsConn)
+
+	sub(t, tlsConn, topicName, "ch")
+
+	channel, err := nsqd.GetTopic(topicName).GetExistingChannel("ch")
+	assert.Equal(t, err, nil)
+	channel.RLock()
+	clientStats := channel.clients[0].Stats()
+	channel.RUnlock()
+	assert.Equal(t, clientStats.TLS, true)
+}
+
+func TestTLSNotConfigured(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	options := testNsqdOptions()
+	tcpAddr, _ := mustStartNSQd(options)
+	defer nsqd.Exit()
+
+	topicName := "test_tls_plain" + strconv.Itoa(int(time.Now().Unix()))
+
+	conn, err := mustConnectNSQd(tcpAddr)
+	assert.Equal(t, err, nil)
+
+	// the connection continues in plaintext
+	r := identifyFeatureNegotiation(t, conn, map[string]interface{}{"tls_v1": true})
+	assert.Equal(t, r.TLSv1, false)
+	sub(t, conn, topicName, "ch")
+}
+
+// compressedConn wraps a net.Conn to (de)compress data as a client would
+// after negotiating compression
+type compressedConn struct {
+	net.Conn
+	r io.Reader
+	w interface {
+		io.Writer
+		Flush() error
+	}
+}
+
+func (c *compressedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *compressedConn) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	if err != nil {
+		return n, err
+	}
+	return n, c.w.Flush()
+}
+
+func TestDeflate(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	options := testNsqdOptions()
+	tcpAddr, _ := mustStartNSQd(options)
+	defer nsqd.Exit()
+
+	topicName := "test_deflate" + strconv.Itoa(int(time.Now().Unix()))
+
+	conn, err := mustConnectNSQd(tcpAddr)
+	assert.Equal(t, err, nil)
+
+	// the requested level is capped by --max-deflate-level
+	r := identifyFeatureNegotiation(t, conn, map[string]interface{}{"deflate": true, "deflate_level": 9})
+	assert.Equal(t, r.Deflate, true)
+	assert.Equal(t, r.DeflateLevel, 6)
+	assert.Equal(t, r.Snappy, false)
+
+	fw, _ := flate.NewWriter(conn, 6)
+	compressConn := &compressedConn{Conn: conn, r: flate.NewReader(conn), w: fw}
+	readValidateOK(t, compressConn)
+
+	sub(t, compressConn, topicName, "ch")
+
+	channel, err := nsqd.GetTopic(topicName).GetExistingChannel("ch")
+	assert.Equal(t, err, nil)
+	channel.RLock()
+	clientStats := channel.clients[0].Stats()
+	channel.RUnlock()
+	assert.Equal(t, clientStats.Deflate, true)
+	assert.Equal(t, clientStats.CompressedBytesReceived > 0, true)
+	assert.Equal(t, clientStats.UncompressedBytesReceived > 0, true)
+	assert.Equal(t, clientStats.CompressedBytesSent > 0, true)
+	assert.Equal(t, clientStats.UncompressedBytesSent > 0, true)
+}
+
+func TestSnappy(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	options := testNsqdOptions()
+	tcpAddr, _ := mustStartNSQd(options)
+	defer nsqd.Exit()
+
+	topicName := "test_snappy" + strconv.Itoa(int(time.Now().Unix()))
+
+	conn, err := mustConnectNSQd(tcpAddr)
+	assert.Equal(t, err, nil)
+
+	r := identifyFeatureNegotiation(t, conn, map[string]interface{}{"snappy": true})
+	assert.Equal(t, r.Snappy, true)
+	assert.Equal(t, r.Deflate, false)
+
+	compressConn := &compressedConn{Conn: conn, r: snappy.NewReader(conn), w: snappy.NewBufferedWriter(conn)}
+	readValidateOK(t, compressConn)
+
+	sub(t, compressConn, topicName, "ch")
+
+	// a message is delivered (compressed) end to end
+	msg := nsq.NewMessage(<-nsqd.idChan, []byte("test body"))
+	topic := nsqd.GetTopic(topicName)
+	topic.PutMessage(msg)
+
+	err = nsq.Ready(1).Write(compressConn)
+	assert.Equal(t, err, nil)
+
+	resp, err := nsq.ReadResponse(compressConn)
+	assert.Equal(t, err, nil)
+	frameType, data, err := nsq.UnpackResponse(resp)
+	msgOut, _ := nsq.DecodeMessage(data)
+	assert.Equal(t, frameType, nsq.FrameTypeMessage)
+	assert.Equal(t, msgOut.Body, []byte("test body"))
+
+	channel, err := topic.GetExistingChannel("ch")
+	assert.Equal(t, err, nil)
+	channel.RLock()
+	clientStats := channel.clients[0].Stats()
+	channel.RUnlock()
+	assert.Equal(t, clientStats.Snappy, true)
+}
+
+func TestDeflateAndSnappy(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	options := testNsqdOptions()
+	tcpAddr, _ := mustStartNSQd(options)
+	defer nsqd.Exit()
+
+	conn, err := mustConnectNSQd(tcpAddr)
+	assert.Equal(t, err, nil)
+
+	ci := make(map[string]interface{})
+	ci["deflate"] = true
+	ci["snappy"] = true
+	cmd, _ := nsq.Identify(ci)
+	err = cmd.Write(conn)
+	assert.Equal(t, err, nil)
+
+	resp, err := nsq.ReadResponse(conn)
+	assert.Equal(t, err, nil)
+	frameType, data, err := nsq.UnpackResponse(resp)
+	assert.Equal(t, frameType, nsq.FrameTypeError)
+	assert.Equal(t, string(data), "E_INVALID IDENTIFY cannot enable both deflate and snappy compression")
+}
+
+func BenchmarkProtocolV2Exec(b *testing.B) {
+	b.StopTimer()
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+	p := &ProtocolV2{}
+	c := NewClientV2(nil)
+	params := [][]byte{[]byte("NOP")}
+	b.StartTimer()
+
+	for i := 0; i < b.N; i++ {
+		p.Exec(c, params)
+	}
+}
+
+func benchmarkProtocolV2Pub(b *testing.B, size int) {
+	var wg sync.WaitGroup
+	b.StopTimer()
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+	options := testNsqdOptions()
+	options.memQueueSize = int64(b.N)
+	tcpAddr, _ := mustStartNSQd(options)
+	msg := make([]byte, size)
+	batchSize := 200
+	batch := make([][]byte, 0)
+	for i := 0; i < batchSize; i++ {
+		batch = append(batch, msg)
+	}
+	topicName := "bench_v2_pub" + strconv.Itoa(int(time.Now().Unix()))
+	b.SetBytes(int64(len(msg)))
+	b.StartTimer()
+
+	for j := 0; j < runtime.GOMAXPROCS(0); j++ {
+		wg.Add(1)
+		go func() {
+			conn, err := mustConnectNSQd(tcpAddr)
+			if err != nil {
+				panic(err.Error())
+			}
+			rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+
+			num := b.N / runtime.GOMAXPROCS(0) / batchSize
+			for i := 0; i < num; i += 1 {
+				cmd, _ := nsq.MultiPublish(topicName, batch)
+				err := cmd.Write(rw)
+				if err != nil {
+					panic(err.Error())
+				}
+				err = rw.Flush()
+				if err != nil {
+					panic(err.Error())
+				}
+				resp, err := nsq.ReadResponse(rw)
+				if err != nil {
+					panic(err.Error())
+				}
+				_, data, _ := nsq.UnpackResponse(resp)
+				if !bytes.Equal(data, []byte("OK")) {
+					panic("invalid response")
+				}
+			}
+			wg.Done()
+		}()
+	}
+
+	wg.Wait()
+
+	b.StopTimer()
+	nsqd.Exit()
+}
+
+func BenchmarkProtocolV2Pub256(b *testing.B)  { benchmarkProtocolV2Pub(b, 256) }
+func BenchmarkProtocolV2Pub512(b *testing.B)  { benchmarkProtocolV2Pub(b, 512) }
+func BenchmarkProtocolV2Pub1k(b *testing.B)   { benchmarkProtocolV2Pub(b, 1024) }
+func BenchmarkProtocolV2Pub2k(b *testing.B)   { benchmarkProtocolV2Pub(b, 2*1024) }
+func BenchmarkProtocolV2Pub4k(b *testing.B)   { benchmarkProtocolV2Pub(b, 4*1024) }
+func BenchmarkProtocolV2Pub8k(b *testing.B)   { benchmarkProtocolV2Pub(b, 8*1024) }
+func BenchmarkProtocolV2Pub16k(b *testing.B)  { benchmarkProtocolV2Pub(b, 16*1024) }
+func BenchmarkProtocolV2Pub32k(b *testing.B)  { benchmarkProtocolV2Pub(b, 32*1024) }
+func BenchmarkProtocolV2Pub64k(b *testing.B)  { benchmarkProtocolV2Pub(b, 64*1024) }
+func BenchmarkProtocolV2Pub128k(b *testing.B) { benchmarkProtocolV2Pub(b, 128*1024) }
+func BenchmarkProtocolV2Pub256k(b *testing.B) { benchmarkProtocolV2Pub(b, 256*1024) }
+func BenchmarkProtocolV2Pub512k(b *testing.B) { benchmarkProtocolV2Pub(b, 512*1024) }
+func BenchmarkProtocolV2Pub1m(b *testing.B)   { benchmarkProtocolV2Pub(b, 1024*1024) }
+
+func benchmarkProtocolV2Sub(b *testing.B, size int) {
+	var wg sync.WaitGroup
+	b.StopTimer()
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+	options := testNsqdOptions()
+	options.memQueueSize = int64(b.N)
+	tcpAddr, _ := mustStartNSQd(options)
+	msg := make([]byte, size)
+	topicName := "bench_v2_sub" + strconv.Itoa(b.N) + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	for i := 0; i < b.N; i++ {
+		msg := nsq.NewMessage(<-nsqd.idChan, msg)
+		topic.PutMessage(msg)
+	}
+	topic.GetChannel("ch")
+	b.SetBytes(int64(len(msg)))
+	goChan := make(chan int)
+	rdyChan := make(chan int)
+	workers := runtime.GOMAXPROCS(0)
+	for j := 0; j < workers; j++ {
+		wg.Add(1)
+		go func() {
+			subWorker(b.N, workers, tcpAddr, topicName, rdyChan, goChan)
+			wg.Done()
+		}()
+		<-rdyChan
+	}
+	b.StartTimer()
+
+	close(goChan)
+	wg.Wait()
+
+	b.StopTimer()
+	nsqd.Exit()
+}
+
+func subWorker(n int, workers int, tcpAddr *net.TCPAddr, topicName string, rdyChan chan int, goChan chan int) {
+	conn, err := mustConnectNSQd(tcpAddr)
+	if err != nil {
+		panic(err.Error())
+	}
+	rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+
+	identify(nil, conn)
+	sub(nil, conn, topicName, "ch")
+
+	rdyCount := int(math.Min(math.Max(float64(n/workers), 1), 2500))
+	rdyChan <- 1
+	<-goChan
+	nsq.Ready(rdyCount).Write(rw)
+	rw.Flush()
+	num := n / workers
+	numRdy := num/rdyCount - 1
+	rdy := rdyCount
+	for i := 0; i < num; i += 1 {
+		resp, err := nsq.ReadResponse(rw)
+		if err != nil {
+			panic(err.Error())
+		}
+		frameType, data, err := nsq.UnpackResponse(resp)
+		if err != nil {
+			panic(err.Error())
+		}
+		if frameType != nsq.FrameTypeMessage {
+			panic("got something else")
 		}
 		msg, err := nsq.DecodeMessage(data)
 		if err != nil {
@@ -679,7 +1722,7 @@ func benchmarkProtocolV2MultiSub(b *testing.B, num int) {
 	log.SetOutput(ioutil.Discard)
 	log.SetOutput(os.Stdout)
 
-	options := NewNsqdOptions()
+	options := testNsqdOptions()
 	options.memQueueSize = int64(b.N)
 	tcpAddr, _ := mustStartNSQd(options)
 	msg := make([]byte, 256)
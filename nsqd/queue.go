@@ -3,34 +3,58 @@ package main
 import (
 	"bytes"
 	"github.com/bitly/nsq/nsq"
+	"strconv"
+	"time"
 )
 
 // BackendQueue represents the behavior for the secondary message
 // storage system
 type BackendQueue interface {
 	Put([]byte) error
+	PutBatch([][]byte) error
 	ReadChan() chan []byte // this is expected to be an *unbuffered* channel
+	IdleChan() chan int    // receives when there is nothing left to read
+	Peek(int) ([][]byte, error)
 	Close() error
 	Depth() int64
 	Empty() error
+	CorruptCount() int64
+	SetSyncEveryWrite(bool)
+	LastSync() time.Time
 }
 
 type DummyBackendQueue struct {
 	readChan chan []byte
+	idleChan chan int
 }
 
 func NewDummyBackendQueue() BackendQueue {
-	return &DummyBackendQueue{readChan: make(chan []byte)}
+	// there is never anything to read
+	idleChan := make(chan int)
+	close(idleChan)
+	return &DummyBackendQueue{readChan: make(chan []byte), idleChan: idleChan}
 }
 
 func (d *DummyBackendQueue) Put([]byte) error {
 	return nil
 }
 
+func (d *DummyBackendQueue) PutBatch([][]byte) error {
+	return nil
+}
+
 func (d *DummyBackendQueue) ReadChan() chan []byte {
 	return d.readChan
 }
 
+func (d *DummyBackendQueue) IdleChan() chan int {
+	return d.idleChan
+}
+
+func (d *DummyBackendQueue) Peek(limit int) ([][]byte, error) {
+	return nil, nil
+}
+
 func (d *DummyBackendQueue) Close() error {
 	return nil
 }
@@ -43,9 +67,30 @@ func (d *DummyBackendQueue) Empty() error {
 	return nil
 }
 
+func (d *DummyBackendQueue) CorruptCount() int64 {
+	return int64(0)
+}
+
+func (d *DummyBackendQueue) SetSyncEveryWrite(enabled bool) {
+}
+
+func (d *DummyBackendQueue) LastSync() time.Time {
+	return time.Time{}
+}
+
+// the header the absolute time (unix ns) a deferred message is due is
+// persisted in while it's in a backend (it is removed when read back)
+const deferredUntilHeader = "_nsqd_deferred_until"
+
+// the number of bytes a serialized message adds to its body
+// (2-byte version, 8-byte timestamp, 2-byte attempts, the id, and the
+// deferredUntilHeader of a deferred message), the headers of a message are
+// part of the published body it's bounded by
+const messageOverhead = int64(2 + 8 + 2 + nsq.MsgIdLength + 2 + 2 + len(deferredUntilHeader) + 2 + 20)
+
 func WriteMessageToBackend(buf *bytes.Buffer, msg *nsq.Message, bq BackendQueue) error {
 	buf.Reset()
-	err := msg.Write(buf)
+	err := writeBackendMessage(buf, msg)
 	if err != nil {
 		return err
 	}
@@ -55,3 +100,71 @@ func WriteMessageToBackend(buf *bytes.Buffer, msg *nsq.Message, bq BackendQueue)
 	}
 	return nil
 }
+
+// WriteMessagesToBackend serializes messages into buf and writes them to
+// the backend as a single batch
+func WriteMessagesToBackend(buf *bytes.Buffer, msgs []*nsq.Message, bq BackendQueue) error {
+	buf.Reset()
+	offsets := make([]int, len(msgs)+1)
+	for i, msg := range msgs {
+		err := writeBackendMessage(buf, msg)
+		if err != nil {
+			return err
+		}
+		offsets[i+1] = buf.Len()
+	}
+
+	data := make([][]byte, len(msgs))
+	b := buf.Bytes()
+	for i := range msgs {
+		data[i] = b[offsets[i]:offsets[i+1]]
+	}
+
+	return bq.PutBatch(data)
+}
+
+// writeBackendMessage serializes msg, along with the time it is due if it
+// is deferred
+func writeBackendMessage(buf *bytes.Buffer, msg *nsq.Message) error {
+	if msg.Deferred <= 0 {
+		return msg.Write(buf)
+	}
+
+	deferredMsg := *msg
+	deferredMsg.Headers = make(map[string]string, len(msg.Headers)+1)
+	for k, v := range msg.Headers {
+		deferredMsg.Headers[k] = v
+	}
+	due := time.Now().Add(msg.Deferred).UnixNano()
+	deferredMsg.Headers[deferredUntilHeader] = strconv.FormatInt(due, 10)
+	return deferredMsg.Write(buf)
+}
+
+// decodeBackendMessage deserializes a message read from a backend, restoring
+// the remaining delay of a deferred message
+func decodeBackendMessage(data []byte) (*nsq.Message, error) {
+	msg, err := nsq.DecodeMessage(data)
+	if err != nil {
+		return nil, err
+	}
+
+	dueStr, ok := msg.Headers[deferredUntilHeader]
+	if !ok {
+		return msg, nil
+	}
+	delete(msg.Headers, deferredUntilHeader)
+	if len(msg.Headers) == 0 {
+		msg.Headers = nil
+	}
+
+	due, err := strconv.ParseInt(dueStr, 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	msg.Deferred = time.Unix(0, due).Sub(time.Now())
+	if msg.Deferred < 0 {
+		msg.Deferred = 0
+	}
+
+	return msg, nil
+}
@@ -2,54 +2,88 @@ package main
 
 import (
 	"sort"
+	"sync/atomic"
+	"time"
 )
 
 type TopicStats struct {
-	TopicName    string         `json:"topic_name"`
-	Channels     []ChannelStats `json:"channels"`
-	Depth        int64          `json:"depth"`
-	BackendDepth int64          `json:"backend_depth"`
-	MessageCount uint64         `json:"message_count"`
+	TopicName           string         `json:"topic_name"`
+	Channels            []ChannelStats `json:"channels"`
+	Depth               int64          `json:"depth"`
+	BackendDepth        int64          `json:"backend_depth"`
+	BackendCorruptCount int64          `json:"backend_corrupt_count"`
+	BackendLastSyncAge  int64          `json:"backend_last_sync_age_ms"`
+	SyncEveryWrite      bool           `json:"sync_every_write"`
+	MessageCount        uint64         `json:"message_count"`
+	DedupHitCount       uint64         `json:"dedup_hit_count"`
+	DedupMissCount      uint64         `json:"dedup_miss_count"`
 }
 
 func NewTopicStats(t *Topic, channels []ChannelStats) TopicStats {
 	return TopicStats{
-		TopicName:    t.name,
-		Channels:     channels,
-		Depth:        t.Depth(),
-		BackendDepth: t.backend.Depth(),
-		MessageCount: t.messageCount,
+		TopicName:           t.name,
+		Channels:            channels,
+		Depth:               t.Depth(),
+		BackendDepth:        t.backend.Depth(),
+		BackendCorruptCount: t.backend.CorruptCount(),
+		BackendLastSyncAge:  lastSyncAge(t.backend),
+		SyncEveryWrite:      t.SyncEveryWrite(),
+		MessageCount:        t.messageCount,
+		DedupHitCount:       atomic.LoadUint64(&t.dedup.hitCount),
+		DedupMissCount:      atomic.LoadUint64(&t.dedup.missCount),
 	}
 }
 
 type ChannelStats struct {
-	ChannelName   string        `json:"channel_name"`
-	Depth         int64         `json:"depth"`
-	BackendDepth  int64         `json:"backend_depth"`
-	InFlightCount int           `json:"in_flight_count"`
-	DeferredCount int           `json:"deferred_count"`
-	MessageCount  uint64        `json:"message_count"`
-	RequeueCount  uint64        `json:"requeue_count"`
-	TimeoutCount  uint64        `json:"timeout_count"`
-	Clients       []ClientStats `json:"clients"`
-	Paused        bool          `json:"paused"`
+	ChannelName            string        `json:"channel_name"`
+	Depth                  int64         `json:"depth"`
+	BackendDepth           int64         `json:"backend_depth"`
+	BackendCorruptCount    int64         `json:"backend_corrupt_count"`
+	BackendLastSyncAge     int64         `json:"backend_last_sync_age_ms"`
+	InFlightCount          int           `json:"in_flight_count"`
+	DeferredCount          int           `json:"deferred_count"`
+	MessageCount           uint64        `json:"message_count"`
+	RequeueCount           uint64        `json:"requeue_count"`
+	TimeoutCount           uint64        `json:"timeout_count"`
+	DisconnectRequeueCount uint64        `json:"disconnect_requeue_count"`
+	DeadLetterDepth        int64         `json:"dead_letter_depth"`
+	MaxAttempts            uint16        `json:"max_attempts"`
+	Ordered                bool          `json:"ordered"`
+	Clients                []ClientStats `json:"clients"`
+	Paused                 bool          `json:"paused"`
 }
 
 func NewChannelStats(c *Channel, clients []ClientStats) ChannelStats {
 	return ChannelStats{
-		ChannelName:   c.name,
-		Depth:         c.Depth(),
-		BackendDepth:  c.backend.Depth(),
-		InFlightCount: len(c.inFlightMessages),
-		DeferredCount: len(c.deferredMessages),
-		MessageCount:  c.messageCount,
-		RequeueCount:  c.requeueCount,
-		TimeoutCount:  c.timeoutCount,
-		Clients:       clients,
-		Paused:        c.IsPaused(),
+		ChannelName:            c.name,
+		Depth:                  c.Depth(),
+		BackendDepth:           c.backend.Depth(),
+		BackendCorruptCount:    c.backend.CorruptCount(),
+		BackendLastSyncAge:     lastSyncAge(c.backend),
+		InFlightCount:          len(c.inFlightMessages),
+		DeferredCount:          len(c.deferredMessages),
+		MessageCount:           c.messageCount,
+		RequeueCount:           c.requeueCount,
+		TimeoutCount:           c.timeoutCount,
+		DisconnectRequeueCount: c.disconnectRequeueCount,
+		DeadLetterDepth:        c.DeadLetterDepth(),
+		MaxAttempts:            c.MaxAttempts(),
+		Ordered:                c.IsOrdered(),
+		Clients:                clients,
+		Paused:                 c.IsPaused(),
 	}
 }
 
+// lastSyncAge returns the milliseconds since the backend last synced to disk
+// (0 for backends that don't)
+func lastSyncAge(bq BackendQueue) int64 {
+	lastSync := bq.LastSync()
+	if lastSync.IsZero() {
+		return 0
+	}
+	return int64(time.Now().Sub(lastSync) / time.Millisecond)
+}
+
 type ClientStats struct {
 	Version       string `json:"version"`
 	RemoteAddress string `json:"remote_address"`
@@ -61,6 +95,19 @@ type ClientStats struct {
 	FinishCount   uint64 `json:"finish_count"`
 	RequeueCount  uint64 `json:"requeue_count"`
 	ConnectTime   int64  `json:"connect_ts"`
+	TLS           bool   `json:"tls"`
+	Deflate       bool   `json:"deflate"`
+	Snappy        bool   `json:"snappy"`
+	SampleRate    int32  `json:"sample_rate"`
+
+	Authed          bool   `json:"authed"`
+	AuthIdentity    string `json:"auth_identity,omitempty"`
+	AuthIdentityURL string `json:"auth_identity_url,omitempty"`
+
+	CompressedBytesReceived   uint64 `json:"compressed_bytes_received"`
+	UncompressedBytesReceived uint64 `json:"uncompressed_bytes_received"`
+	CompressedBytesSent       uint64 `json:"compressed_bytes_sent"`
+	UncompressedBytesSent     uint64 `json:"uncompressed_bytes_sent"`
 }
 
 type Topics []*Topic
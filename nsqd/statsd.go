@@ -76,6 +76,10 @@ func statsdLoop(addr string, prefix string, interval int) {
 					stat = fmt.Sprintf("topic.%s.channel.%s.timeout_count", topic.TopicName, channel.ChannelName)
 					statsd.Incr(stat, int(diff))
 
+					diff = channel.DisconnectRequeueCount - lastChannel.DisconnectRequeueCount
+					stat = fmt.Sprintf("topic.%s.channel.%s.disconnect_requeue_count", topic.TopicName, channel.ChannelName)
+					statsd.Incr(stat, int(diff))
+
 					stat = fmt.Sprintf("topic.%s.channel.%s.clients", topic.TopicName, channel.ChannelName)
 					statsd.Gauge(stat, len(channel.Clients))
 				}
@@ -3,27 +3,46 @@ package main
 import (
 	"bytes"
 	"errors"
+	"fmt"
 	"github.com/bitly/nsq/nsq"
 	"github.com/bitly/nsq/util"
 	"log"
+	"os"
+	"path"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
+// errDuplicateMessageID is returned by PutMessage(s) when a message's ID is
+// among the topic's recent messages
+var errDuplicateMessageID = errors.New("duplicate message ID")
+
 type Topic struct {
 	sync.RWMutex
 	name               string
 	channelMap         map[string]*Channel
 	backend            BackendQueue
-	incomingMsgChan    chan *nsq.Message
+	incomingMsgChan    chan []*nsq.Message
 	memoryMsgChan      chan *nsq.Message
 	messagePumpStarter *sync.Once
 	exitChan           chan int
 	waitGroup          util.WaitGroupWrapper
 	exitFlag           int32
 	messageCount       uint64
+	syncEveryWrite     int32
 	notifier           Notifier
 	options            *nsqdOptions
+
+	// the IDs of the last --max-recent-ids messages
+	recentIDs *idWindow
+
+	// the dedup keys of the messages published within the last --dedup-window
+	dedup *dedupIndex
+
+	// serializes the dedup and recent ID checks of concurrent publishes, so
+	// that a duplicate is only acknowledged once its original was accepted
+	publishMutex sync.Mutex
 }
 
 // Topic constructor
@@ -31,16 +50,23 @@ func NewTopic(topicName string, options *nsqdOptions, notifier Notifier) *Topic
 	topic := &Topic{
 		name:               topicName,
 		channelMap:         make(map[string]*Channel),
-		backend:            NewDiskQueue(topicName, options.dataPath, options.maxBytesPerFile, options.syncEvery),
-		incomingMsgChan:    make(chan *nsq.Message, 1),
+		backend:            NewDiskQueue(topicName, options.dataPath, options.maxBytesPerFile, options.maxMessageSize+messageOverhead, options.syncEvery, options.syncTimeout),
+		incomingMsgChan:    make(chan []*nsq.Message, 1),
 		memoryMsgChan:      make(chan *nsq.Message, options.memQueueSize),
 		notifier:           notifier,
 		options:            options,
 		exitChan:           make(chan int),
 		messagePumpStarter: new(sync.Once),
+		recentIDs:          newIDWindow(options.maxRecentIDs),
+		dedup:              newDedupIndex(options.dedupWindow, options.maxDedupKeys),
 	}
 
+	topic.loadDedupKeys()
+
 	topic.waitGroup.Wrap(func() { topic.router() })
+	if topic.dedup.Enabled() {
+		topic.waitGroup.Wrap(func() { topic.dedupSyncLoop() })
+	}
 
 	go notifier.Notify(topic)
 
@@ -69,6 +95,7 @@ func (t *Topic) getOrCreateChannel(channelName string) *Channel {
 			t.DeleteExistingChannel(c.name)
 		}
 		channel = NewChannel(t.name, channelName, t.options, t.notifier, deleteCallback)
+		channel.backend.SetSyncEveryWrite(t.SyncEveryWrite())
 		t.channelMap[channelName] = channel
 		log.Printf("TOPIC(%s): new channel(%s)", t.name, channel.name)
 		// start the topic message pump lazily using a `once` on the first channel creation
@@ -77,6 +104,28 @@ func (t *Topic) getOrCreateChannel(channelName string) *Channel {
 	return channel
 }
 
+// SetSyncEveryWrite sets whether or not messages written to disk (for this topic
+// and its channels) are synced before the write returns
+func (t *Topic) SetSyncEveryWrite(enabled bool) {
+	t.Lock()
+	defer t.Unlock()
+
+	if enabled {
+		atomic.StoreInt32(&t.syncEveryWrite, 1)
+	} else {
+		atomic.StoreInt32(&t.syncEveryWrite, 0)
+	}
+
+	t.backend.SetSyncEveryWrite(enabled)
+	for _, channel := range t.channelMap {
+		channel.backend.SetSyncEveryWrite(enabled)
+	}
+}
+
+func (t *Topic) SyncEveryWrite() bool {
+	return atomic.LoadInt32(&t.syncEveryWrite) == 1
+}
+
 func (t *Topic) GetExistingChannel(channelName string) (*Channel, error) {
 	t.RLock()
 	defer t.RUnlock()
@@ -110,26 +159,38 @@ func (t *Topic) DeleteExistingChannel(channelName string) error {
 
 // PutMessage writes to the appropriate incoming message channel
 func (t *Topic) PutMessage(msg *nsq.Message) error {
-	t.RLock()
-	defer t.RUnlock()
-	if atomic.LoadInt32(&t.exitFlag) == 1 {
-		return errors.New("exiting")
-	}
-	t.incomingMsgChan <- msg
-	atomic.AddUint64(&t.messageCount, 1)
-	return nil
+	return t.putMessages([]*nsq.Message{msg}, false)
 }
 
 func (t *Topic) PutMessages(messages []*nsq.Message) error {
+	return t.putMessages(messages, false)
+}
+
+// putMessages quietly drops messages whose dedup key was already published and
+// checks that the IDs of the rest are unique among the topic's recent messages,
+// unless they're being requeued (ie. they've already been put to the topic)
+func (t *Topic) putMessages(messages []*nsq.Message, requeued bool) error {
 	t.RLock()
 	defer t.RUnlock()
 	if atomic.LoadInt32(&t.exitFlag) == 1 {
 		return errors.New("exiting")
 	}
-	for _, m := range messages {
-		t.incomingMsgChan <- m
-		atomic.AddUint64(&t.messageCount, 1)
+	if !requeued {
+		t.publishMutex.Lock()
+		filtered := t.dedup.Filter(messages)
+		if !t.recentIDs.Add(filtered) {
+			t.dedup.Remove(filtered)
+			t.publishMutex.Unlock()
+			return errDuplicateMessageID
+		}
+		t.publishMutex.Unlock()
+		messages = filtered
+		if len(messages) == 0 {
+			return nil
+		}
 	}
+	t.incomingMsgChan <- messages
+	atomic.AddUint64(&t.messageCount, uint64(len(messages)))
 	return nil
 }
 
@@ -155,7 +216,7 @@ func (t *Topic) messagePump() {
 		select {
 		case msg = <-t.memoryMsgChan:
 		case buf = <-t.backend.ReadChan():
-			msg, err = nsq.DecodeMessage(buf)
+			msg, err = decodeBackendMessage(buf)
 			if err != nil {
 				log.Printf("ERROR: failed to decode message - %s", err.Error())
 				continue
@@ -170,7 +231,7 @@ func (t *Topic) messagePump() {
 			// put this message back on the queue
 			// we need to background because we currently hold the lock
 			go func() {
-				t.PutMessage(msg)
+				t.putMessages([]*nsq.Message{msg}, true)
 			}()
 
 			// reset the sync.Once
@@ -185,7 +246,12 @@ func (t *Topic) messagePump() {
 			// needs a unique instance
 			chanMsg := nsq.NewMessage(msg.Id, msg.Body)
 			chanMsg.Timestamp = msg.Timestamp
-			err := channel.PutMessage(chanMsg)
+			chanMsg.Headers = msg.Headers
+			if msg.Deferred > 0 {
+				err = channel.StartDeferredTimeout(chanMsg, msg.Deferred)
+			} else {
+				err = channel.PutMessage(chanMsg)
+			}
 			if err != nil {
 				log.Printf("TOPIC(%s) ERROR: failed to put msg(%s) to channel(%s) - %s", t.name, msg.Id, channel.name, err.Error())
 			}
@@ -201,22 +267,50 @@ exit:
 // proxying messages to memory or backend
 func (t *Topic) router() {
 	var msgBuf bytes.Buffer
-	for msg := range t.incomingMsgChan {
-		select {
-		case t.memoryMsgChan <- msg:
-		default:
-			err := WriteMessageToBackend(&msgBuf, msg, t.backend)
+	for msgs := range t.incomingMsgChan {
+		for i, msg := range msgs {
+			select {
+			case t.memoryMsgChan <- msg:
+				continue
+			default:
+			}
+
+			// the memory queue is full, write the remainder (of an MPUB) to the
+			// backend as a single batch
+			err := WriteMessagesToBackend(&msgBuf, msgs[i:], t.backend)
 			if err != nil {
-				log.Printf("ERROR: failed to write message to backend - %s", err.Error())
+				log.Printf("ERROR: failed to write messages to backend - %s", err.Error())
 				// theres not really much we can do at this point, you're certainly
 				// going to lose messages...
 			}
+			break
 		}
 	}
 
 	log.Printf("TOPIC(%s): closing ... router", t.name)
 }
 
+// dedupSyncLoop persists the dedup keys every --sync-timeout (if there were
+// any changes) so that, like the messages in the backend, they survive a crash
+func (t *Topic) dedupSyncLoop() {
+	syncTicker := time.NewTicker(t.options.syncTimeout)
+	for {
+		select {
+		case <-syncTicker.C:
+			err := t.dedup.persist(t.dedupFileName())
+			if err != nil {
+				log.Printf("ERROR: topic(%s) failed to persist dedup keys - %s", t.name, err.Error())
+			}
+		case <-t.exitChan:
+			goto exit
+		}
+	}
+
+exit:
+	log.Printf("TOPIC(%s): closing ... dedupSyncLoop", t.name)
+	syncTicker.Stop()
+}
+
 // Delete empties the topic and all its channels and closes
 func (t *Topic) Delete() error {
 	err := t.exit(true)
@@ -251,6 +345,7 @@ func (t *Topic) exit(deleted bool) error {
 	if deleted {
 		// empty the queue (deletes the backend files, too)
 		t.Empty()
+		os.Remove(t.dedupFileName())
 
 		t.Lock()
 		for _, channel := range t.channelMap {
@@ -270,11 +365,37 @@ func (t *Topic) exit(deleted bool) error {
 
 		// write anything leftover to disk
 		t.flush()
+
+		err := t.dedup.persist(t.dedupFileName())
+		if err != nil {
+			log.Printf("ERROR: topic(%s) failed to persist dedup keys - %s", t.name, err.Error())
+		}
 	}
 
 	return t.backend.Close()
 }
 
+func (t *Topic) dedupFileName() string {
+	return fmt.Sprintf(path.Join(t.options.dataPath, "%s.diskqueue.dedup.dat"), t.name)
+}
+
+// loadDedupKeys restores the dedup keys persisted when the topic was closed,
+// it is only called in NewTopic()
+func (t *Topic) loadDedupKeys() {
+	fileName := t.dedupFileName()
+	count, err := t.dedup.load(fileName)
+	if err != nil {
+		// move the file aside so that we don't load it again on the next restart
+		badFileName := fileName + ".bad"
+		log.Printf("ERROR: topic(%s) corrupt dedup keys file, renaming %s to %s - %s",
+			t.name, fileName, badFileName, err.Error())
+		os.Rename(fileName, badFileName)
+	}
+	if count > 0 {
+		log.Printf("TOPIC(%s): loaded %d dedup keys", t.name, count)
+	}
+}
+
 func (t *Topic) Empty() error {
 	for {
 		select {
@@ -16,7 +16,7 @@ func TestGetTopic(t *testing.T) {
 	log.SetOutput(ioutil.Discard)
 	defer log.SetOutput(os.Stdout)
 
-	nsqd := NewNSQd(1, NewNsqdOptions())
+	nsqd := NewNSQd(1, testNsqdOptions())
 	defer nsqd.Exit()
 
 	topic1 := nsqd.GetTopic("test")
@@ -35,7 +35,7 @@ func TestGetChannel(t *testing.T) {
 	log.SetOutput(ioutil.Discard)
 	defer log.SetOutput(os.Stdout)
 
-	nsqd := NewNSQd(1, NewNsqdOptions())
+	nsqd := NewNSQd(1, testNsqdOptions())
 	defer nsqd.Exit()
 
 	topic := nsqd.GetTopic("test")
@@ -54,7 +54,7 @@ func TestDeletes(t *testing.T) {
 	log.SetOutput(ioutil.Discard)
 	defer log.SetOutput(os.Stdout)
 
-	nsqd := NewNSQd(1, NewNsqdOptions())
+	nsqd := NewNSQd(1, testNsqdOptions())
 	defer nsqd.Exit()
 
 	topic := nsqd.GetTopic("test")
@@ -79,7 +79,7 @@ func TestDeleteLast(t *testing.T) {
 	log.SetOutput(ioutil.Discard)
 	defer log.SetOutput(os.Stdout)
 
-	nsqd := NewNSQd(1, NewNsqdOptions())
+	nsqd := NewNSQd(1, testNsqdOptions())
 	defer nsqd.Exit()
 
 	topic := nsqd.GetTopic("test")
@@ -103,7 +103,7 @@ func BenchmarkTopicPut(b *testing.B) {
 	log.SetOutput(ioutil.Discard)
 	defer log.SetOutput(os.Stdout)
 	topicName := "bench_topic_put" + strconv.Itoa(b.N)
-	options := NewNsqdOptions()
+	options := testNsqdOptions()
 	options.memQueueSize = int64(b.N)
 	nsqd := NewNSQd(1, options)
 	defer nsqd.Exit()
@@ -122,7 +122,7 @@ func BenchmarkTopicToChannelPut(b *testing.B) {
 	defer log.SetOutput(os.Stdout)
 	topicName := "bench_topic_to_channel_put" + strconv.Itoa(b.N)
 	channelName := "bench"
-	options := NewNsqdOptions()
+	options := testNsqdOptions()
 	options.memQueueSize = int64(b.N)
 	nsqd := NewNSQd(1, options)
 	defer nsqd.Exit()
@@ -142,3 +142,180 @@ func BenchmarkTopicToChannelPut(b *testing.B) {
 		runtime.Gosched()
 	}
 }
+
+func TestPutMessagesOverflow(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	options := testNsqdOptions()
+	options.memQueueSize = 2
+	nsqd := NewNSQd(1, options)
+	defer nsqd.Exit()
+
+	topicName := "test_put_messages_overflow" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+
+	var msgs []*nsq.Message
+	for i := 0; i < 10; i++ {
+		msgs = append(msgs, nsq.NewMessage(<-nsqd.idChan, []byte("test")))
+	}
+	err := topic.PutMessages(msgs)
+	assert.Equal(t, err, nil)
+
+	// the messages that didn't fit in memory were written to the backend together
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, int64(len(topic.memoryMsgChan)), int64(2))
+	assert.Equal(t, topic.backend.Depth(), int64(8))
+	assert.Equal(t, topic.messageCount, uint64(10))
+
+	channel := topic.GetChannel("ch")
+	for i := 0; i < 10; i++ {
+		select {
+		case <-channel.clientMsgChan:
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for message %d", i)
+		}
+	}
+	topic.DeleteExistingChannel("ch")
+}
+
+func TestIDWindow(t *testing.T) {
+	msg := func(id string) *nsq.Message {
+		var msgID nsq.MessageID
+		copy(msgID[:], id)
+		return nsq.NewMessage(msgID, nil)
+	}
+
+	w := newIDWindow(2)
+	assert.Equal(t, w.Add([]*nsq.Message{msg("a"), msg("b")}), true)
+	assert.Equal(t, w.Add([]*nsq.Message{msg("a")}), false)
+
+	// none of a batch with a duplicate are recorded
+	assert.Equal(t, w.Add([]*nsq.Message{msg("c"), msg("c")}), false)
+	assert.Equal(t, w.Add([]*nsq.Message{msg("c"), msg("b")}), false)
+	assert.Equal(t, len(w.set), 2)
+
+	// the oldest ID is evicted
+	assert.Equal(t, w.Add([]*nsq.Message{msg("c")}), true)
+	assert.Equal(t, w.Add([]*nsq.Message{msg("a")}), true)
+	assert.Equal(t, w.Add([]*nsq.Message{msg("b")}), true)
+	assert.Equal(t, w.Add([]*nsq.Message{msg("a")}), false)
+}
+
+func TestTopicRecentIDsNoMemQueue(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	// the IDs window doesn't depend on the memory queue
+	options := testNsqdOptions()
+	options.memQueueSize = 0
+	nsqd = NewNSQd(1, options)
+	defer nsqd.Exit()
+
+	topicName := "test_recent_ids" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+
+	id := <-nsqd.idChan
+	err := topic.PutMessage(nsq.NewMessage(id, []byte("test")))
+	assert.Equal(t, err, nil)
+	err = topic.PutMessage(nsq.NewMessage(id, []byte("test")))
+	assert.Equal(t, err, errDuplicateMessageID)
+}
+
+func TestDedupIndex(t *testing.T) {
+	msg := func(key string) *nsq.Message {
+		var msgID nsq.MessageID
+		copy(msgID[:], key+"_id")
+		m := nsq.NewMessage(msgID, nil)
+		if key != "" {
+			m.SetHeader(nsq.DedupKeyHeader, key)
+		}
+		return m
+	}
+
+	d := newDedupIndex(50*time.Millisecond, 2)
+	assert.Equal(t, len(d.Filter([]*nsq.Message{msg("a"), msg(""), msg("a")})), 2)
+
+	dup := msg("a")
+	dup.Id[0] = 'x'
+	assert.Equal(t, len(d.Filter([]*nsq.Message{dup})), 0)
+	// a duplicate takes the ID of the original
+	assert.Equal(t, string(dup.Id[:3]), "a_i")
+	assert.Equal(t, d.hitCount, uint64(2))
+	assert.Equal(t, d.missCount, uint64(1))
+
+	// bounded by max keys (the oldest is evicted)
+	d.Filter([]*nsq.Message{msg("b"), msg("c")})
+	assert.Equal(t, len(d.Filter([]*nsq.Message{msg("a")})), 1)
+	assert.Equal(t, len(d.keys), 2)
+
+	// bounded by the window
+	time.Sleep(60 * time.Millisecond)
+	assert.Equal(t, len(d.Filter([]*nsq.Message{msg("c")})), 1)
+}
+
+func TestTopicDedupPersistence(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	topicName := "test_dedup" + strconv.Itoa(int(time.Now().Unix()))
+
+	msg := func(id string) *nsq.Message {
+		var msgID nsq.MessageID
+		copy(msgID[:], id)
+		m := nsq.NewMessage(msgID, []byte("test body"))
+		m.SetHeader(nsq.DedupKeyHeader, "key")
+		return m
+	}
+
+	nsqd := NewNSQd(1, testNsqdOptions())
+	topic := nsqd.GetTopic(topicName)
+	topic.GetChannel("ch")
+	assert.Equal(t, topic.PutMessage(msg("0000000000000001")), nil)
+	assert.Equal(t, topic.PutMessage(msg("0000000000000002")), nil)
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, topic.messageCount, uint64(1))
+	stats := NewTopicStats(topic, nil)
+	assert.Equal(t, stats.DedupHitCount, uint64(1))
+	assert.Equal(t, stats.DedupMissCount, uint64(1))
+	nsqd.Exit()
+
+	// the dedup keys are restored along with the topic
+	nsqd = NewNSQd(1, testNsqdOptions())
+	topic = nsqd.GetTopic(topicName)
+	dup := msg("0000000000000003")
+	assert.Equal(t, topic.PutMessage(dup), nil)
+	assert.Equal(t, string(dup.Id[:]), "0000000000000001")
+	assert.Equal(t, topic.messageCount, uint64(0))
+	nsqd.DeleteExistingTopic(topicName)
+	nsqd.Exit()
+
+	_, err := os.Stat(topic.dedupFileName())
+	assert.Equal(t, os.IsNotExist(err), true)
+}
+
+func TestTopicDedupSync(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	options := testNsqdOptions()
+	options.syncTimeout = 10 * time.Millisecond
+	nsqd := NewNSQd(1, options)
+	defer nsqd.Exit()
+
+	topicName := "test_dedup_sync" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	msg := nsq.NewMessage(<-nsqd.idChan, []byte("test body"))
+	msg.SetHeader(nsq.DedupKeyHeader, "key")
+	assert.Equal(t, topic.PutMessage(msg), nil)
+
+	// the dedup keys are persisted periodically (ie. before the topic is closed)
+	time.Sleep(50 * time.Millisecond)
+	d := newDedupIndex(options.dedupWindow, options.maxDedupKeys)
+	count, err := d.load(topic.dedupFileName())
+	assert.Equal(t, err, nil)
+	assert.Equal(t, count, 1)
+	assert.Equal(t, d.keys["key"].id, msg.Id)
+
+	nsqd.DeleteExistingTopic(topicName)
+}
@@ -21,8 +21,8 @@ popd >/dev/null
 pushd nsqd >/dev/null
 go build
 rm -f *.dat
-echo "starting nsqd --data-path=/tmp --lookupd-tcp-address=127.0.0.1:4160"
-./nsqd --data-path=/tmp --lookupd-tcp-address=127.0.0.1:4160 >/dev/null 2>&1 &
+echo "starting nsqd --data-path=/tmp --lookupd-tcp-address=127.0.0.1:4160 --tls-cert=./test/cert.pem --tls-key=./test/key.pem"
+./nsqd --data-path=/tmp --lookupd-tcp-address=127.0.0.1:4160 --tls-cert=./test/cert.pem --tls-key=./test/key.pem >/dev/null 2>&1 &
 NSQD_PID=$!
 popd >/dev/null
 